@@ -5,6 +5,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type AutoCompleter interface {
@@ -15,9 +21,100 @@ type AutoCompleter interface {
 	//   Do("g", 1) => ["o", "it", "it-shell", "rep"], 1
 	//   Do("gi", 2) => ["t", "t-shell"], 2
 	//   Do("git", 3) => ["", "-shell"], 3
+	//
+	// commentLine[i] is the comment of newLine[i], it can be nil or shorter
+	// than newLine if there are no comments, the missing ones are treated
+	// as empty and the extra ones are dropped.
 	Do(line []rune, pos int) (newLine, commentLine [][]rune, length int)
 }
 
+// Candidate is a completion candidate with its comment, the comment can be
+// computed lazily by CommentFunc, which is only called when the candidate
+// gets selected in the complete select mode, and only once.
+type Candidate struct {
+	Name        []rune
+	Comment     []rune
+	CommentFunc func() []rune
+}
+
+// CandidateCompleter can be implemented by an AutoCompleter to return
+// Candidates instead of names and comments, readline prefers DoCandidates
+// over Do if it's implemented.
+type CandidateCompleter interface {
+	// DoCandidates is the same as AutoCompleter.Do
+	DoCandidates(line []rune, pos int) (candidates []Candidate, length int)
+}
+
+// CandidateFunc is an AutoCompleter which returns Candidates.
+type CandidateFunc func(line []rune, pos int) (candidates []Candidate, length int)
+
+func (f CandidateFunc) DoCandidates(line []rune, pos int) ([]Candidate, int) {
+	return f(line, pos)
+}
+
+// Do ignores the lazy comments.
+func (f CandidateFunc) Do(line []rune, pos int) (newLine, commentLine [][]rune, length int) {
+	candidates, length := f(line, pos)
+	for _, c := range candidates {
+		newLine = append(newLine, c.Name)
+		commentLine = append(commentLine, c.Comment)
+	}
+	return newLine, commentLine, length
+}
+
+// DefaultCompletionSelectMarker marks the selected candidate if NO_COLOR
+// is set and Config.CompletionSelectMarker is empty.
+const DefaultCompletionSelectMarker = "> "
+
+// DefaultIncrementalCompletionDelay is the default Config.IncrementalCompletionDelay
+const DefaultIncrementalCompletionDelay = 100 * time.Millisecond
+
+// DefaultCompletionMaxCandidates is the default Config.CompletionMaxCandidates
+const DefaultCompletionMaxCandidates = 1000
+
+// CompletionStyle is the colors of the completion menu, every field is the
+// parameters of an SGR sequence, i.e. "30" for \033[30m, or "38;5;240" for
+// a 256-color one. An empty field means the default one.
+type CompletionStyle struct {
+	// the selected candidate, "30" and "47" by default
+	SelectedFg string
+	SelectedBg string
+	// the comments and the "+N more" line, "90" by default
+	CommentFg string
+}
+
+// selected returns the SGR sequence of the selected candidate.
+func (s CompletionStyle) selected() string {
+	return sgr(s.SelectedFg, "30") + sgr(s.SelectedBg, "47")
+}
+
+// comment returns the SGR sequence of the comments.
+func (s CompletionStyle) comment() string {
+	return sgr(s.CommentFg, "90")
+}
+
+func sgr(param, def string) string {
+	if param == "" {
+		param = def
+	}
+	return "\033[" + param + "m"
+}
+
+// SeparatorCompleter can be implemented by an AutoCompleter whose candidates
+// are made of segments, i.e. paths separated by '/'. The common prefix of
+// the candidates is then completed one segment at a time instead of at once.
+type SeparatorCompleter interface {
+	SegmentSeparator() rune
+}
+
+// segmentPrefix cuts same after the first sep in it.
+func segmentPrefix(same []rune, sep rune) []rune {
+	if idx := runes.Index(sep, same); idx >= 0 {
+		return same[:idx+1]
+	}
+	return same
+}
+
 type TabCompleter struct{}
 
 func (t *TabCompleter) Do([]rune, int) ([][]rune, [][]rune, int) {
@@ -39,6 +136,8 @@ type opCompleter struct {
 	candidate    [][]rune
 	// add
 	candidateComments [][]rune
+	// Candidate.CommentFunc of each candidate, set to nil once it's called.
+	candidateCommentFuncs []func() []rune
 	// 按下tab时，光标左边的所有字符串。
 	candidateSource []rune
 	// Do 的返回值
@@ -50,6 +149,29 @@ type opCompleter struct {
 	candidateChoise int
 	// 候选项排成几列
 	candidateColNum int
+	// how many candidates are dropped by Config.CompletionMaxCandidates
+	candidateMore int
+	// the first row shown in the viewport, see Config.CompletionMaxRows
+	candidateTop int
+	// the rows of the menu drawn above the input, see
+	// Config.CompletionMenuAbove
+	menuAbove int
+	// the runes of the word after the cursor, replaced by the accepted
+	// candidate if Config.CompletionWordRegex is set.
+	candidateTail int
+	// the runes before the cursor replaced by the accepted candidate, the
+	// candidates are whole words rather than suffixes if it's not 0.
+	candidateReplace int
+
+	// the line and cursor before the last accepted candidate,
+	// kept if Config.CompletionKeepQuery is enabled. keptLine is the line
+	// after accepting, the query is forgotten once the line differs.
+	keptQuery    []rune
+	keptQueryPos int
+	keptLine     []rune
+
+	// the last result of doComplete
+	cache *completeResult
 }
 
 func newOpCompleter(w io.Writer, op *Operation, width int) *opCompleter {
@@ -60,13 +182,400 @@ func newOpCompleter(w io.Writer, op *Operation, width int) *opCompleter {
 	}
 }
 
+// applyCandidate writes the accepted candidate into the buffer.
+func (o *opCompleter) applyCandidate(candidate []rune) {
+	if o.op.cfg.CompletionKeepQuery {
+		o.keptQuery, o.keptQueryPos = o.op.buf.Runes(), o.op.buf.Pos()
+		defer func() { o.keptLine = o.op.buf.Runes() }()
+	}
+	if o.candidateTail > 0 || o.candidateReplace > 0 {
+		o.op.buf.ReplaceAround(o.candidateReplace, o.candidateTail, candidate)
+		return
+	}
+	o.op.buf.WriteRunes(candidate)
+}
+
+// selectCandidate reports the accepted idx-th candidate to
+// Config.OnCompleteSelected and writes it into the buffer, candidate is the
+// candidate or a part of it.
+func (o *opCompleter) selectCandidate(idx int, candidate []rune) {
+	if f := o.op.cfg.OnCompleteSelected; f != nil {
+		f(append(o.op.buf.RuneSlice(-o.candidateOff), o.candidate[idx]...), idx)
+	}
+	o.applyCandidate(candidate)
+}
+
+// RevertCompletion restores the line typed before the last accepted
+// candidate, it only works if Config.CompletionKeepQuery is enabled.
+func (o *opCompleter) RevertCompletion() bool {
+	if o.keptQuery == nil {
+		return false
+	}
+	o.op.buf.SetWithIdx(o.keptQueryPos, o.keptQuery)
+	o.ForgetCompletionQuery()
+	return true
+}
+
+// ForgetCompletionQuery drops the line kept by Config.CompletionKeepQuery.
+func (o *opCompleter) ForgetCompletionQuery() {
+	o.keptQuery = nil
+	o.keptQueryPos = 0
+	o.keptLine = nil
+}
+
+// forgetEditedQuery drops the kept query once the line is edited after the
+// candidate is accepted.
+func (o *opCompleter) forgetEditedQuery() {
+	if o.keptQuery != nil && !runes.Equal(o.op.buf.Runes(), o.keptLine) {
+		o.ForgetCompletionQuery()
+	}
+}
+
+// isAcceptChar reports whether r is one of Config.CompletionAcceptChars.
+func (o *opCompleter) isAcceptChar(r rune) bool {
+	for _, c := range o.op.GetConfig().CompletionAcceptChars {
+		if c == r {
+			return true
+		}
+	}
+	return false
+}
+
+// doComplete returns the candidates of line at pos, the result is kept
+// until the line or the cursor changes, so the completer is not called again
+// when the candidates of the same line are listed and cycled.
+func (o *opCompleter) doComplete(line []rune, pos int) (newLines, comments [][]rune, commentFuncs []func() []rune, offset int) {
+	if c := o.cache; c != nil && c.pos == pos && runes.Equal(c.line, line) {
+		o.candidateTail, o.candidateReplace = c.tail, c.replace
+		return c.result()
+	}
+	newLines, comments, commentFuncs, offset = o.complete(line, pos)
+	o.cache = &completeResult{
+		line:         runes.Copy(line),
+		pos:          pos,
+		newLines:     newLines,
+		comments:     comments,
+		commentFuncs: commentFuncs,
+		offset:       offset,
+		tail:         o.candidateTail,
+		replace:      o.candidateReplace,
+	}
+	return o.cache.result()
+}
+
+// completeResult is the result of complete kept by doComplete.
+type completeResult struct {
+	line         []rune
+	pos          int
+	newLines     [][]rune
+	comments     [][]rune
+	commentFuncs []func() []rune
+	offset       int
+	tail         int
+	replace      int
+}
+
+// result returns copies of the kept slices, since the callers change them,
+// i.e. runes.Aggregate strips the common prefix of the candidates.
+func (c *completeResult) result() (newLines, comments [][]rune, commentFuncs []func() []rune, offset int) {
+	newLines = append([][]rune(nil), c.newLines...)
+	comments = append([][]rune(nil), c.comments...)
+	commentFuncs = append([]func() []rune(nil), c.commentFuncs...)
+	return newLines, comments, commentFuncs, c.offset
+}
+
+// forgetCache drops the candidates kept by doComplete, so the completer is
+// called next time.
+func (o *opCompleter) forgetCache() {
+	o.cache = nil
+}
+
+// complete calls the AutoCompleter, the Candidates returned by a
+// CandidateCompleter are split into names, comments and lazy comments.
+func (o *opCompleter) complete(line []rune, pos int) (newLines, comments [][]rune, commentFuncs []func() []rune, offset int) {
+	o.candidateTail = 0
+	o.candidateReplace = 0
+	if min := o.op.cfg.CompleteMinChars; min > 0 && o.typedWordLen(line, pos) < min {
+		return
+	}
+	re := o.op.cfg.CompletionWordRegex
+	start := pos
+	if re != nil {
+		var end int
+		start, end = wordAt(re, line, pos)
+		o.candidateTail = end - pos
+	}
+	if o.op.cfg.FuzzyComplete {
+		if re == nil {
+			start = wordStart(line, pos)
+			return o.fuzzyComplete(append(runes.Copy(line[:start]), line[pos:]...), start, line[start:pos])
+		}
+		return o.fuzzyComplete(nil, 0, line[start:pos])
+	}
+	if re != nil {
+		line, pos = line[start:pos], pos-start
+	} else if o.op.cfg.CompleteQuoteAware {
+		return o.quotedComplete(line, pos)
+	}
+	return o.callCompleter(line, pos)
+}
+
+// quotedComplete completes the shell-style word before the cursor, the
+// completer receives it unquoted. The candidates are quoted whole words
+// replacing the typed one if it's quoted or they contain spaces.
+func (o *opCompleter) quotedComplete(line []rune, pos int) (newLines, comments [][]rune, commentFuncs []func() []rune, offset int) {
+	start, word, quote := quotedWordAt(line, pos)
+	unquoted := append(append(runes.Copy(line[:start]), word...), line[pos:]...)
+	newLines, comments, commentFuncs, offset = o.callCompleter(unquoted, start+len(word))
+
+	// the typed word is quoted or escaped
+	requote := !runes.Equal(word, line[start:pos])
+	for _, name := range newLines {
+		if runes.Index(' ', trimTrailingSpace(name)) >= 0 {
+			requote = true
+		}
+	}
+	if !requote {
+		return newLines, comments, commentFuncs, offset
+	}
+	// the part of word before the candidates, it's all of it unless they
+	// are whole names too
+	prefix := word[:len(word)-o.candidateReplace]
+	for i, name := range newLines {
+		newLines[i] = quoteWord(append(runes.Copy(prefix), name...), quote)
+	}
+	o.candidateReplace = pos - start
+	return newLines, comments, commentFuncs, 0
+}
+
+// callCompleter calls Config.AutoComplete.
+func (o *opCompleter) callCompleter(line []rune, pos int) (newLines, comments [][]rune, commentFuncs []func() []rune, offset int) {
+	ac := o.op.autoComplete()
+	if ac == nil {
+		return nil, nil, nil, 0
+	}
+	if pc, ok := ac.(PrefixCompleterInterface); ok && o.op.cfg.CompleteIgnoreCase {
+		// the candidates are whole names replacing the typed word
+		newLines, comments, o.candidateReplace = DoFold(pc, line, pos)
+		return newLines, comments, nil, 0
+	}
+	cc, ok := ac.(CandidateCompleter)
+	if !ok {
+		newLines, comments, offset = ac.Do(line, pos)
+		return
+	}
+	candidates, offset := cc.DoCandidates(line, pos)
+	for _, c := range candidates {
+		newLines = append(newLines, c.Name)
+		comments = append(comments, c.Comment)
+		commentFuncs = append(commentFuncs, onceComment(c.CommentFunc))
+	}
+	return
+}
+
+// onceComment wraps a Candidate.CommentFunc to call it once at most, the
+// funcs are kept by doComplete and listed again.
+func onceComment(f func() []rune) func() []rune {
+	if f == nil {
+		return nil
+	}
+	var (
+		done    bool
+		comment []rune
+	)
+	return func() []rune {
+		if !done {
+			comment, done = f(), true
+		}
+		return comment
+	}
+}
+
+// fuzzyComplete asks the candidates with the pattern removed from the line,
+// and returns the whole words matching pattern, the best ones first.
+func (o *opCompleter) fuzzyComplete(line []rune, pos int, pattern []rune) (newLines, comments [][]rune, commentFuncs []func() []rune, offset int) {
+	names, nameComments, nameCommentFuncs, nameOffset := o.callCompleter(line, pos)
+	nameComments = alignComments(nameComments, len(names))
+	matcher := o.op.cfg.FuzzyMatcher
+	if matcher == nil {
+		matcher = DefaultFuzzyMatcher
+	}
+
+	// the typed runes the names share, they are replaced too
+	prefix := line[pos-nameOffset : pos]
+	type match struct {
+		idx   int
+		name  []rune
+		score int
+	}
+	matches := make([]match, 0, len(names))
+	for idx, name := range names {
+		name = append(runes.Copy(prefix), name...)
+		if ok, score := matcher(string(pattern), string(name)); ok {
+			matches = append(matches, match{idx, name, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	for _, m := range matches {
+		newLines = append(newLines, m.name)
+		comments = append(comments, nameComments[m.idx])
+		if m.idx < len(nameCommentFuncs) {
+			commentFuncs = append(commentFuncs, nameCommentFuncs[m.idx])
+		} else {
+			commentFuncs = append(commentFuncs, nil)
+		}
+	}
+	o.candidateReplace = len(pattern) + nameOffset
+	return newLines, comments, commentFuncs, 0
+}
+
+// DefaultFuzzyMatcher is the default Config.FuzzyMatcher, candidate matches
+// if the runes of pattern appear in it in order, ignoring case. The
+// consecutive runes and the ones starting a word score higher, and the
+// runes skipped between them lower the score.
+func DefaultFuzzyMatcher(pattern, candidate string) (matched bool, score int) {
+	p := []rune(strings.ToLower(pattern))
+	c := []rune(strings.ToLower(candidate))
+	j, last := 0, -1
+	for i := 0; i < len(c) && j < len(p); i++ {
+		if c[i] != p[j] {
+			continue
+		}
+		switch {
+		case i == 0 || last >= 0 && last == i-1:
+			score += 8
+		case strings.ContainsRune(" -_./:", c[i-1]):
+			score += 6
+		default:
+			score++
+		}
+		if last >= 0 {
+			score -= i - last - 1
+		}
+		last = i
+		j++
+	}
+	if j < len(p) {
+		return false, 0
+	}
+	return true, score
+}
+
+// quotedWordAt returns the start of the shell-style word before pos, the
+// word unquoted, and the quote it's opened with, which is 0 if there is
+// none. A backslash escapes the next rune outside the single quotes.
+func quotedWordAt(line []rune, pos int) (start int, word []rune, quote rune) {
+	var inQuote rune
+	escaped := false
+	for i, r := range line[:pos] {
+		switch {
+		case escaped:
+			escaped = false
+			word = append(word, r)
+		case r == '\\' && inQuote != '\'':
+			escaped = true
+		case inQuote != 0:
+			if r == inQuote {
+				inQuote = 0
+			} else {
+				word = append(word, r)
+			}
+		case r == '"' || r == '\'':
+			inQuote = r
+			if quote == 0 {
+				quote = r
+			}
+		case unicode.IsSpace(r):
+			start, word, quote = i+1, nil, 0
+		default:
+			word = append(word, r)
+		}
+	}
+	return start, word, quote
+}
+
+// quoteWord quotes word by quote, or '"' if it's 0. A trailing space is
+// kept after the closing quote.
+func quoteWord(word []rune, quote rune) []rune {
+	name := trimTrailingSpace(word)
+	if quote == 0 || quote == '\'' && runes.Index('\'', name) >= 0 {
+		quote = '"'
+	}
+	ret := []rune{quote}
+	for _, r := range name {
+		if quote == '"' && (r == '"' || r == '\\') {
+			ret = append(ret, '\\')
+		}
+		ret = append(ret, r)
+	}
+	ret = append(ret, quote)
+	return append(ret, word[len(name):]...)
+}
+
+func trimTrailingSpace(r []rune) []rune {
+	if n := len(r); n > 0 && r[n-1] == ' ' {
+		return r[:n-1]
+	}
+	return r
+}
+
+// wordStart returns the start of the word before pos, words are separated
+// by spaces.
+func wordStart(line []rune, pos int) int {
+	for pos > 0 && !unicode.IsSpace(line[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// typedWordLen returns how many runes of the word are before pos, the words
+// are separated as Config.WordBreakFunc says.
+func (o *opCompleter) typedWordLen(line []rune, pos int) int {
+	start := pos
+	for start > 0 && !o.op.buf.isWordBreak(line[start-1], false) {
+		start--
+	}
+	return pos - start
+}
+
+// wordAt returns the bounds of the match of re around pos, in runes.
+// It's an empty word at pos if there is no such match.
+func wordAt(re *regexp.Regexp, line []rune, pos int) (start, end int) {
+	s := string(line)
+	bytePos := len(string(line[:pos]))
+	for _, m := range re.FindAllStringIndex(s, -1) {
+		if m[0] <= bytePos && bytePos <= m[1] {
+			return utf8.RuneCountInString(s[:m[0]]), utf8.RuneCountInString(s[:m[1]])
+		}
+	}
+	return pos, pos
+}
+
+// loadLazyComment computes the comment of the selected candidate if it's
+// provided by Candidate.CommentFunc.
+func (o *opCompleter) loadLazyComment() {
+	idx := o.candidateChoise
+	if idx < 0 || idx >= len(o.candidateCommentFuncs) || idx >= len(o.candidateComments) {
+		return
+	}
+	if f := o.candidateCommentFuncs[idx]; f != nil {
+		o.candidateCommentFuncs[idx] = nil
+		o.candidateComments[idx] = f()
+	}
+}
+
 func (o *opCompleter) doSelect() {
 	if len(o.candidate) == 1 {
-		o.op.buf.WriteRunes(o.candidate[0])
+		candidate := o.candidate[0]
+		o.selectCandidate(0, candidate)
 		o.ExitCompleteMode(false)
+		o.chainComplete(candidate)
 		return
 	}
 	o.nextCandidate(1)
+	o.loadLazyComment()
 	o.CompleteRefresh()
 }
 
@@ -98,7 +607,7 @@ func (o *opCompleter) OnComplete() bool {
 
 	o.ExitCompleteSelectMode()
 	o.candidateSource = rs
-	newLines, commentLines, offset := o.op.cfg.AutoComplete.Do(rs, buf.idx)
+	newLines, commentLines, commentFuncs, offset := o.doComplete(rs, buf.idx)
 	if len(newLines) == 0 {
 		o.ExitCompleteMode(false)
 		return true
@@ -106,24 +615,130 @@ func (o *opCompleter) OnComplete() bool {
 
 	// only Aggregate candidates in non-complete mode
 	if !o.IsInCompleteMode() {
+		if len(newLines) == 1 && o.candidateTail == 0 && runes.Equal(newLines[0], buf.RuneSlice(-o.candidateReplace)) {
+			// the word is already complete
+			o.ExitCompleteMode(false)
+			if !o.op.cfg.CompleteExactMatchHint {
+				return false
+			}
+			comment := alignComments(commentLines, 1)[0]
+			if len(commentFuncs) > 0 && commentFuncs[0] != nil {
+				comment = commentFuncs[0]()
+			}
+			hint := o.op.cfg.translate(MsgAlreadyComplete)
+			if len(comment) > 0 {
+				hint = o.op.cfg.translate(MsgAlreadyCompleteComment, string(comment))
+			}
+			o.op.showHint(hint)
+			return true
+		}
 		if len(newLines) == 1 {
-			buf.WriteRunes(newLines[0])
+			o.applyCandidate(newLines[0])
 			o.ExitCompleteMode(false)
+			o.chainComplete(newLines[0])
 			return true
 		}
 
-		same, size := runes.Aggregate(newLines)
-		if size > 0 {
+		switch {
+		case o.op.cfg.FuzzyComplete:
+		case o.candidateReplace > 0:
+			// the whole names share more than the typed word, Aggregate
+			// works on a copy since the names are listed otherwise.
+			same, size := runes.Aggregate(append([][]rune(nil), newLines...))
+			if size > o.candidateReplace {
+				buf.ReplaceAround(o.candidateReplace, 0, same)
+				o.ExitCompleteMode(false)
+				return true
+			}
+		default:
+			same, size := runes.Aggregate(newLines)
+			if size == 0 {
+				break
+			}
+			if sc, ok := o.op.autoComplete().(SeparatorCompleter); ok {
+				same = segmentPrefix(same, sc.SegmentSeparator())
+			}
 			buf.WriteRunes(same)
 			o.ExitCompleteMode(false)
 			return true
 		}
 	}
 
-	o.EnterCompleteMode(offset, newLines, commentLines)
+	o.listCandidates(offset, newLines, commentLines, commentFuncs)
 	return true
 }
 
+// chainComplete lists the candidates of the next word after candidate is
+// accepted, see Config.ChainCompletion. A single candidate is listed rather
+// than accepted, so it doesn't go on by itself.
+func (o *opCompleter) chainComplete(candidate []rune) {
+	if !o.op.cfg.ChainCompletion || len(candidate) == 0 || candidate[len(candidate)-1] != ' ' {
+		return
+	}
+	buf := o.op.buf
+	rs := buf.Runes()
+	newLines, commentLines, commentFuncs, offset := o.doComplete(rs, buf.Pos())
+	if len(newLines) == 0 || len(newLines) == 1 && len(newLines[0]) == 0 {
+		return
+	}
+	o.candidateSource = rs
+	o.listCandidates(offset, newLines, commentLines, commentFuncs)
+}
+
+// listCandidates enters the complete mode with at most
+// Config.CompletionMaxCandidates and Config.MaxCompletionCandidates
+// candidates.
+func (o *opCompleter) listCandidates(offset int, newLines, commentLines [][]rune, commentFuncs []func() []rune) {
+	more := 0
+	max := o.op.cfg.CompletionMaxCandidates
+	if m := o.op.cfg.MaxCompletionCandidates; m > 0 && (max <= 0 || m < max) {
+		max = m
+	}
+	if max > 0 && len(newLines) > max {
+		more = len(newLines) - max
+		newLines = newLines[:max]
+		if len(commentLines) > max {
+			commentLines = commentLines[:max]
+		}
+		if len(commentFuncs) > max {
+			commentFuncs = commentFuncs[:max]
+		}
+	}
+	o.candidateMore = more
+	o.EnterCompleteMode(offset, newLines, commentLines)
+	o.candidateCommentFuncs = commentFuncs
+}
+
+// ShowCompletions lists the candidates for Config.IncrementalCompletion and
+// Ctrl+D with ListCompletions, the line is left untouched. The list is dismissed if there is no
+// candidate, or the word is already complete.
+func (o *opCompleter) ShowCompletions() {
+	buf := o.op.buf
+	rs := buf.Runes()
+	var newLines, commentLines [][]rune
+	var commentFuncs []func() []rune
+	offset := 0
+	if o.width > 0 && buf.Len() > 0 {
+		newLines, commentLines, commentFuncs, offset = o.doComplete(rs, buf.Pos())
+	}
+	o.ExitCompleteMode(false)
+	if len(newLines) == 0 || len(newLines) == 1 && len(newLines[0]) == 0 {
+		buf.Refresh(nil)
+		return
+	}
+	o.candidateSource = rs
+	buf.SetHint(nil)
+	buf.Refresh(nil)
+	o.listCandidates(offset, newLines, commentLines, commentFuncs)
+}
+
+// SelectLastCandidate selects the last candidate in the complete select mode.
+func (o *opCompleter) SelectLastCandidate() {
+	o.candidateChoise = len(o.candidate) - 1
+	o.loadLazyComment()
+	o.CompleteRefresh()
+}
+
 func (o *opCompleter) IsInCompleteSelectMode() bool {
 	return o.inSelectMode
 }
@@ -137,62 +752,168 @@ func (o *opCompleter) HandleCompleteSelect(r rune) bool {
 	switch r {
 	case CharEnter, CharCtrlJ:
 		next = false
-		o.op.buf.WriteRunes(o.op.candidate[o.op.candidateChoise])
-		o.ExitCompleteMode(false)
-	case CharLineStart:
-		num := o.candidateChoise % o.candidateColNum
-		o.nextCandidate(-num)
-	case CharLineEnd:
-		num := o.candidateColNum - o.candidateChoise%o.candidateColNum - 1
-		o.candidateChoise += num
-		if o.candidateChoise >= len(o.candidate) {
-			o.candidateChoise = len(o.candidate) - 1
+		if o.candidateChoise < 0 {
+			// nothing is selected yet, see EnterSubmits
+			o.candidateChoise = 0
 		}
+		o.selectCandidate(o.candidateChoise, o.candidate[o.candidateChoise])
+		o.ExitCompleteMode(false)
+	case CharLineStart, CharLineEnd, CharNext, CharPrev:
+		o.moveCandidate(r)
 	case CharBackspace:
-		o.ExitCompleteSelectMode()
-		next = false
+		o.op.buf.Backspace()
+		return o.refilter()
 	case CharTab, CharForward:
 		o.doSelect()
 	case CharBell, CharInterrupt:
 		o.ExitCompleteMode(true)
 		next = false
-	case CharNext:
-		tmpChoise := o.candidateChoise + o.candidateColNum
-		if tmpChoise >= o.getMatrixSize() {
-			tmpChoise -= o.getMatrixSize()
-		} else if tmpChoise >= len(o.candidate) {
-			tmpChoise += o.candidateColNum
-			tmpChoise -= o.getMatrixSize()
-		}
-		o.candidateChoise = tmpChoise
 	case CharBackward:
-		o.nextCandidate(-1)
-	case CharPrev:
-		tmpChoise := o.candidateChoise - o.candidateColNum
-		if tmpChoise < 0 {
-			tmpChoise += o.getMatrixSize()
-			if tmpChoise >= len(o.candidate) {
-				tmpChoise -= o.candidateColNum
-			}
+		if o.candidateChoise < 0 {
+			// nothing is selected yet, see refilter
+			o.candidateChoise = len(o.candidate) - 1
+			break
 		}
-		o.candidateChoise = tmpChoise
+		o.nextCandidate(-1)
 	default:
 		next = false
+		if o.isAcceptChar(r) && o.candidateChoise >= 0 {
+			// accept the candidate, and r will be inserted after it.
+			candidate := o.candidate[o.candidateChoise]
+			if n := len(candidate); n > 0 && (candidate[n-1] == ' ' || candidate[n-1] == r) {
+				candidate = candidate[:n-1]
+			}
+			o.selectCandidate(o.candidateChoise, candidate)
+			o.ExitCompleteMode(false)
+			break
+		}
+		if IsPrintable(r) {
+			o.op.buf.WriteRune(r)
+			return o.refilter()
+		}
 		o.ExitCompleteSelectMode()
 	}
 	if next {
+		o.loadLazyComment()
 		o.CompleteRefresh()
 		return true
 	}
 	return false
 }
 
+// refilter lists the candidates of the line edited in the complete select
+// mode, the menu is closed if there is none. It always returns true since
+// the key is handled, ioloop goes on with the Listener, the hint and the
+// history then as the line is changed.
+func (o *opCompleter) refilter() bool {
+	buf := o.op.buf
+	rs := buf.Runes()
+	newLines, commentLines, commentFuncs, offset := o.doComplete(rs, buf.Pos())
+	if len(newLines) == 0 {
+		o.ExitCompleteMode(false)
+		buf.Refresh(nil)
+		return true
+	}
+	o.candidateSource = rs
+	o.candidateChoise = -1
+	o.listCandidates(offset, newLines, commentLines, commentFuncs)
+	return true
+}
+
+// EnterSubmits reports whether Enter should submit the line rather than
+// accept a candidate, that is no candidate is selected yet and
+// Config.CompletionEnterAccepts is false.
+func (o *opCompleter) EnterSubmits() bool {
+	return o.IsInCompleteSelectMode() && o.candidateChoise < 0 && !o.op.cfg.CompletionEnterAccepts
+}
+
 func (o *opCompleter) getMatrixSize() int {
+	return o.candidateRows() * o.candidateColNum
+}
+
+func (o *opCompleter) candidateRows() int {
 	line := len(o.candidate) / o.candidateColNum
 	if len(o.candidate)%o.candidateColNum != 0 {
 		line++
 	}
-	return line * o.candidateColNum
+	return line
+}
+
+// candidateCell returns the cell of the idx-th candidate in the menu, the
+// candidates are listed row by row, or column by column if
+// Config.CompletionColumnMajor is set.
+func (o *opCompleter) candidateCell(idx int) (row, col int) {
+	if o.op.cfg.CompletionColumnMajor {
+		rows := o.candidateRows()
+		return idx % rows, idx / rows
+	}
+	return idx / o.candidateColNum, idx % o.candidateColNum
+}
+
+// candidateAt returns the index of the candidate in the cell, or -1 if the
+// cell is empty.
+func (o *opCompleter) candidateAt(row, col int) int {
+	rows := o.candidateRows()
+	if row < 0 || row >= rows || col < 0 || col >= o.candidateColNum {
+		return -1
+	}
+	idx := row*o.candidateColNum + col
+	if o.op.cfg.CompletionColumnMajor {
+		idx = col*rows + row
+	}
+	if idx >= len(o.candidate) {
+		return -1
+	}
+	return idx
+}
+
+// displayOrder returns the candidate indexes in the order they are drawn,
+// the empty cells before the last candidate are -1.
+func (o *opCompleter) displayOrder() []int {
+	order := make([]int, 0, o.getMatrixSize())
+	last := 0
+	for row := 0; row < o.candidateRows(); row++ {
+		for col := 0; col < o.candidateColNum; col++ {
+			idx := o.candidateAt(row, col)
+			order = append(order, idx)
+			if idx >= 0 {
+				last = len(order)
+			}
+		}
+	}
+	return order[:last]
+}
+
+// moveCandidate moves the selection in the menu, Up and Down stay in the
+// column and wrap around, Home and End move to the ends of the row.
+func (o *opCompleter) moveCandidate(r rune) {
+	if o.candidateChoise < 0 {
+		o.candidateChoise = 0
+		return
+	}
+	row, col := o.candidateCell(o.candidateChoise)
+	switch r {
+	case CharLineStart:
+		col = 0
+	case CharLineEnd:
+		col = o.candidateColNum - 1
+		for o.candidateAt(row, col) < 0 {
+			col--
+		}
+	case CharNext:
+		row++
+		if o.candidateAt(row, col) < 0 {
+			row = 0
+		}
+	case CharPrev:
+		if row--; row < 0 {
+			row = o.candidateRows() - 1
+			for o.candidateAt(row, col) < 0 {
+				row--
+			}
+		}
+	}
+	o.candidateChoise = o.candidateAt(row, col)
 }
 
 func (o *opCompleter) OnWidthChange(newWidth int) {
@@ -204,62 +925,152 @@ func (o *opCompleter) CompleteRefresh() {
 		return
 	}
 	// 光标所在行后面还有多少行+1。
-	lineCnt := o.op.buf.CursorLineCount()
+	lineCnt := o.op.buf.CursorLineCount() + o.op.buf.StatusLineCount()
 	// 候选项中最大宽度是多少
 	colWidth := 0
-	for i, c := range o.candidate {
-		w := runes.WidthAll(c)
-		// comment add here
-		w += runes.WidthAll(o.candidateComments[i])
-		if w > colWidth {
-			colWidth = w
+	// the width of the candidates padded to the comment column
+	nameCol := 0
+	if o.op.cfg.CompletionAlignComments {
+		commentCol := 0
+		for i := range o.candidate {
+			if w := o.candidateNameWidth(i); w > nameCol {
+				nameCol = w
+			}
+			if w := o.candidateCommentWidth(i); w > commentCol {
+				commentCol = w
+			}
+		}
+		if commentCol > 0 {
+			// a space before the comments
+			nameCol++
 		}
+		colWidth = nameCol + commentCol
+	} else {
+		for i := range o.candidate {
+			w := o.candidateWidth(i)
+			if w > colWidth {
+				colWidth = w
+			}
+		}
+	}
+	// the selected candidate is marked by marker if set, and the others
+	// are indented by the same width.
+	colorful := !noColor()
+	style := o.op.cfg.CompletionStyle
+	marker := []rune(o.op.cfg.CompletionSelectMarker)
+	if len(marker) == 0 && !colorful {
+		marker = []rune(DefaultCompletionSelectMarker)
 	}
+	markerWidth := runes.WidthAll(marker)
 	// 候选项中最大宽度 + 输入中与原始候选项的公共前缀的长度。
-	colWidth += o.candidateOff + 1
+	colWidth += o.candidateOff + 1 + markerWidth
 	// same是自动填充之前，光标左边的字符串，不包括prompt。
 	same := o.op.buf.RuneSlice(-o.candidateOff)
 
 	// -1 to avoid reach the end of line
 	width := o.width - 1
+	if o.op.cfg.CompletionMaxRows > 0 {
+		// room for the scroll indicator
+		width -= 2
+	}
 	colNum := width / colWidth
 	if colNum != 0 {
 		colWidth += (width - (colWidth * colNum)) / colNum
+	} else {
+		// the widest candidate doesn't fit in the screen, it will be truncated
+		colNum, colWidth = 1, width
 	}
 
 	o.candidateColNum = colNum
+	order := o.displayOrder()
+	rows := (len(order) + colNum - 1) / colNum
+	top, bottom := o.viewport(rows)
+	menuRows := bottom - top
+	if o.candidateMore > 0 {
+		menuRows++
+	}
+	// the lines of the prompt and the input above the cursor
+	cursorLine := o.op.buf.CursorLine()
+	above := o.menuFitsAbove(cursorLine, menuRows)
+
 	buf := bufio.NewWriter(o.w)
-	// 移动到输入形成的行的后面一个行，这是接下来候选项输入的起始位置。
-	buf.Write(bytes.Repeat([]byte("\n"), lineCnt))
+	if above {
+		// the rows left by a longer menu are cleared
+		n := menuRows
+		if o.menuAbove > n {
+			n = o.menuAbove
+		}
+		fmt.Fprintf(buf, "\033[%dA\r", cursorLine+n)
+		buf.Write(bytes.Repeat([]byte("\033[2K\n"), n-menuRows))
+		o.menuAbove = menuRows
+	} else {
+		o.eraseMenuAbove(buf)
+		// 移动到输入形成的行的后面一个行，这是接下来候选项输入的起始位置。
+		buf.Write(bytes.Repeat([]byte("\n"), lineCnt))
+		// 清空光标所在位置+后面直到页面末尾
+		buf.WriteString("\033[J")
+	}
 
 	colIdx := 0
 	lines := 1
-	// 清空光标所在位置+后面直到页面末尾
-	buf.WriteString("\033[J")
-	for idx, c := range o.candidate {
-		// c是当前tab应该选中的候选项
-		inSelect := idx == o.candidateChoise && o.IsInCompleteSelectMode()
-		if inSelect {
-			// 对选中的候选项进行高亮处理
-			buf.WriteString("\033[30;47m")
-		}
-		// 写入共同部分。
-		buf.WriteString(string(same))
-		// 写入去掉共同部分的候选项。
-		buf.WriteString(string(c))
-		// 写入候选项的注释
-		if len(o.candidateComments[idx]) > 0 {
-			buf.WriteString("\033[90m" + string(o.candidateComments[idx]) + "\033[39m")
-		}
-		// 填充到列宽
-		buf.Write(bytes.Repeat([]byte(" "), colWidth-runes.WidthAll(c)-runes.WidthAll(same)-runes.WidthAll(o.candidateComments[idx])))
-
-		if inSelect {
-			// 清空对选中候选项的特色处理
-			buf.WriteString("\033[0m")
+	for k, idx := range order {
+		row := k / colNum
+		if row < top || row >= bottom {
+			continue
+		}
+		if above && colIdx == 0 {
+			// the row is drawn over the screen
+			buf.WriteString("\033[2K")
+		}
+		// idx is -1 for the empty cells of the short columns
+		if idx >= 0 {
+			// c是当前tab应该选中的候选项
+			c := o.candidate[idx]
+			inSelect := idx == o.candidateChoise && o.IsInCompleteSelectMode()
+			if inSelect {
+				buf.WriteString(string(marker))
+			} else {
+				buf.Write(bytes.Repeat([]byte(" "), markerWidth))
+			}
+			if inSelect && colorful {
+				// 对选中的候选项进行高亮处理
+				buf.WriteString(style.selected())
+			}
+			// 共同部分+去掉共同部分的候选项，放不下的部分被截断。
+			name := append(runes.Copy(same), c...)
+			comment := o.candidateComments[idx]
+			w := runes.WidthAll(same) + o.candidateWidth(idx)
+			if nameCol > 0 {
+				pad := nameCol - o.candidateNameWidth(idx)
+				name = append(name, []rune(strings.Repeat(" ", pad))...)
+				w = runes.WidthAll(same) + nameCol + o.candidateCommentWidth(idx)
+			}
+			if w > colWidth-1-markerWidth {
+				name, comment = ellipsize(name, comment, colWidth-1-markerWidth)
+				w = runes.WidthAll(name) + runes.WidthAll(comment)
+			}
+			buf.WriteString(string(name))
+			// 写入候选项的注释
+			if len(comment) > 0 && colorful {
+				buf.WriteString(style.comment() + string(comment) + "\033[39m")
+			} else if len(comment) > 0 {
+				buf.WriteString(string(comment))
+			}
+			// 填充到列宽
+			if pad := colWidth - markerWidth - w; pad > 0 {
+				buf.Write(bytes.Repeat([]byte(" "), pad))
+			}
+
+			if inSelect && colorful {
+				// 清空对选中候选项的特色处理
+				buf.WriteString("\033[0m")
+			}
 		}
 
 		colIdx++
+		if colIdx == colNum || k == len(order)-1 {
+			o.writeScrollIndicator(buf, row == top && top > 0, row == bottom-1 && bottom < rows)
+		}
 		if colIdx == colNum {
 			// 当前候选项已经位于最后一列，应该换行了
 			buf.WriteString("\n")
@@ -267,15 +1078,160 @@ func (o *opCompleter) CompleteRefresh() {
 			colIdx = 0
 		}
 	}
-	// move back
-	// 移动会光标原来所在的行。
-	fmt.Fprintf(buf, "\033[%dA\r", lineCnt-1+lines)
-	// 移动光标到原来的位置。
-	fmt.Fprintf(buf, "\033[%dC", o.op.buf.idx+o.op.buf.PromptLen())
+	if o.candidateMore > 0 {
+		if colIdx != 0 {
+			buf.WriteString("\n")
+			lines++
+		}
+		more := o.op.cfg.translate(MsgMoreCandidates, o.candidateMore)
+		if colorful {
+			more = style.comment() + more + "\033[39m"
+		}
+		if above {
+			buf.WriteString("\033[2K")
+		}
+		buf.WriteString(more)
+	}
+	if above {
+		// the last row goes on to the first line of the prompt
+		if colIdx != 0 || o.candidateMore > 0 {
+			buf.WriteString("\n")
+		}
+		o.moveToCursor(buf, cursorLine)
+	} else {
+		// move back
+		// 移动会光标原来所在的行。
+		fmt.Fprintf(buf, "\033[%dA\r", lineCnt-1+lines)
+		o.moveToCursor(buf, 0)
+	}
 	// 将候选项列表输出到终端。
 	buf.Flush()
 }
 
+// menuFitsAbove reports whether the menu of rows is drawn above the input,
+// cursorLine is the line of the cursor from the first line of the prompt.
+// It's drawn below unless Config.FuncGetCursorPos tells that the screen
+// above the prompt is tall enough, the lines there would be overwritten.
+func (o *opCompleter) menuFitsAbove(cursorLine, rows int) bool {
+	cfg := o.op.cfg
+	if !cfg.CompletionMenuAbove || cfg.FuncGetCursorPos == nil {
+		return false
+	}
+	row, _, err := cfg.FuncGetCursorPos()
+	return err == nil && row-1-cursorLine >= rows
+}
+
+// moveToCursor moves to the column of the cursor from the beginning of the
+// line which is down lines above it.
+func (o *opCompleter) moveToCursor(buf *bufio.Writer, down int) {
+	if down > 0 {
+		fmt.Fprintf(buf, "\033[%dB", down)
+	}
+	// 移动光标到原来的位置。
+	// it's in the middle of the line if the word under the cursor is
+	// completed, and the wide runes take two columns.
+	if col := o.op.buf.CursorColumn(); col > 0 {
+		fmt.Fprintf(buf, "\033[%dC", col)
+	}
+}
+
+// eraseMenuAbove clears the menu drawn above the input, the cursor is
+// moved back.
+func (o *opCompleter) eraseMenuAbove(buf *bufio.Writer) {
+	if o.menuAbove == 0 {
+		return
+	}
+	cursorLine := o.op.buf.CursorLine()
+	fmt.Fprintf(buf, "\033[%dA\r", cursorLine+o.menuAbove)
+	buf.Write(bytes.Repeat([]byte("\033[2K\n"), o.menuAbove))
+	o.moveToCursor(buf, cursorLine)
+	o.menuAbove = 0
+}
+
+// ellipsize truncates a candidate and its comment to width, and marks the
+// cut by an ellipsis.
+func ellipsize(name, comment []rune, width int) ([]rune, []rune) {
+	if width < 1 {
+		return nil, nil
+	}
+	width-- // the ellipsis
+	name = runes.TruncateToWidth(name, width)
+	comment = runes.TruncateToWidth(comment, width-runes.WidthAll(name))
+	if len(comment) == 0 {
+		return append(name, '…'), nil
+	}
+	return name, append(runes.Copy(comment), '…')
+}
+
+// viewport returns the rows [top, bottom) of the menu shown within
+// Config.CompletionMaxRows, it's scrolled to the selected candidate.
+func (o *opCompleter) viewport(rows int) (top, bottom int) {
+	max := o.op.cfg.CompletionMaxRows
+	if max <= 0 || rows <= max {
+		o.candidateTop = 0
+		return 0, rows
+	}
+	if o.candidateChoise >= 0 {
+		row, _ := o.candidateCell(o.candidateChoise)
+		if row < o.candidateTop {
+			o.candidateTop = row
+		} else if row >= o.candidateTop+max {
+			o.candidateTop = row - max + 1
+		}
+	}
+	if o.candidateTop > rows-max {
+		o.candidateTop = rows - max
+	}
+	return o.candidateTop, o.candidateTop + max
+}
+
+// writeScrollIndicator marks the end of a row in the viewport if there
+// are hidden rows above or below it.
+func (o *opCompleter) writeScrollIndicator(buf *bufio.Writer, above, below bool) {
+	var mark string
+	switch {
+	case above && below:
+		mark = "↕"
+	case above:
+		mark = "↑"
+	case below:
+		mark = "↓"
+	default:
+		return
+	}
+	if !noColor() {
+		mark = o.op.cfg.CompletionStyle.comment() + mark + "\033[39m"
+	}
+	fmt.Fprintf(buf, "\033[%dG%s", o.width-1, mark)
+}
+
+// candidateWidth returns the display width of the idx-th candidate and its
+// comment, see Config.CandidateWidthFunc.
+func (o *opCompleter) candidateWidth(idx int) int {
+	if f := o.op.cfg.CandidateWidthFunc; f != nil {
+		return f(o.candidate[idx], o.candidateComments[idx])
+	}
+	return runes.WidthAll(o.candidate[idx]) + runes.WidthAll(o.candidateComments[idx])
+}
+
+// candidateNameWidth returns the display width of the idx-th candidate
+// without its comment.
+func (o *opCompleter) candidateNameWidth(idx int) int {
+	if f := o.op.cfg.CandidateWidthFunc; f != nil {
+		return f(o.candidate[idx], nil)
+	}
+	return runes.WidthAll(o.candidate[idx])
+}
+
+// candidateCommentWidth returns the display width of the comment of the
+// idx-th candidate.
+func (o *opCompleter) candidateCommentWidth(idx int) int {
+	if f := o.op.cfg.CandidateWidthFunc; f != nil {
+		return f(nil, o.candidateComments[idx])
+	}
+	return runes.WidthAll(o.candidateComments[idx])
+}
+
 func (o *opCompleter) aggCandidate(candidate [][]rune) int {
 	offset := 0
 	for i := 0; i < len(candidate[0]); i++ {
@@ -299,22 +1255,48 @@ func (o *opCompleter) EnterCompleteSelectMode() {
 	o.CompleteRefresh()
 }
 
+// alignComments pads or truncates comments to n entries.
+func alignComments(comments [][]rune, n int) [][]rune {
+	if len(comments) == n {
+		return comments
+	}
+	ret := make([][]rune, n)
+	copy(ret, comments)
+	return ret
+}
+
 // EnterCompleteMode offset 光标在补充完候选项之后所在的位置。
 func (o *opCompleter) EnterCompleteMode(offset int, candidate, comments [][]rune) {
 	o.inCompleteMode = true
 	o.candidate = candidate
-	o.candidateComments = comments
+	o.candidateTop = 0
+	o.candidateComments = alignComments(comments, len(candidate))
 	o.candidateOff = offset
 	o.CompleteRefresh()
 }
 
+// EraseMenu clears the menu drawn above the input, the one below is cleared
+// by the redraw of the input.
+func (o *opCompleter) EraseMenu() {
+	if o.menuAbove == 0 {
+		return
+	}
+	buf := bufio.NewWriter(o.w)
+	o.eraseMenuAbove(buf)
+	buf.Flush()
+}
+
 func (o *opCompleter) ExitCompleteSelectMode() {
+	o.EraseMenu()
 	o.inSelectMode = false
 	o.candidate = nil
 	o.candidateComments = nil
+	o.candidateCommentFuncs = nil
 	o.candidateChoise = -1
 	o.candidateOff = -1
 	o.candidateSource = nil
+	o.candidateMore = 0
+	o.candidateTop = 0
 }
 
 func (o *opCompleter) ExitCompleteMode(revent bool) {
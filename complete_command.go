@@ -0,0 +1,96 @@
+package readline
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandCompleter is an AutoCompleter which runs an external command to
+// get the candidates, i.e. the `complete` helper of a CLI tool.
+//
+// The command is run with Args followed by the line and the cursor
+// position (in runes), which are also set as READLINE_LINE and
+// READLINE_POINT in its environment. It prints a candidate per line, a
+// tab separates the candidate from its comment. Like RemoteCompleter the
+// candidates are the whole words under the cursor.
+//
+// A command failing or running longer than Timeout completes nothing.
+type CommandCompleter struct {
+	Path string
+	Args []string
+	// the extra environment of the command, it inherits the one of the
+	// process too
+	Env []string
+	// DefaultRemoteTimeout by default
+	Timeout time.Duration
+	// OnError is called if the command fails
+	OnError func(error)
+}
+
+func (c *CommandCompleter) DoCandidates(line []rune, pos int) ([]Candidate, int) {
+	remote := &RemoteCompleter{
+		Fetch:   c.run,
+		Timeout: c.Timeout,
+		OnError: c.OnError,
+	}
+	return remote.DoCandidates(line, pos)
+}
+
+func (c *CommandCompleter) Do(line []rune, pos int) (newLine, commentLine [][]rune, length int) {
+	return CandidateFunc(c.DoCandidates).Do(line, pos)
+}
+
+func (c *CommandCompleter) run(ctx context.Context, line string, pos int) ([]Candidate, error) {
+	point := strconv.Itoa(pos)
+	args := append(append([]string{}, c.Args...), line, point)
+	cmd := exec.CommandContext(ctx, c.Path, args...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Env = append(cmd.Env, "READLINE_LINE="+line, "READLINE_POINT="+point)
+	// the command is killed once ctx is done, but a child it forks may keep
+	// the output open, so don't wait for it.
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := cmd.Output()
+		done <- result{out, err}
+	}()
+	select {
+	case ret := <-done:
+		if ret.err != nil {
+			return nil, ret.err
+		}
+		return parseCandidates(ret.out), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// parseCandidates parses the lines of "name[\tcomment]", the empty lines
+// are skipped.
+func parseCandidates(out []byte) []Candidate {
+	var ret []Candidate
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		var cand Candidate
+		if idx := strings.IndexByte(text, '\t'); idx >= 0 {
+			cand.Comment = []rune(text[idx+1:])
+			text = text[:idx]
+		}
+		cand.Name = []rune(text)
+		ret = append(ret, cand)
+	}
+	return ret
+}
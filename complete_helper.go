@@ -8,6 +8,10 @@ import (
 // DynamicCompleteFunc Caller type for dynamic completion
 type DynamicCompleteFunc func(string) ([]string, []string)
 
+// DynamicCompleteFuncPos is like DynamicCompleteFunc, but also receives the
+// cursor position in line, counted in runes.
+type DynamicCompleteFuncPos func(line string, pos int) ([]string, []string)
+
 type PrefixCompleterInterface interface {
 	Print(prefix string, level int, buf *bytes.Buffer)
 	Do(line []rune, pos int) (newLine, commentLine [][]rune, length int)
@@ -23,12 +27,21 @@ type DynamicPrefixCompleterInterface interface {
 	GetDynamicNames(line []rune) ([][]rune, [][]rune)
 }
 
+// DynamicPosPrefixCompleterInterface is implemented by the dynamic
+// completers which need the cursor position, it's preferred over
+// GetDynamicNames.
+type DynamicPosPrefixCompleterInterface interface {
+	DynamicPrefixCompleterInterface
+	GetDynamicNamesPos(line []rune, pos int) ([][]rune, [][]rune)
+}
+
 type PrefixCompleter struct {
 	Name            []rune
 	Comment         []rune
 	Dynamic         bool
 	DynamicComments [][]rune
 	Callback        DynamicCompleteFunc
+	CallbackPos     DynamicCompleteFuncPos
 	Children        []PrefixCompleterInterface
 }
 
@@ -70,7 +83,16 @@ func (p *PrefixCompleter) GetComment() []rune {
 }
 
 func (p *PrefixCompleter) GetDynamicNames(line []rune) (names, comments [][]rune) {
-	names1, comments1 := p.Callback(string(line))
+	return p.GetDynamicNamesPos(line, len(line))
+}
+
+func (p *PrefixCompleter) GetDynamicNamesPos(line []rune, pos int) (names, comments [][]rune) {
+	var names1, comments1 []string
+	if p.CallbackPos != nil {
+		names1, comments1 = p.CallbackPos(string(line), pos)
+	} else {
+		names1, comments1 = p.Callback(string(line))
+	}
 	for _, name := range names1 {
 		names = append(names, []rune(name+" "))
 	}
@@ -102,6 +124,18 @@ func PcItem(name string, comment string, pc ...PrefixCompleterInterface) *Prefix
 	}
 }
 
+// PcItemNoSpace is like PcItem, but the name is not followed by a space
+// after completion, i.e. for a name like `--flag=` which is a prefix of the
+// argument.
+func PcItemNoSpace(name string, comment string, pc ...PrefixCompleterInterface) *PrefixCompleter {
+	return &PrefixCompleter{
+		Name:     []rune(name),
+		Comment:  []rune(comment),
+		Dynamic:  false,
+		Children: pc,
+	}
+}
+
 func PcItemDynamic(callback DynamicCompleteFunc, pc ...PrefixCompleterInterface) *PrefixCompleter {
 	return &PrefixCompleter{
 		Callback: callback,
@@ -110,15 +144,37 @@ func PcItemDynamic(callback DynamicCompleteFunc, pc ...PrefixCompleterInterface)
 	}
 }
 
+// PcItemDynamicPos is like PcItemDynamic, but callback also receives the
+// cursor position.
+func PcItemDynamicPos(callback DynamicCompleteFuncPos, pc ...PrefixCompleterInterface) *PrefixCompleter {
+	return &PrefixCompleter{
+		CallbackPos: callback,
+		Dynamic:     true,
+		Children:    pc,
+	}
+}
+
 func (p *PrefixCompleter) Do(line []rune, pos int) (newLine, commentLine [][]rune, offset int) {
-	return doInternal(p, line, pos, line)
+	return doInternal(p, line, pos, line, pos, false)
 }
 
 func Do(p PrefixCompleterInterface, line []rune, pos int) (newLine, commentLine [][]rune, offset int) {
-	return doInternal(p, line, pos, line)
+	return doInternal(p, line, pos, line, pos, false)
+}
+
+// DoFold is like Do but matches the names case-insensitively, see
+// Config.CompleteIgnoreCase. Since the typed word may differ from the name
+// in case, the candidates are the whole names instead of the rest of them,
+// and offset is the length of the typed word they replace.
+func DoFold(p PrefixCompleterInterface, line []rune, pos int) (newLine, commentLine [][]rune, offset int) {
+	return doInternal(p, line, pos, line, pos, true)
 }
 
-func doInternal(p PrefixCompleterInterface, line []rune, pos int, origLine []rune) (newLine, commentLine [][]rune, offset int) {
+func doInternal(p PrefixCompleterInterface, line []rune, pos int, origLine []rune, origPos int, fold bool) (newLine, commentLine [][]rune, offset int) {
+	hasPrefix := runes.HasPrefix
+	if fold {
+		hasPrefix = runes.HasPrefixFold
+	}
 	line = runes.TrimSpaceLeft(line[:pos])
 	goNext := false
 	var lineCompleter PrefixCompleterInterface
@@ -127,7 +183,10 @@ func doInternal(p PrefixCompleterInterface, line []rune, pos int, origLine []run
 		commentNames := make([][]rune, 1)
 
 		childDynamic, ok := child.(DynamicPrefixCompleterInterface)
-		if ok && childDynamic.IsDynamic() {
+		childPos, posOk := child.(DynamicPosPrefixCompleterInterface)
+		if posOk && childPos.IsDynamic() {
+			childNames, commentNames = childPos.GetDynamicNamesPos(origLine, origPos)
+		} else if ok && childDynamic.IsDynamic() {
 			childNames, commentNames = childDynamic.GetDynamicNames(origLine)
 		} else {
 			childNames[0] = child.GetName()
@@ -135,21 +194,37 @@ func doInternal(p PrefixCompleterInterface, line []rune, pos int, origLine []run
 		}
 
 		for i, childName := range childNames {
+			var comment []rune
+			if i < len(commentNames) {
+				comment = commentNames[i]
+			}
 			if len(line) >= len(childName) {
-				if runes.HasPrefix(line, childName) {
+				if hasPrefix(line, childName) {
 					if len(line) == len(childName) {
-						newLine = append(newLine, []rune{' '})
+						if fold {
+							newLine = append(newLine, childName)
+						} else if n := len(childName); n > 0 && childName[n-1] != ' ' {
+							// created by PcItemNoSpace, nothing to add
+							newLine = append(newLine, []rune{})
+						} else {
+							newLine = append(newLine, []rune{' '})
+						}
 					} else {
 						newLine = append(newLine, childName)
 					}
+					commentLine = append(commentLine, comment)
 					offset = len(childName)
 					lineCompleter = child
 					goNext = true
 				}
 			} else {
-				if runes.HasPrefix(childName, line) {
-					newLine = append(newLine, childName[len(line):])
-					commentLine = append(commentLine, commentNames[i])
+				if hasPrefix(childName, line) {
+					if fold {
+						newLine = append(newLine, childName)
+					} else {
+						newLine = append(newLine, childName[len(line):])
+					}
+					commentLine = append(commentLine, comment)
 					offset = len(line)
 					lineCompleter = child
 				}
@@ -168,11 +243,11 @@ func doInternal(p PrefixCompleterInterface, line []rune, pos int, origLine []run
 		}
 
 		tmpLine = append(tmpLine, line[i:]...)
-		return doInternal(lineCompleter, tmpLine, len(tmpLine), origLine)
+		return doInternal(lineCompleter, tmpLine, len(tmpLine), origLine, origPos, fold)
 	}
 
 	if goNext {
-		return doInternal(lineCompleter, nil, 0, origLine)
+		return doInternal(lineCompleter, nil, 0, origLine, origPos, fold)
 	}
 	return
 }
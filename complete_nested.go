@@ -0,0 +1,57 @@
+package readline
+
+import (
+	"sort"
+	"unicode"
+)
+
+// NestedCompleter completes the first word of the line with its keys, and
+// the rest of the line with the AutoCompleter of the first word, i.e.
+//
+//	NestedCompleter{
+//		"checkout": branchCompleter,
+//		"remote":   remoteCompleter,
+//		"status":   nil,
+//	}
+//
+// The AutoCompleter receives the line after the first word and the spaces
+// following it, so it can be a NestedCompleter too. A nil one completes
+// nothing.
+type NestedCompleter map[string]AutoCompleter
+
+func (n NestedCompleter) Do(line []rune, pos int) (newLine [][]rune, commentLine [][]rune, offset int) {
+	start := 0
+	for start < pos && unicode.IsSpace(line[start]) {
+		start++
+	}
+	end := start
+	for end < len(line) && !unicode.IsSpace(line[end]) {
+		end++
+	}
+
+	if pos <= end {
+		// the first word is being typed, a complete one gets a space
+		word := line[start:pos]
+		keys := make([]string, 0, len(n))
+		for key := range n {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			name := []rune(key)
+			if runes.HasPrefix(name, word) {
+				newLine = append(newLine, append(name[len(word):], ' '))
+			}
+		}
+		return newLine, nil, len(word)
+	}
+
+	sub := n[string(line[start:end])]
+	if sub == nil {
+		return nil, nil, 0
+	}
+	for end < pos && unicode.IsSpace(line[end]) {
+		end++
+	}
+	return sub.Do(line[end:], pos-end)
+}
@@ -0,0 +1,130 @@
+package readline
+
+import (
+	"context"
+	"io"
+	"time"
+	"unicode"
+)
+
+// DefaultRemoteTimeout is the timeout of a RemoteCompleter attempt if
+// RemoteCompleter.Timeout is not set.
+const DefaultRemoteTimeout = 2 * time.Second
+
+var spinnerFrames = []rune(`|/-\`)
+
+// RemoteCompleter is an AutoCompleter backed by a slow source, i.e. a
+// language server or a web API.
+//
+// Fetch receives the whole line and the cursor position, and returns the
+// candidates for the word under the cursor. Unlike AutoCompleter.Do the
+// names are the whole words, the ones which don't start with the typed
+// word are dropped.
+//
+// A failed or timed out fetch is treated as no candidates, so readline
+// rings the bell instead of completing.
+type RemoteCompleter struct {
+	Fetch func(ctx context.Context, line string, pos int) ([]Candidate, error)
+
+	// the context of every fetch, context.Background() by default
+	Context context.Context
+	// timeout of every attempt, DefaultRemoteTimeout by default
+	Timeout time.Duration
+	// how many times a failed attempt is retried
+	Retries int
+	// a spinner is drawn at the cursor while waiting if Output is set,
+	// it should be the terminal readline writes to, i.e. Config.Stdout
+	Output io.Writer
+	// OnError is called with the error of the last attempt
+	OnError func(error)
+}
+
+func (c *RemoteCompleter) DoCandidates(line []rune, pos int) ([]Candidate, int) {
+	word := line[:pos]
+	for i := pos - 1; i >= 0; i-- {
+		if unicode.IsSpace(line[i]) {
+			word = line[i+1 : pos]
+			break
+		}
+	}
+
+	candidates, err := c.fetch(line, pos)
+	if err != nil {
+		if c.OnError != nil {
+			c.OnError(err)
+		}
+		return nil, 0
+	}
+
+	ret := make([]Candidate, 0, len(candidates))
+	for _, cand := range candidates {
+		if !runes.HasPrefix(cand.Name, word) {
+			continue
+		}
+		cand.Name = cand.Name[len(word):]
+		ret = append(ret, cand)
+	}
+	return ret, len(word)
+}
+
+func (c *RemoteCompleter) Do(line []rune, pos int) (newLine, commentLine [][]rune, length int) {
+	return CandidateFunc(c.DoCandidates).Do(line, pos)
+}
+
+func (c *RemoteCompleter) fetch(line []rune, pos int) (candidates []Candidate, err error) {
+	if c.Output != nil {
+		stop := c.spin(line, pos)
+		defer stop()
+	}
+
+	parent := c.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRemoteTimeout
+	}
+	for i := 0; i <= c.Retries; i++ {
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		candidates, err = c.Fetch(ctx, string(line), pos)
+		cancel()
+		if err == nil || parent.Err() != nil {
+			break
+		}
+	}
+	return candidates, err
+}
+
+// spin draws the spinner at the cursor until the returned func is called,
+// which puts back the rune under the cursor.
+func (c *RemoteCompleter) spin(line []rune, pos int) func() {
+	under := []rune(" ")
+	if pos < len(line) {
+		under = line[pos : pos+1]
+	}
+	stopChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		drawn := false
+		for i := 0; ; i++ {
+			select {
+			case <-ticker.C:
+				drawn = true
+				c.Output.Write([]byte{byte(spinnerFrames[i%len(spinnerFrames)]), '\b'})
+			case <-stopChan:
+				if drawn {
+					c.Output.Write(append([]byte(string(under)), runes.Backspace(under)...))
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stopChan)
+		<-done
+	}
+}
@@ -0,0 +1,1494 @@
+package readline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAlignComments(t *testing.T) {
+	for _, c := range []struct {
+		comments [][]rune
+		n        int
+	}{
+		{nil, 3},
+		{sr("a"), 3},
+		{sr("a", "b", "c"), 3},
+		{sr("a", "b", "c", "d"), 3},
+	} {
+		ret := alignComments(c.comments, c.n)
+		if len(ret) != c.n {
+			t.Fatal("result not expect", c.comments, len(ret))
+		}
+		for i := range ret {
+			if i < len(c.comments) && string(ret[i]) != string(c.comments[i]) {
+				t.Fatal("result not expect", c.comments, rs(ret))
+			}
+		}
+	}
+}
+
+func TestPrefixCompleterMismatchedComments(t *testing.T) {
+	p := NewPrefixCompleter(
+		PcItemDynamic(func(string) ([]string, []string) {
+			return []string{"foo", "bar", "baz"}, []string{"only one"}
+		}),
+		PcItem("ba", "exactly matched"),
+	)
+	newLine, commentLine, _ := p.Do([]rune("ba"), 2)
+	if len(newLine) != len(commentLine) {
+		t.Fatal("result not expect", rs(newLine), rs(commentLine))
+	}
+}
+
+func TestPcItemNoSpace(t *testing.T) {
+	completer := NewPrefixCompleter(
+		PcItemNoSpace("--name=", "", PcItem("foo", "")),
+		PcItem("go", ""),
+	)
+	for _, c := range []struct {
+		input, expected string
+	}{
+		// no space after the name, so its children follow it directly
+		{"--na\t\r", "--name="},
+		{"--na\tf\t\r", "--name=foo "},
+		{"g\t\r", "go "},
+	} {
+		rl, err := NewEx(&Config{
+			Stdin:          ioutil.NopCloser(strings.NewReader(c.input)),
+			Stdout:         ioutil.Discard,
+			FuncIsTerminal: func() bool { return false },
+			FuncGetWidth:   func() int { return 80 },
+			AutoComplete:   completer,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line, err := rl.Readline(); err != nil || line != c.expected {
+			t.Fatalf("%q: result not expect %q %v", c.input, line, err)
+		}
+		rl.Close()
+	}
+}
+
+// shortCommentsCompleter returns fewer comments than candidates
+type shortCommentsCompleter struct {
+	comments [][]rune
+}
+
+func (c shortCommentsCompleter) Do(line []rune, pos int) (newLine, commentLine [][]rune, length int) {
+	return sr("o ", "it ", "rep "), c.comments, 1
+}
+
+func TestCompleteMismatchedComments(t *testing.T) {
+	for _, comments := range [][][]rune{nil, sr("build")} {
+		for _, align := range []bool{false, true} {
+			rl, err := NewEx(&Config{
+				Stdin:                   ioutil.NopCloser(strings.NewReader("")),
+				Stdout:                  ioutil.Discard,
+				FuncIsTerminal:          func() bool { return false },
+				FuncGetWidth:            func() int { return 20 },
+				CompletionAlignComments: align,
+				AutoComplete:            shortCommentsCompleter{comments},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			op := rl.Operation
+			op.SetBuffer("g")
+			op.OnComplete()
+			if len(op.candidateComments) != len(op.candidate) {
+				t.Fatal("result not expect", len(op.candidate), len(op.candidateComments))
+			}
+			// every candidate is drawn selected
+			op.EnterCompleteSelectMode()
+			for i := 0; i < 3; i++ {
+				op.doSelect()
+			}
+			op.HandleCompleteSelect(CharEnter)
+			if line := string(op.buf.Runes()); line != "grep " {
+				t.Fatalf("result not expect %q", line)
+			}
+			rl.Close()
+		}
+	}
+}
+
+func TestRemoteCompleter(t *testing.T) {
+	calls := 0
+	c := &RemoteCompleter{
+		Timeout: 10 * time.Millisecond,
+		Retries: 1,
+		Fetch: func(ctx context.Context, line string, pos int) ([]Candidate, error) {
+			calls++
+			if calls == 1 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return []Candidate{{Name: []rune("git")}, {Name: []rune("go")}, {Name: []rune("grep")}}, nil
+		},
+	}
+	newLine, _, length := c.Do([]rune("sudo gi"), 7)
+	if calls != 2 || length != 2 || len(newLine) != 1 || string(newLine[0]) != "t" {
+		t.Fatal("result not expect", calls, length, rs(newLine))
+	}
+
+	var lastErr error
+	c.Retries = 0
+	c.OnError = func(err error) { lastErr = err }
+	c.Fetch = func(context.Context, string, int) ([]Candidate, error) {
+		return nil, errors.New("unavailable")
+	}
+	if newLine, _, _ := c.Do([]rune("g"), 1); len(newLine) != 0 || lastErr == nil {
+		t.Fatal("result not expect", rs(newLine), lastErr)
+	}
+}
+
+func TestCommandCompleter(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	c := &CommandCompleter{
+		Path: sh,
+		Args: []string{"-c", `[ "$1|$2" = "$READLINE_LINE|$READLINE_POINT" ] || exit 1
+printf 'git\tthe stupid content tracker\ngo\ngrep\n'`, "sh"},
+	}
+	newLine, comments, length := c.Do([]rune("sudo gi"), 7)
+	if length != 2 || len(newLine) != 1 || string(newLine[0]) != "t" ||
+		string(comments[0]) != "the stupid content tracker" {
+		t.Fatal("result not expect", length, rs(newLine), rs(comments))
+	}
+
+	var lastErr error
+	c.Args = []string{"-c", "exec sleep 1"}
+	c.Timeout = 10 * time.Millisecond
+	c.OnError = func(err error) { lastErr = err }
+	if newLine, _, _ := c.Do([]rune("g"), 1); len(newLine) != 0 || lastErr == nil {
+		t.Fatal("result not expect", rs(newLine), lastErr)
+	}
+
+	// the timeout works if a child of the command keeps the output open
+	lastErr = nil
+	c.Args = []string{"-c", "sleep 2; echo x"}
+	start := time.Now()
+	if newLine, _, _ := c.Do([]rune("g"), 1); len(newLine) != 0 || lastErr == nil {
+		t.Fatal("result not expect", rs(newLine), lastErr)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("timeout not enforced", elapsed)
+	}
+}
+
+func TestSegmentPrefix(t *testing.T) {
+	for _, c := range []struct {
+		same, e string
+	}{
+		{"src/foo/bar/", "src/"},
+		{"foo/bar", "foo/"},
+		{"/usr/", "/"},
+		{"foo", "foo"},
+		{"", ""},
+	} {
+		if ret := string(segmentPrefix([]rune(c.same), '/')); ret != c.e {
+			t.Fatalf("segment prefix of %q: want %q, got %q", c.same, c.e, ret)
+		}
+	}
+}
+
+func TestWordAt(t *testing.T) {
+	re := regexp.MustCompile(`\w+`)
+	for _, c := range []struct {
+		line       string
+		pos        int
+		start, end int
+	}{
+		{"std::vec", 8, 5, 8},
+		{"std::vec", 6, 5, 8},
+		{"std::vec", 4, 4, 4},
+		{"你好.len", 3, 3, 6},
+		{"", 0, 0, 0},
+	} {
+		start, end := wordAt(re, []rune(c.line), c.pos)
+		if start != c.start || end != c.end {
+			t.Fatal("result not expect", c.line, c.pos, start, end)
+		}
+	}
+}
+
+func TestDefaultFuzzyMatcher(t *testing.T) {
+	for _, c := range []struct {
+		pattern, candidate string
+		matched            bool
+	}{
+		{"grp", "grep", true},
+		{"gp", "git-prune", true},
+		{"grp", "go", false},
+		{"GR", "grep", true},
+		{"", "go", true},
+	} {
+		matched, _ := DefaultFuzzyMatcher(c.pattern, c.candidate)
+		if matched != c.matched {
+			t.Fatal("result not expect", c.pattern, c.candidate, matched)
+		}
+	}
+	_, prefix := DefaultFuzzyMatcher("gre", "grep")
+	_, scattered := DefaultFuzzyMatcher("gre", "git-remote")
+	if prefix <= scattered {
+		t.Fatal("prefix match should score higher", prefix, scattered)
+	}
+}
+
+func TestCompleteSelectEnterWithoutChoice(t *testing.T) {
+	for _, accepts := range []bool{true, false} {
+		rl, err := NewEx(&Config{
+			Stdin:                  ioutil.NopCloser(strings.NewReader("")),
+			Stdout:                 ioutil.Discard,
+			FuncIsTerminal:         func() bool { return false },
+			CompletionEnterAccepts: accepts,
+			AutoComplete:           NewPrefixCompleter(PcItem("abc", ""), PcItem("abd", "")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := rl.Operation
+		op.SetBuffer("ab")
+		op.OnComplete()
+		op.EnterCompleteSelectMode()
+
+		if op.EnterSubmits() == accepts {
+			t.Fatal("result not expect", accepts)
+		}
+		if op.HandleCompleteSelect(CharEnter) {
+			t.Fatal("enter should leave the complete select mode")
+		}
+		if line := string(op.buf.Runes()); line != "abc " {
+			t.Fatalf("unexpected line %q", line)
+		}
+		rl.Close()
+	}
+}
+
+func TestCompleteSelectRefilter(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		AutoComplete: NewPrefixCompleter(
+			PcItem("go", ""), PcItem("git", ""), PcItem("git-shell", ""), PcItem("grep", ""),
+		),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	op := rl.Operation
+	op.SetBuffer("g")
+	op.OnComplete()
+	op.EnterCompleteSelectMode()
+
+	for _, c := range []struct {
+		r          rune
+		line       string
+		candidates string
+	}{
+		{'i', "gi", "t |t-shell "},
+		{'t', "git", " |-shell "},
+		// backspace widens the candidates again
+		{CharBackspace, "gi", "t |t-shell "},
+		{CharBackspace, "g", "o |it |it-shell |rep "},
+		// no candidate closes the menu
+		{'x', "gx", ""},
+	} {
+		if !op.HandleCompleteSelect(c.r) {
+			t.Fatal("the key should be handled", string(c.r))
+		}
+		candidates := strings.Join(rs(op.candidate), "|")
+		if line := string(op.buf.Runes()); line != c.line || candidates != c.candidates {
+			t.Fatalf("result not expect %q %q", line, candidates)
+		}
+		if op.IsInCompleteSelectMode() != (c.candidates != "") {
+			t.Fatal("complete select mode not expect", string(c.r))
+		}
+	}
+
+	// nothing is selected after the refiltering, Ctrl+B selects the last
+	op.SetBuffer("gi")
+	op.OnComplete()
+	op.EnterCompleteSelectMode()
+	op.HandleCompleteSelect(CharBackspace)
+	op.HandleCompleteSelect(CharBackward)
+	if op.candidateChoise != len(op.candidate)-1 {
+		t.Fatal("the last candidate should be selected", op.candidateChoise)
+	}
+}
+
+func TestCompleteSelectRefilterListener(t *testing.T) {
+	var (
+		m    sync.Mutex
+		keys []rune
+	)
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("g\t\tit\x7f\x02\r\r")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		Listener: FuncListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+			m.Lock()
+			defer m.Unlock()
+			keys = append(keys, key)
+			return nil, 0, false
+		}),
+		AutoComplete: NewPrefixCompleter(
+			PcItem("go", ""), PcItem("git", ""), PcItem("git-shell", ""), PcItem("grep", ""),
+		),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "git-shell " {
+		t.Fatal("result not expect", line, err)
+	}
+	// the keys editing the line are passed to the Listener
+	m.Lock()
+	defer m.Unlock()
+	if !strings.Contains(string(keys), "it\x7f") {
+		t.Fatalf("keys not expect %q", string(keys))
+	}
+}
+
+func TestChainCompletion(t *testing.T) {
+	cfg := &Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		AutoComplete: NewPrefixCompleter(
+			PcItem("git", "", PcItem("commit", ""), PcItem("checkout", "")),
+			PcItem("ls", ""),
+		),
+		ChainCompletion: true,
+	}
+	rl, err := NewEx(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	op := rl.Operation
+
+	for _, c := range []struct {
+		line       string
+		result     string
+		candidates string
+	}{
+		{"gi", "git ", "commit |checkout "},
+		{"git co", "git commit ", ""},
+		// no candidate after it
+		{"l", "ls ", ""},
+	} {
+		op.SetBuffer(c.line)
+		op.OnComplete()
+		if line := string(op.buf.Runes()); line != c.result {
+			t.Fatalf("result not expect %q", line)
+		}
+		candidates := strings.Join(rs(op.candidate), "|")
+		if candidates != c.candidates || op.IsInCompleteMode() != (c.candidates != "") {
+			t.Fatalf("candidates not expect %q", candidates)
+		}
+		op.ExitCompleteMode(false)
+	}
+
+	// the single candidate listed is accepted by Tab
+	op.SetBuffer("git ch")
+	op.EnterCompleteMode(0, [][]rune{[]rune("eckout ")}, nil)
+	op.candidateSource = op.buf.Runes()
+	op.OnComplete()
+	if line := string(op.buf.Runes()); line != "git checkout " || op.IsInCompleteMode() {
+		t.Fatalf("result not expect %q", line)
+	}
+
+	cfg.ChainCompletion = false
+	op.SetBuffer("gi")
+	op.OnComplete()
+	if line := string(op.buf.Runes()); line != "git " || op.IsInCompleteMode() {
+		t.Fatalf("result not expect %q", line)
+	}
+}
+
+func TestTriggerComplete(t *testing.T) {
+	r, w := io.Pipe()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete:   NewPrefixCompleter(PcItem("hello", ""), PcItem("help", "")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	ret := make(chan string, 1)
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	w.Write([]byte("he"))
+	for rl.Operation.buf.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the common prefix is inserted
+	if rl.TriggerComplete() {
+		t.Fatal("candidates should not be listed")
+	}
+	if !rl.TriggerComplete() || !rl.Operation.IsInCompleteMode() {
+		t.Fatal("candidates should be listed")
+	}
+	w.Write([]byte("\r"))
+	if line := <-ret; line != "hel" {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	rl.SetConfig(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+	})
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	w.Write([]byte("he"))
+	for rl.Operation.buf.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if rl.TriggerComplete() {
+		t.Fatal("there is no completer")
+	}
+	w.Write([]byte("\r"))
+	if line := <-ret; line != "he" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestTriggerCompleteBinding(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("hel\x14\t\r\r")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete:   NewPrefixCompleter(PcItem("hello", ""), PcItem("help", "")),
+		KeyBindings: map[rune]func(op *Operation) bool{
+			CharTranspose: func(op *Operation) bool {
+				op.TriggerComplete()
+				return true
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// the candidates listed by the binding are kept, so Tab selects one
+	if line, err := rl.Readline(); err != nil || line != "hello " {
+		t.Fatal("result not expect", line, err)
+	}
+}
+
+func TestDismissCompletion(t *testing.T) {
+	r, w := io.Pipe()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete:   NewPrefixCompleter(PcItem("hello", ""), PcItem("help", "")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	ret := make(chan string, 1)
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	if rl.DismissCompletion() {
+		t.Fatal("there is no completion")
+	}
+	w.Write([]byte("hel\t"))
+	for !inCompleteMode(rl) {
+		time.Sleep(time.Millisecond)
+	}
+	if !rl.DismissCompletion() || inCompleteMode(rl) {
+		t.Fatal("the completion should be dismissed")
+	}
+	if rl.DismissCompletion() {
+		t.Fatal("the completion is dismissed already")
+	}
+
+	// dismissed while the keys are handled
+	for i := 0; i < 20; i++ {
+		w.Write([]byte("\t"))
+		rl.DismissCompletion()
+	}
+	w.Write([]byte("\r"))
+	if line := <-ret; line != "hel" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestCandidateWidthFunc(t *testing.T) {
+	stripped := regexp.MustCompile("\033\\[[0-9;]*m")
+	for _, widthFunc := range []func(candidate, comment []rune) int{
+		nil,
+		func(candidate, comment []rune) int {
+			return len(stripped.ReplaceAllString(string(candidate)+string(comment), ""))
+		},
+	} {
+		rl, err := NewEx(&Config{
+			Stdin:              ioutil.NopCloser(strings.NewReader("")),
+			Stdout:             ioutil.Discard,
+			FuncIsTerminal:     func() bool { return false },
+			FuncGetWidth:       func() int { return 20 },
+			CandidateWidthFunc: widthFunc,
+			AutoComplete: NewPrefixCompleter(
+				PcItem("\033[31;1mred\033[0m", ""), PcItem("blue", ""),
+			),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := rl.Operation
+		op.OnComplete()
+		if colNum := op.candidateColNum; (colNum > 1) != (widthFunc != nil) {
+			t.Fatal("result not expect", colNum)
+		}
+		rl.Close()
+	}
+}
+
+func TestCompletionAlignComments(t *testing.T) {
+	stripped := regexp.MustCompile("\033\\[[0-9;]*[a-zA-Z]")
+	for _, c := range []struct {
+		align    bool
+		expected []string
+	}{
+		{false, []string{"go build", "git vcs", "grep "}},
+		{true, []string{"go    build", "git   vcs", "grep  "}},
+	} {
+		out := bytes.NewBuffer(nil)
+		rl, err := NewEx(&Config{
+			Stdin:                   ioutil.NopCloser(strings.NewReader("")),
+			Stdout:                  out,
+			FuncIsTerminal:          func() bool { return false },
+			FuncGetWidth:            func() int { return 80 },
+			CompletionAlignComments: c.align,
+			AutoComplete: NewPrefixCompleter(
+				PcItem("go", "build"), PcItem("git", "vcs"), PcItem("grep", ""),
+			),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := rl.Operation
+		op.SetBuffer("g")
+		out.Reset()
+		op.OnComplete()
+		menu := stripped.ReplaceAllString(out.String(), "")
+		for _, s := range c.expected {
+			if !strings.Contains(menu, s) {
+				t.Fatalf("menu not expect: %q", menu)
+			}
+		}
+		rl.Close()
+	}
+}
+
+func TestCompleteNarrowScreen(t *testing.T) {
+	stripped := regexp.MustCompile("\033\\[[0-9;]*[a-zA-Z]")
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("")),
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return false },
+		FuncGetWidth:   func() int { return 10 },
+		AutoComplete: NewPrefixCompleter(
+			PcItem("checkout-branch", ""), PcItem("cherry-pick", "apply the changes"), PcItem("clone", ""),
+		),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	op := rl.Operation
+	op.SetBuffer("c")
+	out.Reset()
+	op.OnComplete()
+	if op.candidateColNum != 1 {
+		t.Fatal("result not expect", op.candidateColNum)
+	}
+	// a column leaves a space after the candidate
+	menu := strings.Trim(stripped.ReplaceAllString(out.String(), ""), "\r\n")
+	if menu != "checkou… \ncherry-… \nclone    " {
+		t.Fatalf("menu not expect: %q", menu)
+	}
+}
+
+func TestCompletionMenuAbove(t *testing.T) {
+	stripped := regexp.MustCompile("\033\\[[0-9;]*m")
+	row := 10
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Prompt:              "> ",
+		Stdin:               ioutil.NopCloser(strings.NewReader("")),
+		Stdout:              out,
+		FuncIsTerminal:      func() bool { return false },
+		FuncGetWidth:        func() int { return 20 },
+		FuncGetCursorPos:    func() (int, int, error) { return row, 4, nil },
+		CompletionMenuAbove: true,
+		AutoComplete: NewPrefixCompleter(
+			PcItem("go", ""), PcItem("git", ""), PcItem("grep", ""),
+		),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	op := rl.Operation
+	op.SetBuffer("g")
+
+	// up over the menu, and back to the cursor after it
+	out.Reset()
+	op.OnComplete()
+	menu := stripped.ReplaceAllString(out.String(), "")
+	if !strings.HasPrefix(menu, "\033[1A\r\033[2K") || !strings.HasSuffix(menu, "\n\033[3C") ||
+		!strings.Contains(menu, "grep") || strings.Contains(menu, "\033[J") {
+		t.Fatalf("menu not expect: %q", menu)
+	}
+
+	// it's erased as the completion exits
+	out.Reset()
+	op.ExitCompleteMode(false)
+	if s := out.String(); s != "\033[1A\r\033[2K\n\033[3C" {
+		t.Fatalf("erase not expect: %q", s)
+	}
+
+	// no room above the first line of the screen
+	row = 1
+	out.Reset()
+	op.OnComplete()
+	if menu := out.String(); !strings.HasPrefix(menu, "\n\033[J") || op.menuAbove != 0 {
+		t.Fatalf("menu not expect: %q", menu)
+	}
+	op.ExitCompleteMode(false)
+
+	// the cursor row is unknown
+	for _, getPos := range []func() (int, int, error){
+		nil,
+		func() (int, int, error) { return 0, 0, errors.New("no reply") },
+	} {
+		rl.Config.FuncGetCursorPos = getPos
+		out.Reset()
+		op.OnComplete()
+		if menu := out.String(); !strings.HasPrefix(menu, "\n\033[J") || op.menuAbove != 0 {
+			t.Fatalf("menu not expect: %q", menu)
+		}
+		op.ExitCompleteMode(false)
+	}
+}
+
+func TestCompletionKeepQuery(t *testing.T) {
+	for _, c := range []struct {
+		input, expected string
+	}{
+		{"he\t\x18\x07\r", "he"},
+		// moving the cursor keeps the query
+		{"he\t\x01\x18\x07\r", "he"},
+		// the query is forgotten once the line is edited
+		{"he\tx\x18\x07\r", "hello x"},
+		{"he\t\b \x18\x07\r", "hello "},
+		// Ctrl+G alone only cancels
+		{"he\t\x07\r", "hello "},
+	} {
+		rl, err := NewEx(&Config{
+			Stdin:               ioutil.NopCloser(strings.NewReader(c.input)),
+			Stdout:              ioutil.Discard,
+			FuncIsTerminal:      func() bool { return false },
+			FuncGetWidth:        func() int { return 80 },
+			CompletionKeepQuery: true,
+			AutoComplete:        NewPrefixCompleter(PcItem("hello", "")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line, err := rl.Readline(); err != nil || line != c.expected {
+			t.Fatalf("%q: result not expect %q %v", c.input, line, err)
+		}
+		rl.Close()
+	}
+}
+
+func TestCompletionMaxCandidates(t *testing.T) {
+	var items []PrefixCompleterInterface
+	for _, name := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		items = append(items, PcItem(name, ""))
+	}
+	for _, c := range []struct {
+		max, maxCompletion int
+		listed             int
+	}{
+		{0, 0, 5},
+		{3, 0, 3},
+		{0, 3, 3},
+		{-1, 3, 3},
+		{4, 3, 3},
+		{3, 4, 3},
+		{-1, 0, 5},
+	} {
+		rl, err := NewEx(&Config{
+			Stdin:                   ioutil.NopCloser(strings.NewReader("")),
+			Stdout:                  ioutil.Discard,
+			FuncIsTerminal:          func() bool { return false },
+			FuncGetWidth:            func() int { return 80 },
+			CompletionMaxCandidates: c.max,
+			MaxCompletionCandidates: c.maxCompletion,
+			AutoComplete:            NewPrefixCompleter(items...),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		op := rl.Operation
+		op.SetBuffer("a")
+		op.OnComplete()
+		if len(op.candidate) != c.listed || op.candidateMore != 5-c.listed {
+			t.Fatal("result not expect", c, len(op.candidate), op.candidateMore)
+		}
+		// Tab cycles through the listed candidates only
+		op.EnterCompleteSelectMode()
+		for i := 0; i <= c.listed; i++ {
+			op.doSelect()
+		}
+		if op.candidateChoise != 0 {
+			t.Fatal("result not expect", c, op.candidateChoise)
+		}
+		rl.Close()
+	}
+}
+
+func TestCompletionStyle(t *testing.T) {
+	if noColor() {
+		t.Skip("NO_COLOR is set")
+	}
+	for _, c := range []struct {
+		style             CompletionStyle
+		selected, comment string
+	}{
+		{CompletionStyle{}, "\033[30m\033[47m", "\033[90m"},
+		{CompletionStyle{SelectedBg: "44", CommentFg: "38;5;240"}, "\033[30m\033[44m", "\033[38;5;240m"},
+	} {
+		out := bytes.NewBuffer(nil)
+		rl, err := NewEx(&Config{
+			Stdin:           ioutil.NopCloser(strings.NewReader("")),
+			Stdout:          out,
+			FuncIsTerminal:  func() bool { return false },
+			FuncGetWidth:    func() int { return 80 },
+			CompletionStyle: c.style,
+			AutoComplete:    NewPrefixCompleter(PcItem("abc", "first"), PcItem("abd", "")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := rl.Operation
+		op.SetBuffer("ab")
+		op.OnComplete()
+		op.EnterCompleteSelectMode()
+		op.doSelect()
+		if !strings.Contains(out.String(), c.selected) || !strings.Contains(out.String(), c.comment+"first") {
+			t.Fatalf("unexpected output %q", out.String())
+		}
+		rl.Close()
+	}
+}
+
+func TestCompletionColumnMajor(t *testing.T) {
+	var items []PrefixCompleterInterface
+	for _, name := range []string{"a0", "a1", "a2", "a3", "a4", "a5", "a6"} {
+		items = append(items, PcItem(name, ""))
+	}
+	for _, columnMajor := range []bool{false, true} {
+		rl, err := NewEx(&Config{
+			Stdin:                  ioutil.NopCloser(strings.NewReader("")),
+			Stdout:                 ioutil.Discard,
+			FuncIsTerminal:         func() bool { return false },
+			FuncGetWidth:           func() int { return 20 },
+			CompletionSelectMarker: "> ",
+			CompletionColumnMajor:  columnMajor,
+			AutoComplete:           NewPrefixCompleter(items...),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		op := rl.Operation
+		op.SetBuffer("a")
+		op.OnComplete()
+		op.EnterCompleteSelectMode()
+		if op.candidateColNum != 3 {
+			t.Fatal("result not expect", op.candidateColNum)
+		}
+
+		// a0 a3 a6    or    a0 a1 a2
+		// a1 a4             a3 a4 a5
+		// a2 a5             a6
+		below := map[int]int{0: 1, 1: 2, 2: 0, 3: 4, 4: 5, 5: 3, 6: 6}
+		if !columnMajor {
+			below = map[int]int{0: 3, 1: 4, 2: 5, 3: 6, 4: 1, 5: 2, 6: 0}
+		}
+		for idx := range op.candidate {
+			op.candidateChoise = idx
+			op.HandleCompleteSelect(CharNext)
+			if op.candidateChoise != below[idx] {
+				t.Fatal("result not expect", columnMajor, idx, op.candidateChoise)
+			}
+			op.HandleCompleteSelect(CharPrev)
+			if op.candidateChoise != idx {
+				t.Fatal("result not expect", columnMajor, idx, op.candidateChoise)
+			}
+		}
+
+		op.candidateChoise = 1
+		op.HandleCompleteSelect(CharLineEnd)
+		if end := map[bool]int{false: 2, true: 4}[columnMajor]; op.candidateChoise != end {
+			t.Fatal("result not expect", columnMajor, op.candidateChoise)
+		}
+		op.HandleCompleteSelect(CharLineStart)
+		if start := map[bool]int{false: 0, true: 1}[columnMajor]; op.candidateChoise != start {
+			t.Fatal("result not expect", columnMajor, op.candidateChoise)
+		}
+		rl.Close()
+	}
+}
+
+func TestCompletionMaxRows(t *testing.T) {
+	var items []PrefixCompleterInterface
+	for i := 0; i < 10; i++ {
+		items = append(items, PcItem(fmt.Sprintf("a%d", i), ""))
+	}
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Stdin:                  ioutil.NopCloser(strings.NewReader("")),
+		Stdout:                 out,
+		FuncIsTerminal:         func() bool { return false },
+		FuncGetWidth:           func() int { return 20 },
+		CompletionSelectMarker: "> ",
+		CompletionMaxRows:      2,
+		AutoComplete:           NewPrefixCompleter(items...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	op := rl.Operation
+	op.SetBuffer("a")
+	op.OnComplete()
+	op.EnterCompleteSelectMode()
+
+	// 2 columns and 5 rows, the 3rd row is selected
+	for i := 0; i < 5; i++ {
+		out.Reset()
+		op.doSelect()
+	}
+	menu := out.String()
+	if op.candidateColNum != 2 || op.candidateTop != 1 {
+		t.Fatal("result not expect", op.candidateColNum, op.candidateTop)
+	}
+	for _, c := range []struct {
+		s     string
+		shown bool
+	}{
+		{"a1", false}, {"a2", true}, {"a5", true}, {"a6", false},
+		{"↑", true}, {"↓", true},
+	} {
+		if strings.Contains(menu, c.s) != c.shown {
+			t.Fatalf("%s not expect in %q", c.s, menu)
+		}
+	}
+	// 3 rows are drawn below the line, the cursor goes back
+	if !strings.Contains(menu, "\033[3A") {
+		t.Fatalf("cursor not moved back %q", menu)
+	}
+
+	op.SelectLastCandidate()
+	if op.candidateTop != 3 {
+		t.Fatal("result not expect", op.candidateTop)
+	}
+	// wrap around to the top
+	op.doSelect()
+	if op.candidateTop != 0 {
+		t.Fatal("result not expect", op.candidateTop)
+	}
+}
+
+func TestOnCompleteSelected(t *testing.T) {
+	var selected string
+	index := -1
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete:   NewPrefixCompleter(PcItem("abc", ""), PcItem("abd", "")),
+		OnCompleteSelected: func(candidate []rune, idx int) {
+			selected, index = string(candidate), idx
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	op := rl.Operation
+	op.SetBuffer("ab")
+	op.OnComplete()
+	op.EnterCompleteSelectMode()
+	op.doSelect()
+	op.doSelect()
+	if index != -1 {
+		t.Fatal("selecting should not accept the candidate")
+	}
+	op.HandleCompleteSelect(CharEnter)
+	if selected != "abd " || index != 1 {
+		t.Fatal("result not expect", selected, index)
+	}
+}
+
+func TestCompletionAcceptChars(t *testing.T) {
+	words := []string{"src/", "srv/", "go ", "git "}
+	// the first Tab inserts the common "r", the next ones list and select
+	input := "s\t\t\t/\r" +
+		// the trailing space is dropped
+		"g\t\t/\r" +
+		// the other runes are inserted as the refiltered query
+		"g\t\ti\r"
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader(input)),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete: CandidateFunc(func(line []rune, pos int) ([]Candidate, int) {
+			var candidates []Candidate
+			for _, w := range words {
+				if strings.HasPrefix(w, string(line[:pos])) {
+					candidates = append(candidates, Candidate{Name: []rune(w[pos:])})
+				}
+			}
+			return candidates, pos
+		}),
+		CompletionAcceptChars: []rune{'/'},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	for _, want := range []string{"src/", "go/", "gi"} {
+		if line, err := rl.Readline(); err != nil || line != want {
+			t.Fatalf("result not expect %q %v", line, err)
+		}
+	}
+}
+
+func TestCompleteIgnoreCase(t *testing.T) {
+	pc := NewPrefixCompleter(
+		PcItem("git", "", PcItem("status", ""), PcItem("stash", "")),
+		PcItem("gist", ""),
+	)
+	newLine, _, offset := DoFold(pc, []rune("GIT St"), 6)
+	if offset != 2 || len(newLine) != 2 || string(newLine[0]) != "status " || string(newLine[1]) != "stash " {
+		t.Fatal("result not expect", offset, newLine)
+	}
+
+	rl, err := NewEx(&Config{
+		Stdin:              ioutil.NopCloser(strings.NewReader("")),
+		Stdout:             ioutil.Discard,
+		FuncIsTerminal:     func() bool { return false },
+		FuncGetWidth:       func() int { return 80 },
+		CompleteIgnoreCase: true,
+		AutoComplete:       pc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	op := rl.Operation
+	for _, c := range []struct {
+		line, expected string
+	}{
+		{"GIT", "git "},
+		{"Gi", "Gi"},
+		{"git STAT", "git status "},
+		{"GIT ST", "GIT sta"},
+	} {
+		op.ExitCompleteMode(false)
+		op.SetBuffer(c.line)
+		op.OnComplete()
+		if line := string(op.buf.Runes()); line != c.expected {
+			t.Fatalf("unexpected line %q for %q", line, c.line)
+		}
+	}
+}
+
+func TestNestedCompleter(t *testing.T) {
+	c := NestedCompleter{
+		"checkout": NestedCompleter{"main": nil, "master": nil},
+		"cherry":   nil,
+		"status":   nil,
+	}
+	for _, tc := range []struct {
+		line     string
+		expected []string
+		offset   int
+	}{
+		{"", []string{"checkout ", "cherry ", "status "}, 0},
+		{"ch", []string{"eckout ", "erry "}, 2},
+		{"status", []string{" "}, 6},
+		{"checkout ", []string{"main ", "master "}, 0},
+		{" checkout  ma", []string{"in ", "ster "}, 2},
+		{"status ", nil, 0},
+		{"unknown m", nil, 0},
+	} {
+		newLine, _, offset := c.Do([]rune(tc.line), len([]rune(tc.line)))
+		var names []string
+		for _, name := range newLine {
+			names = append(names, string(name))
+		}
+		if offset != tc.offset || strings.Join(names, "|") != strings.Join(tc.expected, "|") {
+			t.Fatal("result not expect", tc.line, names, offset)
+		}
+	}
+}
+
+func TestPcItemDynamicPos(t *testing.T) {
+	var gotLine string
+	gotPos := -1
+	pc := NewPrefixCompleter(
+		PcItem("kill", "",
+			PcItemDynamicPos(func(line string, pos int) ([]string, []string) {
+				gotLine, gotPos = line, pos
+				return []string{"1234", "1299"}, nil
+			}),
+		),
+	)
+	line := []rune("kill 12 -9")
+	newLine, _, offset := pc.Do(line, 7)
+	if gotLine != "kill 12 -9" || gotPos != 7 {
+		t.Fatal("result not expect", gotLine, gotPos)
+	}
+	if offset != 2 || len(newLine) != 2 || string(newLine[0]) != "34 " {
+		t.Fatal("result not expect", offset, newLine)
+	}
+}
+
+func TestCompleteQuoteAware(t *testing.T) {
+	files := func(string) ([]string, []string) {
+		return []string{"my file.txt", "my films", "notes"}, nil
+	}
+	rl, err := NewEx(&Config{
+		Stdin:              ioutil.NopCloser(strings.NewReader("")),
+		Stdout:             ioutil.Discard,
+		FuncIsTerminal:     func() bool { return false },
+		FuncGetWidth:       func() int { return 80 },
+		CompleteQuoteAware: true,
+		AutoComplete:       NewPrefixCompleter(PcItem("cat", "", PcItemDynamic(files))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	op := rl.Operation
+	for _, c := range []struct {
+		line, expected string
+	}{
+		{"cat no", "cat notes "},
+		{"cat my", `cat "my fil`},
+		{`cat "my fil`, `cat "my fil`},
+		{`cat "my file`, `cat "my file.txt" `},
+		{`cat 'my fi'lm`, `cat 'my films' `},
+		{`cat my\ file`, `cat "my file.txt" `},
+	} {
+		op.ExitCompleteMode(false)
+		op.SetBuffer(c.line)
+		op.OnComplete()
+		if line := string(op.buf.Runes()); line != c.expected {
+			t.Fatalf("unexpected line %q for %q", line, c.line)
+		}
+	}
+}
+
+func TestCompleteMinChars(t *testing.T) {
+	called := 0
+	rl, err := NewEx(&Config{
+		Stdin:            ioutil.NopCloser(strings.NewReader("")),
+		Stdout:           ioutil.Discard,
+		FuncIsTerminal:   func() bool { return false },
+		FuncGetWidth:     func() int { return 80 },
+		CompleteMinChars: 2,
+		AutoComplete: CandidateFunc(func(line []rune, pos int) ([]Candidate, int) {
+			called++
+			return []Candidate{{Name: []rune("llo")}}, 2
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	op := rl.Operation
+	for _, c := range []struct {
+		line, expected string
+		called         int
+	}{
+		{"", "", 0},
+		{"h", "h", 0},
+		// the word is measured, not the line
+		{"say h", "say h", 0},
+		{"he", "hello", 1},
+		{"say he", "say hello", 2},
+	} {
+		op.ExitCompleteMode(false)
+		op.SetBuffer(c.line)
+		if !op.OnComplete() {
+			t.Fatalf("bell rung for %q", c.line)
+		}
+		if line := string(op.buf.Runes()); line != c.expected || called != c.called {
+			t.Fatalf("unexpected line %q for %q, called %d", line, c.line, called)
+		}
+	}
+}
+
+func TestCompleteCache(t *testing.T) {
+	called := 0
+	newInstance := func(input string) *Instance {
+		rl, err := NewEx(&Config{
+			Stdin:          ioutil.NopCloser(strings.NewReader(input)),
+			Stdout:         ioutil.Discard,
+			FuncIsTerminal: func() bool { return false },
+			FuncGetWidth:   func() int { return 80 },
+			AutoComplete: CandidateFunc(func(line []rune, pos int) ([]Candidate, int) {
+				called++
+				return []Candidate{{Name: []rune("abc")}, {Name: []rune("xyz")}}, 0
+			}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rl
+	}
+
+	rl := newInstance("")
+	defer rl.Close()
+	op := rl.Operation
+	op.OnComplete()
+	op.ExitCompleteMode(false)
+	op.OnComplete()
+	// cycling
+	op.OnComplete()
+	op.OnComplete()
+	if called != 1 || !op.IsInCompleteSelectMode() {
+		t.Fatal("completer called", called)
+	}
+	op.ExitCompleteMode(false)
+	op.SetBuffer("a")
+	op.OnComplete()
+	if called != 2 {
+		t.Fatal("completer called", called)
+	}
+
+	called = 0
+	rl = newInstance("\t\r\t\r")
+	defer rl.Close()
+	for i := 0; i < 2; i++ {
+		if line, err := rl.Readline(); err != nil || line != "" {
+			t.Fatal("result not expect", line, err)
+		}
+		// the cache is dropped once the line is submitted
+		if called != i+1 {
+			t.Fatal("completer called", called)
+		}
+	}
+}
+
+func TestCandidateCommentFunc(t *testing.T) {
+	called := map[string]int{}
+	comment := func(name string) func() []rune {
+		return func() []rune {
+			called[name]++
+			return []rune("about " + name)
+		}
+	}
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete: CandidateFunc(func(line []rune, pos int) ([]Candidate, int) {
+			return []Candidate{
+				{Name: []rune("abc"), CommentFunc: comment("abc")},
+				{Name: []rune("xyz"), CommentFunc: comment("xyz")},
+			}, 0
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	op := rl.Operation
+	check := func(abc, xyz int) {
+		t.Helper()
+		if called["abc"] != abc || called["xyz"] != xyz {
+			t.Fatal("CommentFunc calls not expect", called)
+		}
+	}
+	op.OnComplete()
+	// listing doesn't compute the comments
+	check(0, 0)
+	op.EnterCompleteSelectMode()
+	op.doSelect()
+	check(1, 0)
+	if comment := string(op.candidateComments[0]); comment != "about abc" {
+		t.Fatalf("comment not expect %q", comment)
+	}
+	op.doSelect()
+	check(1, 1)
+	// going back to a candidate doesn't compute it again
+	op.doSelect()
+	check(1, 1)
+
+	// the candidates listed again come from the cache of doComplete
+	op.ExitCompleteMode(false)
+	op.OnComplete()
+	op.EnterCompleteSelectMode()
+	op.doSelect()
+	op.doSelect()
+	check(1, 1)
+	if comment := string(op.candidateComments[0]); comment != "about abc" {
+		t.Fatalf("comment not expect %q", comment)
+	}
+}
+
+func TestSetAutoComplete(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		AutoComplete:   NewPrefixCompleter(PcItem("abc", ""), PcItem("abd", "")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	ret := make(chan string, 1)
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	w.Write([]byte("ab\t"))
+	for {
+		rl.Operation.m.Lock()
+		listed := rl.Operation.IsInCompleteMode()
+		rl.Operation.m.Unlock()
+		if listed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rl.SetAutoComplete(NewPrefixCompleter(PcItem("abxyz", "")))
+	// the completer is swapped in by the ioloop
+	for inCompleteMode(rl) {
+		time.Sleep(time.Millisecond)
+	}
+	if string(rl.Operation.buf.Runes()) != "ab" {
+		t.Fatal("result not expect", string(rl.Operation.buf.Runes()))
+	}
+	w.Write([]byte("\t\r"))
+	if line := <-ret; line != "abxyz " {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	// no completion
+	rl.SetAutoComplete(nil)
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	w.Write([]byte("ab\t\r"))
+	if line := <-ret; line != "ab" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+// countingCompleter counts the calls of the AutoCompleter
+type countingCompleter struct {
+	AutoCompleter
+	calls int32
+}
+
+func (c *countingCompleter) Do(line []rune, pos int) (newLine, commentLine [][]rune, length int) {
+	atomic.AddInt32(&c.calls, 1)
+	return c.AutoCompleter.Do(line, pos)
+}
+
+func TestIncrementalCompletion(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	ac := &countingCompleter{AutoCompleter: NewPrefixCompleter(PcItem("hello", ""), PcItem("help", ""))}
+	rl, err := NewEx(&Config{
+		Stdin:                      r,
+		Stdout:                     ioutil.Discard,
+		FuncIsTerminal:             func() bool { return false },
+		FuncGetWidth:               func() int { return 80 },
+		AutoComplete:               ac,
+		IncrementalCompletion:      true,
+		IncrementalCompletionDelay: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	ret := make(chan string, 1)
+	readline := func() {
+		go func() {
+			line, _ := rl.Readline()
+			ret <- line
+		}()
+	}
+
+	// the key typed in the delay cancels the pending listing
+	readline()
+	w.Write([]byte("he"))
+	w.Write([]byte("\r"))
+	if line := <-ret; line != "he" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if calls := atomic.LoadInt32(&ac.calls); calls != 0 || inCompleteMode(rl) {
+		t.Fatal("candidates listed", calls)
+	}
+
+	// the candidates are listed once no key is pressed in the delay, the
+	// line is untouched. Up selects the last candidate, Down the first one.
+	for _, c := range []struct {
+		key      rune
+		selected int
+		expected string
+	}{
+		{CharPrev, 1, "help "},
+		{CharNext, 0, "hello "},
+	} {
+		readline()
+		w.Write([]byte("he"))
+		for deadline := time.Now().Add(time.Second); !inCompleteMode(rl); {
+			if time.Now().After(deadline) {
+				t.Fatal("candidates not listed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if line := string(rl.Operation.buf.Runes()); line != "he" {
+			t.Fatalf("line changed %q", line)
+		}
+
+		w.Write([]byte(string(c.key)))
+		for {
+			rl.Operation.m.Lock()
+			selected := rl.Operation.IsInCompleteSelectMode() &&
+				rl.Operation.candidateChoise == c.selected
+			rl.Operation.m.Unlock()
+			if selected {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		w.Write([]byte("\r\r"))
+		if line := <-ret; line != c.expected {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestCompleteCacheNotStripped(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("gi\t\b\b\t\t\t\r")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete:   NewPrefixCompleter(PcItem("git-add", ""), PcItem("git-bisect", "")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// the cached candidates of "gi" are listed again after "t-" is erased
+	if line, err := rl.Readline(); err != nil || line != "git-add " {
+		t.Fatal("result not expect", line, err)
+	}
+}
+
+func TestCompleteMidLine(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Prompt:         "> ",
+		Stdin:          ioutil.NopCloser(strings.NewReader("文fbar\033[D\033[D\033[D\t\t\r\r")),
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 80 },
+		AutoComplete: CandidateFunc(func(line []rune, pos int) ([]Candidate, int) {
+			if string(line[pos-1:pos]) != "f" {
+				return nil, 0
+			}
+			return []Candidate{{Name: []rune("oo ")}, {Name: []rune("ax ")}}, 1
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// the candidate is inserted at the cursor
+	if line, err := rl.Readline(); err != nil || line != "文foo bar" {
+		t.Fatal("result not expect", line, err)
+	}
+	// the cursor goes back after "> 文f" when the candidates are listed
+	if !strings.Contains(out.String(), "\033[1A\r\033[5C") {
+		t.Fatalf("cursor not expect: %q", out.String())
+	}
+}
@@ -0,0 +1,144 @@
+package readline
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// editKey applies the editing actions which only touch the buffer.
+// It returns false if r is not one of them.
+//
+// It is shared by Operation.ioloop and LineEditor.Feed.
+func editKey(buf *RuneBuffer, r rune) bool {
+	switch r {
+	case CharCtrlU:
+		buf.KillFront()
+	case CharKill:
+		buf.Kill()
+	case MetaForward:
+		buf.MoveToNextWord()
+	case CharTranspose:
+		buf.Transpose()
+	case MetaBackward:
+		buf.MoveToPrevWord()
+	case MetaBigForward:
+		buf.MoveWordForward(true)
+	case MetaBigBackward:
+		buf.MoveWordBackward(true)
+	case MetaDelete:
+		buf.DeleteWord()
+	case CharLineStart:
+		buf.MoveToLogicalLineStart()
+	case CharLineEnd:
+		buf.MoveToLogicalLineEnd()
+	case MetaBackspace, CharCtrlW:
+		buf.BackEscapeWord()
+	case CharCtrlY:
+		buf.Yank()
+	case MetaYank:
+		buf.YankPop()
+	case CharBackward:
+		buf.MoveBackward()
+	case CharForward:
+		buf.MoveForward()
+	case CharInsert:
+		buf.ToggleOverwrite()
+	default:
+		return false
+	}
+	return true
+}
+
+// LineEditor is the line editing core of readline without a Terminal.
+// It owns no stdin/stdout and starts no goroutines, the caller decodes
+// the keys by itself and feeds them one by one, then renders Display()
+// and places the cursor at Cursor().
+//
+// Search, completion, history and vim mode are not supported.
+type LineEditor struct {
+	buf *RuneBuffer
+}
+
+// NewLineEditor returns a LineEditor with an empty line after prompt.
+func NewLineEditor(prompt string) *LineEditor {
+	cfg := &Config{
+		Painter:        &defaultPainter{},
+		FuncIsTerminal: func() bool { return false },
+		TabWidth:       DefaultTabWidth,
+	}
+	return &LineEditor{
+		buf: NewRuneBuffer(ioutil.Discard, prompt, cfg, 0),
+	}
+}
+
+// Feed handles a decoded key, done is true if the line is submitted by
+// CharEnter or CharCtrlJ, and the editor is reset for the next line.
+func (e *LineEditor) Feed(r rune) (done bool, line string) {
+	switch r {
+	case CharEnter, CharCtrlJ:
+		return true, string(e.buf.Reset())
+	case CharBackspace, CharCtrlH:
+		e.buf.Backspace()
+	case CharDelete:
+		e.buf.Delete()
+	default:
+		if editKey(e.buf, r) {
+			break
+		}
+		if IsPrintable(r) || r == CharTab {
+			e.buf.WriteRune(r)
+		}
+	}
+	return false, ""
+}
+
+// SetPrompt replaces the prompt, the line is kept.
+func (e *LineEditor) SetPrompt(prompt string) {
+	e.buf.SetPrompt(prompt)
+}
+
+// SetLine replaces the line and puts the cursor at its end.
+func (e *LineEditor) SetLine(line string) {
+	e.buf.Set([]rune(line))
+}
+
+// Line returns the line being edited, without the prompt.
+func (e *LineEditor) Line() string {
+	return string(e.buf.Runes())
+}
+
+// Pos returns the cursor position in the line, counted in runes.
+func (e *LineEditor) Pos() int {
+	return e.buf.Pos()
+}
+
+// Display returns the prompt and the current line, the tabs are expanded to
+// the spaces up to the next tab stop as Readline draws them.
+func (e *LineEditor) Display() string {
+	e.buf.Lock()
+	defer e.buf.Unlock()
+	var sb strings.Builder
+	sb.WriteString(string(e.buf.prompt))
+	col := e.buf.promptLen()
+	for i, r := range e.buf.buf {
+		if r == '\t' {
+			n := tabAdvance(col, e.buf.cfg.TabWidth)
+			sb.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		sb.WriteRune(r)
+		col += e.buf.widthAt(e.buf.buf, i)
+	}
+	return sb.String()
+}
+
+// Cursor returns the display column of the cursor, counted from the
+// beginning of the last line of the prompt. The wide runes take two
+// columns, and the tabs go to the next tab stop.
+func (e *LineEditor) Cursor() int {
+	e.buf.Lock()
+	defer e.buf.Unlock()
+	prompt := runes.ColorFilter(e.buf.prompt[e.buf.promptLines():])
+	return e.buf.widthAll(append(prompt, e.buf.buf[:e.buf.idx]...))
+}
@@ -0,0 +1,88 @@
+package readline
+
+import (
+	"testing"
+)
+
+func TestLineEditorFeed(t *testing.T) {
+	e := NewLineEditor("> ")
+	for _, r := range "hello world" {
+		if done, _ := e.Feed(r); done {
+			t.Fatal("submitted too early")
+		}
+	}
+	for _, c := range []struct {
+		r    rune
+		line string
+		pos  int
+	}{
+		{MetaBackward, "hello world", 6},
+		{CharBackspace, "helloworld", 5},
+		{CharLineStart, "helloworld", 0},
+		{CharDelete, "elloworld", 0},
+		{CharForward, "elloworld", 1},
+		{CharKill, "e", 1},
+		// not printable
+		{CharEsc, "e", 1},
+	} {
+		e.Feed(c.r)
+		if e.Line() != c.line || e.Pos() != c.pos {
+			t.Fatalf("%q: result not expect %q %d", c.r, e.Line(), e.Pos())
+		}
+	}
+
+	done, line := e.Feed(CharEnter)
+	if !done || line != "e" {
+		t.Fatal("result not expect", done, line)
+	}
+	// reset for the next line
+	if e.Line() != "" || e.Pos() != 0 {
+		t.Fatalf("not reset: %q %d", e.Line(), e.Pos())
+	}
+}
+
+func TestLineEditorSetLine(t *testing.T) {
+	e := NewLineEditor("> ")
+	e.SetLine("ls -l")
+	if e.Line() != "ls -l" || e.Pos() != 5 {
+		t.Fatal("result not expect", e.Line(), e.Pos())
+	}
+	e.SetPrompt("$ ")
+	if d := e.Display(); d != "$ ls -l" {
+		t.Fatalf("display not expect %q", d)
+	}
+}
+
+func TestLineEditorCursor(t *testing.T) {
+	for _, c := range []struct {
+		prompt  string
+		line    string
+		back    int
+		display string
+		cursor  int
+	}{
+		{"> ", "abc", 0, "> abc", 5},
+		{"> ", "abc", 2, "> abc", 3},
+		// the wide runes take two columns
+		{"> ", "你好", 0, "> 你好", 6},
+		{"> ", "你好", 1, "> 你好", 4},
+		// the tab goes to the next tab stop, counted from the prompt
+		{"> ", "a\tb", 0, "> a     b", 9},
+		{"> ", "a\tb", 1, "> a     b", 8},
+		{"> ", "a\tb", 2, "> a     b", 3},
+		// the color of the prompt takes no column
+		{"\033[31m>\033[0m ", "a", 0, "\033[31m>\033[0m a", 3},
+	} {
+		e := NewLineEditor(c.prompt)
+		e.SetLine(c.line)
+		for i := 0; i < c.back; i++ {
+			e.Feed(CharBackward)
+		}
+		if d := e.Display(); d != c.display {
+			t.Fatalf("%q: display not expect %q", c.line, d)
+		}
+		if cursor := e.Cursor(); cursor != c.cursor {
+			t.Fatalf("%q %d: cursor not expect %d", c.line, c.back, cursor)
+		}
+	}
+}
@@ -4,9 +4,27 @@ import (
 	"bufio"
 	"container/list"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 	"sync"
+	"time"
+)
+
+// DefaultHistoryAutoSaveInterval is the default Config.HistoryAutoSaveInterval
+const DefaultHistoryAutoSaveInterval = time.Second
+
+// HistoryDedup decides how the duplicated history items are dropped.
+type HistoryDedup int
+
+const (
+	// DedupConsecutive drops an item equal to the previous one
+	DedupConsecutive HistoryDedup = iota
+	// DedupNone keeps all of the items
+	DedupNone
+	// DedupAll drops the earlier items equal to the new one, so it's moved
+	// to the end
+	DedupAll
 )
 
 type hisItem struct {
@@ -28,6 +46,13 @@ type opHistory struct {
 	fd         *os.File
 	fdLock     sync.Mutex
 	enable     bool
+
+	// trims the history file once no item is added for a while, see
+	// Config.HistoryAutoSave
+	trimTimer *time.Timer
+	// how many items are in the history file, it's rewritten with the last
+	// HistoryLimit items once it grows too long.
+	fileLines int
 }
 
 func newOpHistory(cfg *Config) (o *opHistory) {
@@ -73,6 +98,8 @@ func (o *opHistory) historyUpdatePath(path string) {
 	o.fd = f
 	r := bufio.NewReader(o.fd)
 	total := 0
+	// the file is rewritten without the duplicated items
+	dropped := false
 	for ; ; total++ {
 		line, err := r.ReadString('\n')
 		if err != nil {
@@ -83,10 +110,18 @@ func (o *opHistory) historyUpdatePath(path string) {
 		if len(line) == 0 {
 			continue
 		}
+		if o.isDuplicated([]rune(line)) {
+			dropped = true
+			continue
+		}
+		if o.cfg.HistoryDedup == DedupAll && o.removeDuplicates([]rune(line)) > 0 {
+			dropped = true
+		}
 		o.Push([]rune(line))
 		o.Compact()
 	}
-	if total > o.cfg.HistoryLimit {
+	o.fileLines = total
+	if total > o.cfg.HistoryLimit || dropped {
 		o.rewriteLocked()
 	}
 	o.historyVer++
@@ -94,9 +129,56 @@ func (o *opHistory) historyUpdatePath(path string) {
 	return
 }
 
+// isDuplicated reports whether s should be dropped since it's equal to the
+// last item, see Config.HistoryDedup.
+func (o *opHistory) isDuplicated(s []rune) bool {
+	back := o.history.Back()
+	return o.cfg.HistoryDedup != DedupNone && back != nil &&
+		runes.Equal(back.Value.(*hisItem).Source, s)
+}
+
+// removeDuplicates removes the items equal to s, and returns how many of
+// them are removed.
+func (o *opHistory) removeDuplicates(s []rune) int {
+	removed := 0
+	for elem := o.history.Front(); elem != nil; {
+		next := elem.Next()
+		if elem != o.current && runes.Equal(elem.Value.(*hisItem).Source, s) {
+			o.history.Remove(elem)
+			removed++
+		}
+		elem = next
+	}
+	return removed
+}
+
+// Compact drops the oldest items beyond Config.HistoryLimit, current is
+// moved to the oldest one left if it's dropped.
 func (o *opHistory) Compact() {
 	for o.history.Len() > o.cfg.HistoryLimit && o.history.Len() > 0 {
-		o.history.Remove(o.history.Front())
+		front := o.history.Front()
+		o.history.Remove(front)
+		if front == o.current {
+			o.current = o.history.Front()
+		}
+	}
+}
+
+// contains reports whether elem is not dropped from the history yet.
+func (o *opHistory) contains(elem *list.Element) bool {
+	for e := o.history.Back(); e != nil; e = e.Prev() {
+		if e == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// trimFile rewrites the history file once it holds twice as many items as
+// Config.HistoryLimit, so it doesn't grow forever in a long session.
+func (o *opHistory) trimFile() {
+	if o.cfg.HistoryLimit > 0 && o.fileLines > 2*o.cfg.HistoryLimit {
+		o.rewriteLocked()
 	}
 }
 
@@ -107,6 +189,35 @@ func (o *opHistory) Rewrite() {
 }
 
 func (o *opHistory) rewriteLocked() {
+	var lines []string
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		lines = append(lines, string(elem.Value.(*hisItem).Source))
+	}
+	o.replaceFileLocked(lines)
+}
+
+// trimLocked rewrites the history file with its last HistoryLimit lines,
+// the file is read rather than the items, which are changed by ioloop.
+func (o *opHistory) trimLocked() {
+	data, err := ioutil.ReadFile(o.cfg.HistoryFile)
+	if err != nil {
+		return
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if n := len(lines) - o.cfg.HistoryLimit; n > 0 {
+		lines = lines[n:]
+	}
+	o.replaceFileLocked(lines)
+}
+
+// replaceFileLocked replaces the history file by lines, the empty ones are
+// dropped.
+func (o *opHistory) replaceFileLocked(lines []string) {
 	if o.cfg.HistoryFile == "" {
 		return
 	}
@@ -117,9 +228,14 @@ func (o *opHistory) rewriteLocked() {
 		return
 	}
 
+	o.fileLines = 0
 	buf := bufio.NewWriter(fd)
-	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
-		buf.WriteString(string(elem.Value.(*hisItem).Source) + "\n")
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		buf.WriteString(line + "\n")
+		o.fileLines++
 	}
 	buf.Flush()
 
@@ -139,11 +255,37 @@ func (o *opHistory) rewriteLocked() {
 func (o *opHistory) Close() {
 	o.fdLock.Lock()
 	defer o.fdLock.Unlock()
+	if o.trimTimer != nil {
+		o.trimTimer.Stop()
+	}
+	if o.fileLines > o.cfg.HistoryLimit {
+		o.rewriteLocked()
+	}
 	if o.fd != nil {
 		o.fd.Close()
 	}
 }
 
+// scheduleTrim rewrites the history file with the last HistoryLimit items
+// once no item is added in Config.HistoryAutoSaveInterval.
+func (o *opHistory) scheduleTrim() {
+	if o.trimTimer == nil {
+		o.trimTimer = time.AfterFunc(o.cfg.HistoryAutoSaveInterval, func() {
+			o.fdLock.Lock()
+			defer o.fdLock.Unlock()
+			// closed meanwhile
+			if o.fd == nil || o.fd.Fd() == ^(uintptr(0)) {
+				return
+			}
+			if o.cfg.HistoryLimit > 0 && o.fileLines > o.cfg.HistoryLimit {
+				o.trimLocked()
+			}
+		})
+		return
+	}
+	o.trimTimer.Reset(o.cfg.HistoryAutoSaveInterval)
+}
+
 func (o *opHistory) FindBck(isNewSearch bool, rs []rune, start int) (int, *list.Element) {
 	for elem := o.current; elem != nil; elem = elem.Prev() {
 		item := o.showItem(elem.Value)
@@ -192,6 +334,48 @@ func (o *opHistory) FindFwd(isNewSearch bool, rs []rune, start int) (int, *list.
 	return -1, nil
 }
 
+// countMatches returns how many history items contain rs, and the index of
+// target among them, counted from the most recent one and starting at 1.
+// The index is 0 if target doesn't contain rs.
+func (o *opHistory) countMatches(rs []rune, target *list.Element) (index, count int) {
+	for elem := o.history.Back(); elem != nil; elem = elem.Prev() {
+		if runes.IndexAllEx(o.showItem(elem.Value), rs, o.cfg.HistorySearchFold) < 0 {
+			continue
+		}
+		count++
+		if elem == target {
+			index = count
+		}
+	}
+	return index, count
+}
+
+// Search returns the saved items containing rs as the incremental search
+// matches them, the most recent one first unless forward is true. All of
+// the items are returned if rs is empty.
+func (o *opHistory) Search(rs []rune, forward bool) []string {
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	var ret []string
+	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+		source := elem.Value.(*hisItem).Source
+		if len(source) == 0 {
+			// the line being edited
+			continue
+		}
+		if runes.IndexAllEx(source, rs, o.cfg.HistorySearchFold) < 0 {
+			continue
+		}
+		ret = append(ret, string(source))
+	}
+	if !forward {
+		for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+			ret[i], ret[j] = ret[j], ret[i]
+		}
+	}
+	return ret
+}
+
 func (o *opHistory) showItem(obj interface{}) []rune {
 	item := obj.(*hisItem)
 	if item.Version == o.historyVer {
@@ -225,6 +409,55 @@ func (o *opHistory) Next() ([]rune, bool) {
 	return runes.Copy(o.showItem(current.Value)), true
 }
 
+// PrevWithPrefix recalls the previous item starting with prefix and
+// differing from the current one, ok is false if there is none.
+func (o *opHistory) PrevWithPrefix(prefix []rune) ([]rune, bool) {
+	return o.findPrefix(prefix, (*list.Element).Prev)
+}
+
+// NextWithPrefix is like PrevWithPrefix but goes forward, it ends at the
+// line being edited.
+func (o *opHistory) NextWithPrefix(prefix []rune) ([]rune, bool) {
+	return o.findPrefix(prefix, (*list.Element).Next)
+}
+
+func (o *opHistory) findPrefix(prefix []rune, step func(*list.Element) *list.Element) ([]rune, bool) {
+	if o.current == nil {
+		return nil, false
+	}
+	shown := o.showItem(o.current.Value)
+	for elem := step(o.current); elem != nil; elem = step(elem) {
+		item := o.showItem(elem.Value)
+		if !runes.HasPrefix(item, prefix) || runes.Equal(item, shown) {
+			continue
+		}
+		o.current = elem
+		return runes.Copy(item), true
+	}
+	return nil, false
+}
+
+// First recalls the oldest item, ok is false if it's recalled already.
+func (o *opHistory) First() ([]rune, bool) {
+	front := o.history.Front()
+	if front == nil || front == o.current {
+		return nil, false
+	}
+	o.current = front
+	return runes.Copy(o.showItem(front.Value)), true
+}
+
+// Last goes back to the line being edited, ok is false if it's there
+// already.
+func (o *opHistory) Last() ([]rune, bool) {
+	back := o.history.Back()
+	if back == nil || back == o.current {
+		return nil, false
+	}
+	o.current = back
+	return runes.Copy(o.showItem(back.Value)), true
+}
+
 // Disable the current history
 func (o *opHistory) Disable() {
 	o.enable = false
@@ -235,10 +468,16 @@ func (o *opHistory) Enable() {
 	o.enable = true
 }
 
+// debug dumps the items to Config.Logger, or to the file of Debug if it's
+// not set.
 func (o *opHistory) debug() {
-	Debug("-------")
+	debug := Debug
+	if o.cfg.Logger != nil {
+		debug = func(a ...interface{}) { fmt.Fprintln(o.cfg.Logger, a...) }
+	}
+	debug("-------")
 	for item := o.history.Front(); item != nil; item = item.Next() {
-		Debug(fmt.Sprintf("%+v", item.Value))
+		debug(fmt.Sprintf("%+v", item.Value))
 	}
 }
 
@@ -256,7 +495,7 @@ func (o *opHistory) New(current []rune) (err error) {
 	// just clean lastest history
 	if back := o.history.Back(); back != nil {
 		prev := back.Prev()
-		if prev != nil {
+		if prev != nil && o.cfg.HistoryDedup != DedupNone {
 			if runes.Equal(current, prev.Value.(*hisItem).Source) {
 				o.current = o.history.Back()
 				o.current.Value.(*hisItem).Clean()
@@ -284,8 +523,20 @@ func (o *opHistory) New(current []rune) (err error) {
 		current = runes.Copy(currentItem.Tmp)
 	}
 
+	// move the item to the end
+	moved := false
+	if o.cfg.HistoryDedup == DedupAll {
+		o.fdLock.Lock()
+		moved = o.removeDuplicates(current) > 0
+		o.fdLock.Unlock()
+	}
+
 	// err only can be a IO error, just report
 	err = o.Update(current, true)
+	if moved {
+		// drop the earlier item from the file too
+		o.Rewrite()
+	}
 
 	// push a new one to commit current command
 	o.historyVer++
@@ -293,6 +544,35 @@ func (o *opHistory) New(current []rune) (err error) {
 	return
 }
 
+// Add appends s to the history without writing it to the history file,
+// it's inserted before the line being edited. s is dropped if it's empty
+// or the same as the last item.
+func (o *opHistory) Add(s []rune) {
+	if !o.enable || len(s) == 0 {
+		return
+	}
+	o.fdLock.Lock()
+	defer o.fdLock.Unlock()
+	s = runes.Copy(s)
+	back := o.history.Back()
+	if back == nil {
+		o.history.PushBack(&hisItem{Source: s})
+		o.historyVer++
+		o.Push(nil)
+		o.Compact()
+		return
+	}
+	if prev := back.Prev(); prev != nil && o.cfg.HistoryDedup != DedupNone &&
+		runes.Equal(prev.Value.(*hisItem).Source, s) {
+		return
+	}
+	if o.cfg.HistoryDedup == DedupAll {
+		o.removeDuplicates(s)
+	}
+	o.history.InsertBefore(&hisItem{Source: s}, back)
+	o.Compact()
+}
+
 func (o *opHistory) Revert() {
 	o.historyVer++
 	o.current = o.history.Back()
@@ -314,6 +594,12 @@ func (o *opHistory) Update(s []rune, commit bool) (err error) {
 		if o.fd != nil {
 			// just report the error
 			_, err = o.fd.Write([]byte(string(r.Source) + "\n"))
+			o.fileLines++
+			if o.cfg.HistoryAutoSave {
+				o.scheduleTrim()
+			} else {
+				o.trimFile()
+			}
 		}
 	} else {
 		r.Tmp = append(r.Tmp[:0], s...)
@@ -0,0 +1,259 @@
+package readline
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHistory(items ...string) *opHistory {
+	h := newOpHistory(&Config{HistoryLimit: 10})
+	for _, item := range items {
+		h.New([]rune(item))
+	}
+	return h
+}
+
+func historySources(h *opHistory) []string {
+	var ret []string
+	for elem := h.history.Front(); elem != nil; elem = elem.Next() {
+		ret = append(ret, string(elem.Value.(*hisItem).Source))
+	}
+	return ret
+}
+
+func TestHistoryEditRecalledLine(t *testing.T) {
+	h := newTestHistory("echo foo", "ls")
+
+	line := h.Prev()
+	if string(line) != "ls" {
+		t.Fatal("result not expect", string(line))
+	}
+	line = append(line, []rune(" -l")...)
+	h.Update(line, false)
+	h.New(line)
+
+	ret := historySources(h)
+	if len(ret) != 4 || ret[0] != "echo foo" || ret[1] != "ls" || ret[2] != "ls -l" || ret[3] != "" {
+		t.Fatalf("result not expect %q", ret)
+	}
+}
+
+func TestHistoryEditSearchedLine(t *testing.T) {
+	h := newTestHistory("echo foo", "ls")
+	cfg := &Config{
+		Painter:        &defaultPainter{},
+		FuncIsTerminal: func() bool { return false },
+	}
+	buf := NewRuneBuffer(ioutil.Discard, "", cfg, 80)
+	s := newOpSearch(ioutil.Discard, buf, h, cfg, 80)
+
+	s.SearchMode(S_DIR_BCK)
+	s.SearchChar('e')
+	s.ExitSearchMode(false)
+	buf.MoveToLineStart()
+	buf.Delete()
+	if string(buf.Runes()) != "cho foo" {
+		t.Fatal("result not expect", string(buf.Runes()))
+	}
+
+	ret := historySources(h)
+	if ret[0] != "echo foo" {
+		t.Fatalf("history is modified: %q", ret)
+	}
+}
+
+func TestHistoryAdd(t *testing.T) {
+	h := newTestHistory("ls")
+	h.Add([]rune("make"))
+	h.Add([]rune("make"))
+	h.Add(nil)
+
+	ret := historySources(h)
+	if len(ret) != 3 || ret[0] != "ls" || ret[1] != "make" || ret[2] != "" {
+		t.Fatalf("result not expect %q", ret)
+	}
+	if line := h.Prev(); string(line) != "make" {
+		t.Fatal("result not expect", string(line))
+	}
+
+	h = newTestHistory()
+	h.Add([]rune("make"))
+	if line := h.Prev(); string(line) != "make" {
+		t.Fatal("result not expect", string(line))
+	}
+}
+
+func TestMaskedLineNotInHistory(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("secret\rplain\r")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	rl.SetMaskRune('*')
+	if line, err := rl.Readline(); err != nil || line != "secret" {
+		t.Fatal("result not expect", line, err)
+	}
+	rl.SetMaskRune(0)
+	if line, err := rl.Readline(); err != nil || line != "plain" {
+		t.Fatal("result not expect", line, err)
+	}
+	// Search takes the lock of the history, the line being edited is skipped
+	if sources := rl.Operation.history.Search(nil, true); strings.Join(sources, "|") != "plain" {
+		t.Fatalf("unexpected history %q", sources)
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+	h := newTestHistory("git status", "ls", "GIT log")
+	h.cfg.HistorySearchFold = true
+	for _, c := range []struct {
+		pattern  string
+		forward  bool
+		expected string
+	}{
+		{"git", false, "GIT log|git status"},
+		{"git", true, "git status|GIT log"},
+		{"", true, "git status|ls|GIT log"},
+		{"rm", false, ""},
+	} {
+		if ret := strings.Join(h.Search([]rune(c.pattern), c.forward), "|"); ret != c.expected {
+			t.Fatal("result not expect", c.pattern, c.forward, ret)
+		}
+	}
+}
+
+func TestHistoryAutoSave(t *testing.T) {
+	f, err := ioutil.TempFile("", "readline-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cfg := &Config{
+		HistoryFile:             f.Name(),
+		HistoryLimit:            2,
+		HistoryAutoSave:         true,
+		HistoryAutoSaveInterval: 20 * time.Millisecond,
+	}
+	cfg.Init()
+	h := newOpHistory(cfg)
+	h.Init()
+	saved := func() string {
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// written at once
+	h.New([]rune("ls"))
+	h.New([]rune("pwd"))
+	h.New([]rune("exit"))
+	if data := saved(); data != "ls\npwd\nexit\n" {
+		t.Fatalf("unexpected history file %q", data)
+	}
+	// trimmed once no item is added for a while
+	time.Sleep(100 * time.Millisecond)
+	if data := saved(); data != "pwd\nexit\n" {
+		t.Fatalf("unexpected history file %q", data)
+	}
+
+	h.New([]rune("cd"))
+	h.Close()
+	if data := saved(); data != "exit\ncd\n" {
+		t.Fatalf("unexpected history file %q", data)
+	}
+}
+
+func TestHistoryDedup(t *testing.T) {
+	for _, c := range []struct {
+		dedup    HistoryDedup
+		expected string
+	}{
+		{DedupConsecutive, "ls|ls -l|pwd|ls|"},
+		{DedupNone, "ls|ls|ls -l|pwd|ls|"},
+		{DedupAll, "ls -l|pwd|ls|"},
+	} {
+		h := newOpHistory(&Config{HistoryLimit: 10, HistoryDedup: c.dedup})
+		for _, item := range []string{"ls", "ls", "ls -l", "pwd", "ls"} {
+			h.New([]rune(item))
+		}
+		if sources := strings.Join(historySources(h), "|"); sources != c.expected {
+			t.Fatal("result not expect", c.dedup, sources)
+		}
+	}
+
+	// the recalled item is moved to the end
+	h := newOpHistory(&Config{HistoryLimit: 10, HistoryDedup: DedupAll})
+	for _, item := range []string{"ls", "pwd"} {
+		h.New([]rune(item))
+	}
+	h.Prev()
+	line := h.Prev()
+	// as the edited line is kept by ioloop
+	h.Update(line, false)
+	h.New(line)
+	if sources := strings.Join(historySources(h), "|"); sources != "pwd|ls|" {
+		t.Fatal("result not expect", sources)
+	}
+	if ret := h.Search([]rune("ls"), false); len(ret) != 1 {
+		t.Fatal("result not expect", ret)
+	}
+	if line := h.Prev(); string(line) != "ls" {
+		t.Fatal("result not expect", string(line))
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	f, err := ioutil.TempFile("", "readline-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	h := newOpHistory(&Config{HistoryFile: f.Name(), HistoryLimit: 3})
+	h.Init()
+	for _, item := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		h.New([]rune(item))
+	}
+	if ret := historySources(h); strings.Join(ret, ",") != "f,g,h," {
+		t.Fatalf("result not expect %q", ret)
+	}
+
+	// recall the oldest one, then drop it
+	if line := h.Prev(); string(line) != "h" {
+		t.Fatal("result not expect", string(line))
+	}
+	h.Prev()
+	if line := h.Prev(); string(line) != "f" {
+		t.Fatal("result not expect", string(line))
+	}
+	h.Add([]rune("x"))
+	// f and g are dropped, current is moved to h
+	if line, ok := h.Next(); !ok || string(line) != "x" {
+		t.Fatal("result not expect", string(line), ok)
+	}
+	if line, ok := h.Next(); !ok || string(line) != "" {
+		t.Fatal("result not expect", string(line), ok)
+	}
+
+	h.Close()
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Fields(string(data)); len(lines) > 3 {
+		t.Fatalf("history file not trimmed: %q", lines)
+	}
+}
@@ -0,0 +1,101 @@
+package readline
+
+// DefaultKillRingSize is the default Config.KillRingSize
+const DefaultKillRingSize = 10
+
+type killDir int
+
+const (
+	killNone killDir = iota
+	killForward
+	killBackward
+)
+
+// killRing keeps the killed texts, the most recent one first. Ctrl+Y yanks
+// the first one, and Meta+Y replaces the yanked text by the next one.
+type killRing struct {
+	items [][]rune
+
+	// the direction of the kill by the previous and the current key, the
+	// consecutive kills in the same direction are merged into items[0].
+	lastKill, killed killDir
+	// whether the previous and the current key yanked, Meta+Y only works
+	// right after a yank.
+	lastYank, yanked bool
+	// items[yankIdx] is yanked, it's yankLen runes before the cursor.
+	yankIdx int
+	yankLen int
+}
+
+// newKey is called before handling a key, so the kills and the yanks of
+// the previous key are known.
+func (k *killRing) newKey() {
+	k.lastKill, k.killed = k.killed, killNone
+	k.lastYank, k.yanked = k.yanked, false
+}
+
+// chain merges the next kill into items[0] if it's in the same direction
+// as the current one, as if the next kill is done by the next key, i.e. for
+// the kills repeated by a count.
+func (k *killRing) chain() {
+	k.lastKill = k.killed
+}
+
+func (k *killRing) push(text []rune, dir killDir, size int) {
+	text = runes.Copy(text)
+	switch {
+	case dir != killNone && dir == k.lastKill && len(k.items) > 0:
+		if dir == killBackward {
+			k.items[0] = append(text, k.items[0]...)
+		} else {
+			k.items[0] = append(k.items[0], text...)
+		}
+	case len(text) > 0:
+		k.items = append([][]rune{text}, k.items...)
+		if size <= 0 {
+			size = DefaultKillRingSize
+		}
+		if len(k.items) > size {
+			k.items = k.items[:size]
+		}
+	}
+	k.killed = dir
+}
+
+// yank returns the text to be yanked by Ctrl+Y.
+func (k *killRing) yank() []rune {
+	if len(k.items) == 0 {
+		return nil
+	}
+	k.yankIdx = 0
+	k.yankLen = len(k.items[0])
+	k.yanked = true
+	return k.items[0]
+}
+
+// yankPop returns the text replacing the one just yanked, ok is false if
+// the previous key didn't yank.
+func (k *killRing) yankPop() (text []rune, ok bool) {
+	if !k.lastYank || len(k.items) == 0 {
+		return nil, false
+	}
+	k.yankIdx = (k.yankIdx + 1) % len(k.items)
+	k.yankLen = len(k.items[k.yankIdx])
+	k.yanked = true
+	return k.items[k.yankIdx], true
+}
+
+func (k *killRing) list() [][]rune {
+	ret := make([][]rune, 0, len(k.items))
+	for _, item := range k.items {
+		ret = append(ret, runes.Copy(item))
+	}
+	return ret
+}
+
+func (k *killRing) set(items [][]rune, size int) {
+	*k = killRing{}
+	for i := len(items) - 1; i >= 0; i-- {
+		k.push(items[i], killNone, size)
+	}
+}
@@ -0,0 +1,46 @@
+package readline
+
+import "fmt"
+
+// The keys of the messages passed to Config.Translator, with the english
+// defaults in the comments. The args are the ones of the default format.
+const (
+	// "bck-i-search: %s", the arg is the query
+	MsgSearchBackward = "search.backward"
+	// "fwd-i-search: %s", the arg is the query
+	MsgSearchForward = "search.forward"
+	// "failing %s", the arg is the translated MsgSearchBackward or MsgSearchForward
+	MsgSearchFailing = "search.failing"
+	// "already complete"
+	MsgAlreadyComplete = "complete.already"
+	// "already complete: %s", the arg is the comment of the candidate
+	MsgAlreadyCompleteComment = "complete.already_comment"
+	// "+%d more", the arg is the number of candidates not listed
+	MsgMoreCandidates = "complete.more"
+	// "^C", the default Config.InterruptPrompt
+	MsgInterrupt = "interrupt"
+	// "^D", the default Config.EOFPrompt
+	MsgEOF = "eof"
+)
+
+var defaultMessages = map[string]string{
+	MsgSearchBackward:         "bck-i-search: %s",
+	MsgSearchForward:          "fwd-i-search: %s",
+	MsgSearchFailing:          "failing %s",
+	MsgAlreadyComplete:        "already complete",
+	MsgAlreadyCompleteComment: "already complete: %s",
+	MsgMoreCandidates:         "+%d more",
+	MsgInterrupt:              "^C",
+	MsgEOF:                    "^D",
+}
+
+// translate returns the message of key by Config.Translator, it falls back
+// to the english one if there is no Translator or it returns "".
+func (c *Config) translate(key string, args ...interface{}) string {
+	if c.Translator != nil {
+		if msg := c.Translator(key, args...); msg != "" {
+			return msg
+		}
+	}
+	return fmt.Sprintf(defaultMessages[key], args...)
+}
@@ -1,13 +1,34 @@
 package readline
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 var (
+	// ErrInterrupt is returned with the partial line when Ctrl+C is
+	// pressed while reading a line, unless it only cancels the search or
+	// the completion.
 	ErrInterrupt = errors.New("Interrupt")
+	// ErrEOF is returned when Ctrl+D is pressed on an empty line, or on any
+	// line with AlwaysEOF, and when stdin is drained with nothing in the
+	// buffer. Ctrl+D deletes the character under the cursor otherwise, see
+	// Config.CtrlDBehavior. It's io.EOF, so checking io.EOF still works.
+	ErrEOF = io.EOF
+	// ErrClosed is returned when reading after the Terminal is closed
+	ErrClosed = errors.New("Closed")
+	// ErrTimeout is returned by ReadlineWithTimeout if no line is submitted
+	// in time
+	ErrTimeout = errors.New("Timeout")
 )
 
 type InterruptError struct {
@@ -18,8 +39,16 @@ func (*InterruptError) Error() string {
 	return "Interrupted"
 }
 
+// Is makes errors.Is(err, ErrInterrupt) true.
+func (*InterruptError) Is(target error) bool {
+	return target == ErrInterrupt
+}
+
 type Operation struct {
-	m       sync.Mutex
+	m sync.Mutex
+	// guards cfg.AutoComplete, which is read by the completion without m,
+	// it's changed with both held, see SetAutoComplete.
+	acM     sync.RWMutex
 	cfg     *Config
 	t       *Terminal
 	buf     *RuneBuffer
@@ -27,6 +56,22 @@ type Operation struct {
 	errchan chan error
 	w       io.Writer
 
+	// a transient hint is shown in the status line, see showHint
+	hinting    bool
+	hintBackup string
+
+	// the key read after a prefix of Config.KeySequenceBindings which is
+	// not bound, it's handled in the next loop.
+	unreadKey rune
+	// the read is given up by a timeout or a context, the keys typed after
+	// it are kept for the next read rather than handled. Guarded by m.
+	readAborted bool
+	abortedKeys []rune
+	// the funcs handed to ioloop by runLater, they're run between the keys
+	// so they can touch the line being read. Guarded by m.
+	tasks    []func()
+	taskChan chan struct{}
+
 	history *opHistory
 	*opSearch
 	*opCompleter
@@ -38,41 +83,67 @@ func (o *Operation) SetBuffer(what string) {
 	o.buf.Set([]rune(what))
 }
 
+// BufferSnapshot returns a copy of the line being edited and the cursor
+// position in it, counted in runes.
+func (o *Operation) BufferSnapshot() (rs []rune, pos int) {
+	return o.buf.Snapshot()
+}
+
+// SetBufferWithPos replaces the line being edited by a copy of rs and puts
+// the cursor at pos, which is clamped to the line, then redraws it.
+func (o *Operation) SetBufferWithPos(rs []rune, pos int) {
+	if pos < 0 {
+		pos = 0
+	} else if pos > len(rs) {
+		pos = len(rs)
+	}
+	o.buf.SetWithIdx(pos, runes.Copy(rs))
+}
+
 type wrapWriter struct {
 	r      *Operation
 	t      *Terminal
 	target io.Writer
 }
 
+// Write writes b above the line being read, it's handed to ioloop which
+// redraws the line, so the error of the target is not reported then.
 func (w *wrapWriter) Write(b []byte) (int, error) {
 	if !w.t.IsReading() {
 		return w.target.Write(b)
 	}
-
-	var (
-		n   int
-		err error
-	)
-	w.r.buf.Refresh(func() {
-		n, err = w.target.Write(b)
+	b = append([]byte(nil), b...)
+	w.r.runLater(func() {
+		w.r.writeAbove(w.target, b)
 	})
+	return len(b), nil
+}
 
-	if w.r.IsSearchMode() {
-		w.r.SearchRefresh(-1)
+// writeAbove writes b to target, the line being read is redrawn below it.
+func (o *Operation) writeAbove(target io.Writer, b []byte) {
+	if !o.t.IsReading() {
+		target.Write(b)
+		return
+	}
+	o.buf.Refresh(func() {
+		target.Write(b)
+	})
+	if o.IsSearchMode() {
+		o.SearchRefresh(-1)
 	}
-	if w.r.IsInCompleteMode() {
-		w.r.CompleteRefresh()
+	if o.IsInCompleteMode() {
+		o.CompleteRefresh()
 	}
-	return n, err
 }
 
 func NewOperation(t *Terminal, cfg *Config) *Operation {
-	width := cfg.FuncGetWidth()
+	width := cfg.screenWidth()
 	op := &Operation{
-		t:       t,
-		buf:     NewRuneBuffer(t, cfg.Prompt, cfg, width),
-		outchan: make(chan []rune),
-		errchan: make(chan error, 1),
+		t:        t,
+		buf:      NewRuneBuffer(t, cfg.Prompt, cfg, width),
+		outchan:  make(chan []rune),
+		errchan:  make(chan error, 1),
+		taskChan: make(chan struct{}, 1),
 	}
 	op.w = op.buf.w
 	op.SetConfig(cfg)
@@ -80,21 +151,99 @@ func NewOperation(t *Terminal, cfg *Config) *Operation {
 	op.opCompleter = newOpCompleter(op.buf.w, op, width)
 	op.opPassword = newOpPassword(op)
 	op.cfg.FuncOnWidthChanged(func() {
-		newWidth := cfg.FuncGetWidth()
-		op.opCompleter.OnWidthChange(newWidth)
-		op.opSearch.OnWidthChange(newWidth)
-		op.buf.OnWidthChange(newWidth)
+		op.runLater(func() {
+			op.reflow(cfg.screenWidth())
+		})
 	})
 	go op.ioloop()
 	return op
 }
 
+// reflow redraws the line being read for the new screen width, the
+// terminal is assumed to rewrap the drawn lines by itself, so the cursor
+// line is counted by the new width. It's run by ioloop, see runLater.
+func (o *Operation) reflow(newWidth int) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.opCompleter.OnWidthChange(newWidth)
+	o.opSearch.OnWidthChange(newWidth)
+	o.buf.OnWidthChange(newWidth)
+	if !o.t.IsReading() {
+		return
+	}
+	o.buf.Refresh(nil)
+	if o.IsInCompleteMode() {
+		o.CompleteRefresh()
+	} else if o.IsSearchMode() {
+		o.SearchRefresh(-1)
+	}
+}
+
+// SetPrompt changes the prompt, the line being read is redrawn with it and
+// the input is kept. A multi-line prompt is supported as long as its lines
+// fit in the screen.
 func (o *Operation) SetPrompt(s string) {
-	o.buf.SetPrompt(s)
+	o.m.Lock()
+	defer o.m.Unlock()
+	if !o.t.IsReading() {
+		o.buf.SetPrompt(s)
+		return
+	}
+	o.buf.Refresh(func() {
+		o.buf.setPrompt(s)
+	})
+	if o.IsInCompleteMode() {
+		o.CompleteRefresh()
+	} else if o.IsSearchMode() {
+		o.SearchRefresh(-1)
+	}
+}
+
+// Prompt returns the prompt currently in use, set by Config.Prompt or SetPrompt.
+func (o *Operation) Prompt() string {
+	return o.buf.Prompt()
+}
+
+// PromptWidth returns the screen width of the prompt, color escapes are
+// not counted.
+func (o *Operation) PromptWidth() int {
+	return o.buf.PromptLen()
+}
+
+// Undo reverts the last edit of the line as Ctrl+_ does, it returns false
+// if there is nothing to undo. The edits are forgotten once a new line is
+// read.
+func (o *Operation) Undo() bool {
+	return o.buf.Undo()
+}
+
+// Redo reapplies the edit reverted by Undo as Meta+_ does, it returns false
+// if there is nothing to redo.
+func (o *Operation) Redo() bool {
+	return o.buf.Redo()
 }
 
+// KillRing returns a copy of the texts which can be yanked by Ctrl+Y and
+// Meta+Y, the most recent one first.
+func (o *Operation) KillRing() [][]rune {
+	return o.buf.KillRing()
+}
+
+// SetKillRing replaces the texts which can be yanked by Ctrl+Y,
+// the runes are copied.
+func (o *Operation) SetKillRing(ring [][]rune) {
+	o.buf.SetKillRing(ring)
+}
+
+// SetMaskRune shows every rune of the input as r, i.e. for passwords, 0
+// turns the masking off. The masked lines are not added to the history.
 func (o *Operation) SetMaskRune(r rune) {
-	o.buf.SetMask(r)
+	// the Config is shared, GetConfig and the Terminal copy it under their
+	// own locks
+	o.m.Lock()
+	o.t.updateConfig(func() { o.buf.SetMask(r) })
+	o.m.Unlock()
+	o.Refresh()
 }
 
 func (o *Operation) GetConfig() *Config {
@@ -105,10 +254,36 @@ func (o *Operation) GetConfig() *Config {
 }
 
 func (o *Operation) ioloop() {
+	// the candidates will be listed if no key is pressed in
+	// Config.IncrementalCompletionDelay, see Config.IncrementalCompletion
+	pendingComplete := false
 	for {
 		keepInSearchMode := false
 		keepInCompleteMode := false
-		r := o.t.ReadRune()
+		o.runTasks()
+		var r rune
+		if o.unreadKey != 0 {
+			r, o.unreadKey = o.unreadKey, 0
+		} else if pendingComplete {
+			var ok bool
+			r, ok = o.readKey(o.GetConfig().IncrementalCompletionDelay)
+			if !ok {
+				pendingComplete = false
+				o.m.Lock()
+				if o.IsNormalMode() || o.IsInCompleteMode() && !o.IsInCompleteSelectMode() {
+					o.ShowCompletions()
+				}
+				o.m.Unlock()
+				continue
+			}
+		} else {
+			r, _ = o.readKey(0)
+		}
+		if o.keepAbortedKey(r) {
+			continue
+		}
+		pendingComplete = false
+		incremental := o.GetConfig().IncrementalCompletion
 
 		if o.GetConfig().FuncFilterInputRune != nil {
 			var process bool
@@ -120,11 +295,20 @@ func (o *Operation) ioloop() {
 			}
 		}
 
+		o.hideHint()
+		o.buf.newKey(r)
+
+		// the line is flushed at io.EOF, it can't be rejected
+		isEOF := false
 		if r == 0 { // io.EOF
+			if o.t.IsClosed() {
+				// the terminal will never send anything
+				return
+			}
 			if o.buf.Len() == 0 {
 				o.buf.Clean()
 				select {
-				case o.errchan <- io.EOF:
+				case o.errchan <- ErrEOF:
 				}
 				break
 			} else {
@@ -132,20 +316,36 @@ func (o *Operation) ioloop() {
 				// let's flush them by sending CharEnter.
 				// And we will got io.EOF int next loop.
 				r = CharEnter
+				isEOF = true
 			}
 		}
 		isUpdateHistory := true
+		// the line is submitted or aborted
+		lineDone := false
 
-		if o.IsInCompleteSelectMode() {
+		if (r == CharEnter || r == CharCtrlJ) && o.EnterSubmits() {
+			o.ExitCompleteMode(false)
+			o.buf.Refresh(nil)
+		}
+		if o.IsInCompleteSelectMode() && r != CharPasteStart && r != CharMouse {
+			line := o.buf.Runes()
 			keepInCompleteMode = o.HandleCompleteSelect(r)
 			if keepInCompleteMode {
-				continue
+				if runes.Equal(line, o.buf.Runes()) {
+					continue
+				}
+				// the candidates are filtered by the edited line, which
+				// is handled as the other edits
+				keepInCompleteMode = o.IsInCompleteMode()
+				goto bound
 			}
 
 			o.buf.Refresh(nil)
 			switch r {
 			case CharEnter, CharCtrlJ:
-				o.history.Update(o.buf.Runes(), false)
+				if !o.GetConfig().EnableMask {
+					o.history.Update(o.buf.Runes(), false)
+				}
 				fallthrough
 			case CharInterrupt:
 				o.t.KickRead()
@@ -155,13 +355,18 @@ func (o *Operation) ioloop() {
 			}
 		}
 
-		if o.IsEnableVimMode() {
+		if o.IsEnableVimMode() && r != CharPasteStart && r != CharMouse {
 			r = o.HandleVim(r, o.t.ReadRune)
 			if r == 0 {
 				continue
 			}
 		}
 
+		if r != CharPasteStart && r != CharMouse && o.handleKeyBinding(r) {
+			// the candidates listed by the binding, i.e. by TriggerComplete
+			keepInCompleteMode = o.IsInCompleteMode()
+			goto bound
+		}
 		switch r {
 		case CharBell:
 			if o.IsSearchMode() {
@@ -190,29 +395,24 @@ func (o *Operation) ioloop() {
 				break
 			}
 			keepInSearchMode = true
-		case CharCtrlU:
-			o.buf.KillFront()
 		case CharFwdSearch:
 			if !o.SearchMode(S_DIR_FWD) {
 				o.t.Bell()
 				break
 			}
 			keepInSearchMode = true
-		case CharKill:
-			o.buf.Kill()
-			keepInCompleteMode = true
-		case MetaForward:
-			o.buf.MoveToNextWord()
-		case CharTranspose:
-			o.buf.Transpose()
-		case MetaBackward:
-			o.buf.MoveToPrevWord()
-		case MetaDelete:
-			o.buf.DeleteWord()
-		case CharLineStart:
-			o.buf.MoveToLineStart()
-		case CharLineEnd:
-			o.buf.MoveToLineEnd()
+		case MetaYank:
+			if !o.buf.YankPop() {
+				o.t.Bell()
+			}
+		case CharUndo:
+			if !o.buf.Undo() {
+				o.t.Bell()
+			}
+		case MetaRedo:
+			if !o.buf.Redo() {
+				o.t.Bell()
+			}
 		case CharBackspace, CharCtrlH:
 			if o.IsSearchMode() {
 				o.SearchBackspace()
@@ -225,46 +425,89 @@ func (o *Operation) ioloop() {
 				break
 			}
 			o.buf.Backspace()
-			if o.IsInCompleteMode() {
+			if incremental {
+				pendingComplete = true
+			} else if o.IsInCompleteMode() {
 				o.OnComplete()
 			}
+		case CharPasteStart:
+			pasted := o.readPaste()
+			if o.IsSearchMode() {
+				for _, p := range pasted {
+					if p != '\n' && p != '\t' {
+						o.SearchChar(p)
+					}
+				}
+				keepInSearchMode = true
+				break
+			}
+			o.buf.WriteRunes(pasted)
+		case CharCtrlX:
+			o.handleCtrlX(o.t.ReadRuneAndPause())
 		case CharCtrlZ:
 			o.buf.Clean()
 			o.t.SleepToResume()
 			o.Refresh()
 		case CharCtrlL:
-			ClearScreen(o.w)
-			o.Refresh()
-		case MetaBackspace, CharCtrlW:
-			o.buf.BackEscapeWord()
-		case CharCtrlY:
-			o.buf.Yank()
+			o.Clear()
 		case CharEnter, CharCtrlJ:
 			if o.IsSearchMode() {
 				o.ExitSearchMode(false)
 			}
-			o.buf.MoveToLineEnd()
+			if isComplete := o.GetConfig().IsComplete; isComplete != nil && !isEOF &&
+				!isComplete(o.buf.Runes()) {
+				o.buf.WriteRune('\n')
+				o.t.KickRead()
+				break
+			}
+			if accept := o.GetConfig().AcceptLine; accept != nil && !isEOF {
+				if ok, msg := accept(o.buf.Runes()); !ok {
+					if len(msg) > 0 {
+						o.showHint("\033[2m" + string(msg))
+					} else {
+						o.buf.Refresh(nil)
+						o.t.Bell()
+					}
+					o.t.KickRead()
+					break
+				}
+			}
+			// the line goes away from the menu above it
+			o.EraseMenu()
+			o.buf.ClearStatusLine()
 			var data []rune
 			if !o.GetConfig().UniqueEditLine {
-				o.buf.WriteRune('\n')
-				data = o.buf.Reset()
-				data = data[:len(data)-1] // trim \n
+				data = o.buf.Submit("")
 			} else {
+				o.buf.MoveToLineEnd()
 				o.buf.Clean()
 				data = o.buf.Reset()
 			}
 			o.outchan <- data
-			if !o.GetConfig().DisableAutoSaveHistory {
+			lineDone = true
+			if o.GetConfig().EnableMask {
+				// the masked line is never kept
+				isUpdateHistory = false
+				o.history.Revert()
+			} else if !o.GetConfig().DisableAutoSaveHistory {
 				// ignore IO error
 				_ = o.history.New(data)
 			} else {
 				isUpdateHistory = false
 			}
-		case CharBackward:
-			o.buf.MoveBackward()
-		case CharForward:
-			o.buf.MoveForward()
 		case CharPrev:
+			if incremental && o.IsInCompleteMode() {
+				o.EnterCompleteSelectMode()
+				o.SelectLastCandidate()
+				keepInCompleteMode = true
+				break
+			}
+			if o.buf.MoveLineUp() {
+				break
+			}
+			if o.searchHistoryPrefix(o.history.PrevWithPrefix) {
+				break
+			}
 			buf := o.history.Prev()
 			if buf != nil {
 				o.buf.Set(buf)
@@ -272,14 +515,54 @@ func (o *Operation) ioloop() {
 				o.t.Bell()
 			}
 		case CharNext:
+			if incremental && o.IsInCompleteMode() {
+				o.EnterCompleteSelectMode()
+				o.doSelect()
+				keepInCompleteMode = o.IsInCompleteMode()
+				break
+			}
+			if o.buf.MoveLineDown() {
+				break
+			}
+			if o.searchHistoryPrefix(o.history.NextWithPrefix) {
+				break
+			}
 			buf, ok := o.history.Next()
 			if ok {
 				o.buf.Set(buf)
 			} else {
 				o.t.Bell()
 			}
+		case CharMouse:
+			o.handleMouse(o.t.ReadRune(), o.t.ReadRune(), o.t.ReadRune())
+		case CharPageUp, CharPageDown:
+			recall := o.history.First
+			if r == CharPageDown {
+				recall = o.history.Last
+			}
+			if buf, ok := recall(); ok {
+				o.buf.Set(buf)
+			} else {
+				o.t.Bell()
+			}
 		case CharDelete:
-			if o.buf.Len() > 0 || !o.IsNormalMode() {
+			behavior := o.GetConfig().CtrlDBehavior
+			if o.buf.Len() > 0 && o.IsNormalMode() && behavior == ListCompletions {
+				o.t.KickRead()
+				// only listed, the line is left untouched
+				if _, ok := o.autoComplete().(*TabCompleter); !ok && o.autoComplete() != nil {
+					o.ShowCompletions()
+				}
+				if o.IsInCompleteMode() {
+					keepInCompleteMode = true
+				} else {
+					o.t.Bell()
+				}
+				break
+			}
+			if o.buf.Len() > 0 && o.IsNormalMode() && behavior == AlwaysEOF {
+				o.buf.MoveToLineEnd()
+			} else if o.buf.Len() > 0 || !o.IsNormalMode() {
 				o.t.KickRead()
 				if !o.buf.Delete() {
 					o.t.Bell()
@@ -288,13 +571,15 @@ func (o *Operation) ioloop() {
 			}
 
 			// treat as EOF
+			o.buf.ClearStatusLine()
 			if !o.GetConfig().UniqueEditLine {
-				o.buf.WriteString(o.GetConfig().EOFPrompt + "\n")
+				o.buf.Submit(o.GetConfig().EOFPrompt)
 			}
 			o.buf.Reset()
 			isUpdateHistory = false
 			o.history.Revert()
-			o.errchan <- io.EOF
+			o.errchan <- ErrEOF
+			lineDone = true
 			if o.GetConfig().UniqueEditLine {
 				o.buf.Clean()
 			}
@@ -310,41 +595,74 @@ func (o *Operation) ioloop() {
 				o.buf.Refresh(nil)
 				break
 			}
-			o.buf.MoveToLineEnd()
-			o.buf.Refresh(nil)
-			hint := o.GetConfig().InterruptPrompt + "\n"
+			o.buf.ClearStatusLine()
+			var remain []rune
 			if !o.GetConfig().UniqueEditLine {
-				o.buf.WriteString(hint)
-			}
-			remain := o.buf.Reset()
-			if !o.GetConfig().UniqueEditLine {
-				remain = remain[:len(remain)-len([]rune(hint))]
+				remain = o.buf.Submit(o.GetConfig().InterruptPrompt)
+			} else {
+				o.buf.MoveToLineEnd()
+				o.buf.Refresh(nil)
+				remain = o.buf.Reset()
 			}
 			isUpdateHistory = false
 			o.history.Revert()
 			o.errchan <- &InterruptError{remain}
+			lineDone = true
 		default:
+			if editKey(o.buf, r) {
+				if r == CharKill {
+					keepInCompleteMode = true
+				}
+				if r == CharInsert {
+					o.updateOverwriteCursor()
+				}
+				break
+			}
 			if o.IsSearchMode() {
 				o.SearchChar(r)
 				keepInSearchMode = true
 				break
 			}
 			o.buf.WriteRune(r)
-			if o.IsInCompleteMode() {
+			if incremental {
+				pendingComplete = true
+			} else if o.IsInCompleteMode() {
 				o.OnComplete()
 				keepInCompleteMode = true
 			}
 		}
 
+	bound:
 		listener := o.GetConfig().Listener
 		if listener != nil {
-			newLine, newPos, ok := listener.OnChange(o.buf.Runes(), o.buf.Pos(), r)
+			var (
+				newLine []rune
+				newPos  int
+				ok      bool
+			)
+			o.callOut(func() {
+				newLine, newPos, ok = listener.OnChange(o.buf.Runes(), o.buf.Pos(), r)
+			})
 			if ok {
 				o.buf.SetWithIdx(newPos, newLine)
 			}
 		}
 
 		o.m.Lock()
+		if lineDone {
+			// the same line may get other candidates next time
+			o.forgetCache()
+		}
+		if hint := o.cfg.Hint; hint != nil && !lineDone {
+			// no hint while the candidates or the search are shown
+			var h []rune
+			if !keepInSearchMode && !keepInCompleteMode {
+				h = hint(o.buf.Runes(), o.buf.Pos())
+			}
+			if o.buf.SetHint(h) && keepInSearchMode {
+				o.SearchRefresh(-1)
+			}
+		}
 		if !keepInSearchMode && o.IsSearchMode() {
 			o.ExitSearchMode(false)
 			o.buf.Refresh(nil)
@@ -357,14 +675,270 @@ func (o *Operation) ioloop() {
 				o.CompleteRefresh()
 			}
 		}
-		if isUpdateHistory && !o.IsSearchMode() {
+		if isUpdateHistory && !o.IsSearchMode() && !o.cfg.EnableMask {
 			// it will cause null history
 			o.history.Update(o.buf.Runes(), false)
 		}
+		o.forgetEditedQuery()
 		o.m.Unlock()
 	}
 }
 
+// updateOverwriteCursor reflects the overwrite mode in the cursor shape
+// if Config.OverwriteCursorShape is set.
+func (o *Operation) updateOverwriteCursor() {
+	shape := o.GetConfig().OverwriteCursorShape
+	if shape == CursorShapeDefault {
+		return
+	}
+	if o.buf.IsOverwrite() {
+		o.t.SetCursorShape(shape)
+	} else if o.IsEnableVimMode() && o.GetConfig().VimCursorShapes {
+		o.updateCursorShape()
+	} else {
+		o.t.SetCursorShape(CursorShapeDefault)
+	}
+}
+
+// readPaste reads the runes of a bracketed paste until CharPasteEnd.
+// They are data rather than keys, so the line breaks are kept as '\n'
+// instead of submitting the line, and the other control characters are
+// dropped, which protects from pasted text running commands.
+func (o *Operation) readPaste() []rune {
+	var pasted []rune
+	prev := rune(0)
+	for {
+		r := o.t.ReadRune()
+		if r == 0 || r == CharPasteEnd {
+			return pasted
+		}
+		switch {
+		case r == '\r':
+			pasted = append(pasted, '\n')
+		case r == '\n':
+			// \r\n is a single line break
+			if prev != '\r' {
+				pasted = append(pasted, '\n')
+			}
+		case r == '\t' || IsPrintable(r) && r != CharBackspace:
+			pasted = append(pasted, r)
+		}
+		prev = r
+	}
+}
+
+// searchHistoryPrefix recalls the item found by find with the text before
+// the cursor, see Config.HistorySearchPrefix. It returns false if the
+// prefix search isn't used and the plain history navigation applies.
+func (o *Operation) searchHistoryPrefix(find func([]rune) ([]rune, bool)) bool {
+	pos := o.buf.Pos()
+	if !o.GetConfig().HistorySearchPrefix || pos == 0 {
+		return false
+	}
+	prefix := o.buf.Runes()[:pos]
+	if buf, ok := find(prefix); ok {
+		o.buf.SetWithIdx(len(prefix), buf)
+	} else {
+		o.t.Bell()
+	}
+	return true
+}
+
+// handleMouse moves the cursor to where the input is clicked, and recalls
+// the history by the wheel, see Config.EnableMouse.
+func (o *Operation) handleMouse(button, x, y rune) {
+	if !o.IsNormalMode() {
+		return
+	}
+	switch button {
+	case 0:
+		// the left button, the click is placed relative to the cursor
+		o.t.GetOffset(func(offset string) {
+			var row, col int
+			if _, err := fmt.Sscanf(offset, "%d;%d", &row, &col); err != nil {
+				return
+			}
+			o.buf.MoveToScreenPos(int(y)-row, int(x)-1)
+		})
+	case 64:
+		if buf := o.history.Prev(); buf != nil {
+			o.buf.Set(buf)
+		}
+	case 65:
+		if buf, ok := o.history.Next(); ok {
+			o.buf.Set(buf)
+		}
+	}
+}
+
+// handleKeyBinding calls the function bound to r in Config.KeyBindings, or
+// to r and the next key in Config.KeySequenceBindings if r is a prefix of
+// them. It returns false if r should be handled by default.
+func (o *Operation) handleKeyBinding(r rune) bool {
+	cfg := o.GetConfig()
+	for seq := range cfg.KeySequenceBindings {
+		if seq[0] != r {
+			continue
+		}
+		var next rune
+		paused := false
+		if r == CharCtrlX {
+			// ^X^E runs an editor, see handleCtrlX
+			next, paused = o.t.ReadRuneAndPause()
+		} else {
+			next = o.t.ReadRune()
+		}
+		if f := cfg.KeySequenceBindings[[2]rune{r, next}]; f != nil && o.callBinding(f) {
+			if stopsReading(next) || paused {
+				o.t.KickRead()
+			}
+			return true
+		}
+		if r == CharCtrlX {
+			o.handleCtrlX(next, paused)
+			return true
+		}
+		o.unreadKey = next
+		break
+	}
+	if f := cfg.KeyBindings[r]; f != nil && o.callBinding(f) {
+		if stopsReading(r) {
+			o.t.KickRead()
+		}
+		return true
+	}
+	return false
+}
+
+// callBinding calls the key binding f by callOut, it returns what f returns.
+func (o *Operation) callBinding(f func(op *Operation) bool) (handled bool) {
+	o.callOut(func() { handled = f(o) })
+	return handled
+}
+
+// stopsReading reports whether the terminal stops reading after r until
+// it's kicked by KickRead.
+func stopsReading(r rune) bool {
+	switch r {
+	case CharInterrupt, CharEnter, CharCtrlJ, CharDelete:
+		return true
+	}
+	return false
+}
+
+// handleCtrlX dispatches the key typed after the ^X prefix, it's read by
+// ReadRuneAndPause so the editor run by ^X^E can read stdin. The reading
+// is resumed once the key is handled if paused is true.
+func (o *Operation) handleCtrlX(r rune, paused bool) {
+	if paused || stopsReading(r) {
+		defer o.t.KickRead()
+	}
+	switch r {
+	case CharBckSearch:
+		o.reloadConfig()
+	case CharLineEnd:
+		o.editInEditor()
+	case CharBell:
+		if !o.IsNormalMode() || !o.RevertCompletion() {
+			o.t.Bell()
+		}
+	default:
+		o.t.Bell()
+	}
+}
+
+// editInEditor opens the current line in $EDITOR, falling back to $VISUAL
+// and vi, and replaces the line with the edited one. The line is kept if
+// the editor exits with error.
+func (o *Operation) editInEditor() {
+	if !o.IsNormalMode() {
+		o.t.Bell()
+		return
+	}
+	f, err := ioutil.TempFile("", "readline-*.txt")
+	if err != nil {
+		o.t.Bell()
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(string(o.buf.Runes()))
+	f.Close()
+	if err != nil {
+		o.t.Bell()
+		return
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = os.Getenv("VISUAL")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// the editor may have arguments, e.g. "code -w"
+	args := append(strings.Fields(editor), f.Name())
+	cmd := exec.Command(args[0], args[1:]...)
+	cfg := o.GetConfig()
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = editorStdin(cfg.Stdin), cfg.Stdout, cfg.Stderr
+
+	o.buf.Clean()
+	o.t.ExitRawMode()
+	err = cmd.Run()
+	o.t.EnterRawMode()
+	if err != nil {
+		o.Refresh()
+		return
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		o.Refresh()
+		return
+	}
+	// most editors end the file with a newline
+	line := strings.TrimRight(string(data), "\r\n")
+	o.buf.Set([]rune(line))
+}
+
+// editorStdin returns the file under the Stdin wrapped by Config.Init, so
+// the editor reads the terminal directly. It's nil if there is no file, a
+// reader copying to the editor would race with the Terminal.
+func editorStdin(stdin io.Reader) io.Reader {
+	for {
+		switch s := stdin.(type) {
+		case *FillableStdin:
+			stdin = s.stdin
+		case *CancelableStdin:
+			stdin = s.r
+		case *os.File:
+			return s
+		default:
+			return nil
+		}
+	}
+}
+
+// reloadConfig applies the config returned by Config.OnReload and redraws
+// the prompt, the current line is kept.
+func (o *Operation) reloadConfig() {
+	onReload := o.GetConfig().OnReload
+	if onReload == nil || !o.IsNormalMode() {
+		o.t.Bell()
+		return
+	}
+	cfg := onReload()
+	if cfg == nil {
+		o.t.Bell()
+		return
+	}
+	o.buf.Clean()
+	if _, err := o.SetConfig(cfg); err != nil {
+		o.t.Bell()
+	} else {
+		o.t.SetConfig(cfg)
+	}
+	o.Refresh()
+}
+
 func (o *Operation) Stderr() io.Writer {
 	return &wrapWriter{target: o.GetConfig().Stderr, r: o, t: o.t}
 }
@@ -373,6 +947,17 @@ func (o *Operation) Stdout() io.Writer {
 	return &wrapWriter{target: o.GetConfig().Stdout, r: o, t: o.t}
 }
 
+// WriteAbove writes b above the line being read, which is redrawn below it
+// with the cursor kept, a newline is added if b doesn't end with it. It's
+// safe to call from another goroutine, b is written by the goroutine
+// handling the keys between them, see Stdout.
+func (o *Operation) WriteAbove(b []byte) {
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		b = append(b[:len(b):len(b)], '\n')
+	}
+	o.Stdout().Write(b)
+}
+
 func (o *Operation) String() (string, error) {
 	r, err := o.Runes()
 	return string(r), err
@@ -380,8 +965,45 @@ func (o *Operation) String() (string, error) {
 
 // Runes 从STDIN中读取一行字符串
 func (o *Operation) Runes() ([]rune, error) {
+	return o.runes(context.Background(), nil)
+}
+
+// ReadlineWithTimeout is String which gives up with ErrTimeout if no line
+// is submitted in d. The line is erased from the screen then, and the
+// input is kept for the next read.
+func (o *Operation) ReadlineWithTimeout(d time.Duration) (string, error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	r, err := o.runes(context.Background(), timer.C)
+	return string(r), err
+}
+
+// ReadlineWithContext is String which gives up with ctx.Err() once ctx is
+// done. As ReadlineWithTimeout, the line is erased from the screen and the
+// input is kept, the Terminal is not closed so the next read works.
+func (o *Operation) ReadlineWithContext(ctx context.Context) (string, error) {
+	r, err := o.runes(ctx, nil)
+	return string(r), err
+}
+
+// runes reads a line, it gives up once ctx is done or timeout fires.
+func (o *Operation) runes(ctx context.Context, timeout <-chan time.Time) ([]rune, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if o.t.IsClosed() {
+		return nil, ErrClosed
+	}
 	o.t.EnterRawMode()
 	defer o.t.ExitRawMode()
+	o.updateCursorShape()
+	if o.buf.IsOverwrite() {
+		o.updateOverwriteCursor()
+	}
+	o.m.Lock()
+	o.ForgetCompletionQuery()
+	o.m.Unlock()
+	o.buf.ResetUndo()
 
 	listener := o.GetConfig().Listener
 	if listener != nil {
@@ -389,6 +1011,7 @@ func (o *Operation) Runes() ([]rune, error) {
 	}
 
 	o.buf.Refresh(nil) // print prompt
+	o.t.UnreadRunes(o.resumeRead()...)
 	o.t.KickRead()
 	select {
 	case r := <-o.outchan:
@@ -398,7 +1021,53 @@ func (o *Operation) Runes() ([]rune, error) {
 			return e.Line, ErrInterrupt
 		}
 		return nil, err
+	case <-o.t.stopChan:
+		return nil, ErrClosed
+	case <-timeout:
+		o.abortRead()
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		o.abortRead()
+		return nil, ctx.Err()
+	}
+}
+
+// abortRead leaves the complete and the search mode, and erases the line
+// from the screen when runes gives up, the line is kept for the next read.
+func (o *Operation) abortRead() {
+	o.t.StopRead()
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.readAborted = true
+	if o.IsInCompleteMode() {
+		o.ExitCompleteMode(true)
 	}
+	if o.IsSearchMode() {
+		o.ExitSearchMode(false)
+	}
+	o.buf.Clean()
+}
+
+// keepAbortedKey keeps r for the next read if the read is given up, it
+// returns false if r should be handled.
+func (o *Operation) keepAbortedKey(r rune) bool {
+	o.m.Lock()
+	defer o.m.Unlock()
+	if !o.readAborted || r == 0 && o.t.IsClosed() {
+		return false
+	}
+	o.abortedKeys = append(o.abortedKeys, r)
+	return true
+}
+
+// resumeRead returns the keys typed after the read given up, they're
+// handled by the new read.
+func (o *Operation) resumeRead() []rune {
+	o.m.Lock()
+	defer o.m.Unlock()
+	keys := o.abortedKeys
+	o.readAborted, o.abortedKeys = false, nil
+	return keys
 }
 
 func (o *Operation) PasswordEx(prompt string, l Listener) ([]byte, error) {
@@ -420,6 +1089,36 @@ func (o *Operation) PasswordWithConfig(cfg *Config) ([]byte, error) {
 	return o.Slice()
 }
 
+// ReadPassword reads a line without echoing and recording it, like Password.
+// The runes of the line are zeroed once they're encoded to the returned
+// bytes, and nothing typed is returned on Ctrl+C.
+func (o *Operation) ReadPassword(prompt string) ([]byte, error) {
+	cfg := o.GenPasswordConfig()
+	cfg.Prompt = prompt
+	if err := o.opPassword.EnterPasswordMode(cfg); err != nil {
+		return nil, err
+	}
+	defer o.opPassword.ExitPasswordMode()
+	// the kill ring is restored after the one of the password is wiped
+	defer o.buf.swapKillRing(o.buf.swapKillRing(killRing{}))
+	r, err := o.Runes()
+	defer o.buf.wipe()
+	defer zeroRunes(r)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, c := range r {
+		n += utf8.RuneLen(c)
+	}
+	ret := make([]byte, n)
+	n = 0
+	for _, c := range r {
+		n += utf8.EncodeRune(ret[n:], c)
+	}
+	return ret, nil
+}
+
 func (o *Operation) Password(prompt string) ([]byte, error) {
 	return o.PasswordEx(prompt, nil)
 }
@@ -438,7 +1137,7 @@ func (o *Operation) Slice() ([]byte, error) {
 
 func (o *Operation) Close() {
 	select {
-	case o.errchan <- io.EOF:
+	case o.errchan <- ErrEOF:
 	default:
 	}
 	o.history.Close()
@@ -452,6 +1151,182 @@ func (o *Operation) SetHistoryPath(path string) {
 	o.history = newOpHistory(o.cfg)
 }
 
+// DismissCompletion exits the complete mode if it's active, and repairs
+// the display as if the user pressed Ctrl+G. It's safe to call from another
+// goroutine, the menu is closed by the goroutine handling the keys, so it
+// can't be called by the functions of Config except the key bindings and
+// the Listener.
+// It returns false if there is no completion to dismiss.
+func (o *Operation) DismissCompletion() bool {
+	dismissed := false
+	o.runInLoop(func() {
+		o.m.Lock()
+		defer o.m.Unlock()
+		if !o.IsInCompleteMode() {
+			return
+		}
+		o.ExitCompleteMode(true)
+		o.Refresh()
+		dismissed = true
+	})
+	return dismissed
+}
+
+// SetAutoComplete replaces Config.AutoComplete without copying the Config,
+// the line being edited is kept and the listed candidates are dismissed.
+// A nil ac disables the completion. It's safe to call while reading a line,
+// the completer is swapped in by the goroutine handling the keys, before
+// the next key.
+func (o *Operation) SetAutoComplete(ac AutoCompleter) {
+	o.runLater(func() { o.swapAutoComplete(ac) })
+}
+
+// swapAutoComplete swaps in the completer given by SetAutoComplete.
+func (o *Operation) swapAutoComplete(ac AutoCompleter) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.acM.Lock()
+	o.t.updateConfig(func() { o.cfg.AutoComplete = ac })
+	o.acM.Unlock()
+	o.forgetCache()
+	if o.IsInCompleteMode() {
+		o.ExitCompleteMode(true)
+		o.Refresh()
+	}
+}
+
+// readKey reads a key as Terminal.ReadRune does, ok is false if no key is
+// read in d, it waits forever if d is 0. The funcs given by runLater
+// meanwhile are run.
+func (o *Operation) readKey(d time.Duration) (r rune, ok bool) {
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case r = <-o.t.outchan:
+			// the funcs given before the key go first
+			o.runTasks()
+			return r, true
+		case <-o.taskChan:
+			o.runTasks()
+		case <-timeout:
+			return 0, false
+		}
+	}
+}
+
+// runLater hands f to ioloop, which runs it before the next key, or while
+// a key binding or the Listener is called, see callOut. The funcs are run
+// in order.
+func (o *Operation) runLater(f func()) {
+	o.m.Lock()
+	o.tasks = append(o.tasks, f)
+	o.m.Unlock()
+	select {
+	case o.taskChan <- struct{}{}:
+	default:
+	}
+}
+
+// runInLoop is runLater which waits for f, it returns false if the
+// Terminal is closed, f may not be run then.
+func (o *Operation) runInLoop(f func()) bool {
+	done := make(chan struct{})
+	o.runLater(func() {
+		defer close(done)
+		f()
+	})
+	select {
+	case <-done:
+		return true
+	case <-o.t.stopChan:
+		return false
+	}
+}
+
+// runTasks runs the funcs given by runLater.
+func (o *Operation) runTasks() {
+	for {
+		o.m.Lock()
+		tasks := o.tasks
+		o.tasks = nil
+		o.m.Unlock()
+		if len(tasks) == 0 {
+			return
+		}
+		for _, f := range tasks {
+			f()
+		}
+	}
+}
+
+// callOut calls f which runs the code of the user while handling a key,
+// i.e. a key binding. It may call the methods waiting for ioloop, so the
+// funcs given by runLater are run meanwhile.
+func (o *Operation) callOut(f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case <-o.taskChan:
+			o.runTasks()
+		}
+	}
+}
+
+// autoComplete returns Config.AutoComplete, see acM.
+func (o *Operation) autoComplete() AutoCompleter {
+	o.acM.RLock()
+	defer o.acM.RUnlock()
+	return o.cfg.AutoComplete
+}
+
+// TriggerComplete completes the word under the cursor as pressing Tab does,
+// it's useful to bind the completion to another key. It returns whether
+// the candidates are listed, which is false if there is no
+// Config.AutoComplete, or the only candidate is applied.
+// It's safe to call from another goroutine, the completion is run by the
+// goroutine handling the keys, so it can't be called by the functions of
+// Config except the key bindings and the Listener.
+func (o *Operation) TriggerComplete() bool {
+	listed := false
+	o.runInLoop(func() {
+		o.m.Lock()
+		defer o.m.Unlock()
+		listed = o.triggerComplete()
+	})
+	return listed
+}
+
+// triggerComplete is TriggerComplete run by ioloop.
+func (o *Operation) triggerComplete() bool {
+	// the TabCompleter is set by Config.Init if there is no completer
+	if _, ok := o.cfg.AutoComplete.(*TabCompleter); ok || o.cfg.AutoComplete == nil ||
+		!o.t.IsReading() || o.IsSearchMode() {
+		return false
+	}
+	if !o.OnComplete() {
+		o.t.Bell()
+		return false
+	}
+	if !o.IsInCompleteMode() {
+		o.Refresh()
+		return false
+	}
+	o.buf.Refresh(nil)
+	o.CompleteRefresh()
+	return true
+}
+
 func (o *Operation) IsNormalMode() bool {
 	return !o.IsInCompleteMode() && !o.IsSearchMode()
 }
@@ -466,11 +1341,12 @@ func (op *Operation) SetConfig(cfg *Config) (*Config, error) {
 		return op.cfg, err
 	}
 	old := op.cfg
+	op.acM.Lock()
 	op.cfg = cfg
-	op.SetPrompt(cfg.Prompt)
-	op.SetMaskRune(cfg.MaskRune)
+	op.acM.Unlock()
+	op.buf.SetPrompt(cfg.Prompt)
 	op.buf.SetConfig(cfg)
-	width := op.cfg.FuncGetWidth()
+	width := op.cfg.screenWidth()
 
 	if cfg.opHistory == nil {
 		op.SetHistoryPath(cfg.HistoryFile)
@@ -501,12 +1377,94 @@ func (o *Operation) SaveHistory(content string) error {
 	return o.history.New([]rune(content))
 }
 
+// SetStatusLine shows s on the line below the input, above the completion
+// menu if any. It's cleared by passing an empty s, and when the line is
+// submitted. It's safe to call from another goroutine, the status line is
+// drawn by the goroutine handling the keys, so it can't be called by the
+// functions of Config except the key bindings and the Listener.
+func (o *Operation) SetStatusLine(s string) {
+	o.runInLoop(func() {
+		o.m.Lock()
+		defer o.m.Unlock()
+		if !o.t.IsReading() {
+			o.buf.Lock()
+			o.buf.setStatusLine(s)
+			o.buf.Unlock()
+			return
+		}
+		o.buf.SetStatusLine(s)
+		if o.IsInCompleteMode() {
+			o.CompleteRefresh()
+		} else if o.IsSearchMode() {
+			o.SearchRefresh(-1)
+		}
+	})
+}
+
+// showHint shows s in the status line until the next key.
+func (o *Operation) showHint(s string) {
+	if !o.hinting {
+		o.hinting = true
+		o.hintBackup = o.buf.StatusLine()
+	}
+	o.buf.SetStatusLine(s)
+}
+
+// hideHint restores the status line replaced by showHint.
+func (o *Operation) hideHint() {
+	if o.hinting {
+		o.hinting = false
+		o.buf.SetStatusLine(o.hintBackup)
+	}
+}
+
+// SearchHistory returns the history items containing pattern, matched as
+// the incremental search (Ctrl+R) does without entering the search mode.
+// The most recent item comes first unless forward is true, and all of the
+// items are returned if pattern is empty.
+func (o *Operation) SearchHistory(pattern string, forward bool) ([]string, error) {
+	if o.t.IsClosed() {
+		return nil, ErrClosed
+	}
+	return o.history.Search([]rune(pattern), forward), nil
+}
+
+// AddHistory adds content to the history which can be recalled by Up/Down,
+// unlike SaveHistory it's not written to Config.HistoryFile.
+func (o *Operation) AddHistory(content string) {
+	o.history.Add([]rune(content))
+}
+
+// MoveWordForward moves the cursor to the start of the next word, which is
+// separated by Config.WordBreakFunc, or by spaces if bigWord is true.
+func (o *Operation) MoveWordForward(bigWord bool) {
+	o.buf.MoveWordForward(bigWord)
+}
+
+// MoveWordBackward moves the cursor to the start of the previous word, see
+// MoveWordForward.
+func (o *Operation) MoveWordBackward(bigWord bool) {
+	o.buf.MoveWordBackward(bigWord)
+}
+
 func (o *Operation) Refresh() {
 	if o.t.IsReading() {
 		o.buf.Refresh(nil)
 	}
 }
 
+// Clear clears the screen as Ctrl+L does, the line being read is redrawn
+// with the prompt at the top.
+func (o *Operation) Clear() {
+	ClearScreen(o.w)
+	if o.t.IsReading() {
+		// the cleaning before redrawing erases the screen
+		o.buf.Refresh(nil)
+	} else {
+		o.w.Write([]byte("\033[J"))
+	}
+}
+
 // Clean 清空prompt和其后的输入。
 func (o *Operation) Clean() {
 	o.buf.Clean()
@@ -536,12 +1494,27 @@ type Listener interface {
 	OnChange(line []rune, pos int, key rune) (newLine []rune, newPos int, ok bool)
 }
 
+// Painter decorates the line before it's written to the terminal, i.e.
+// highlights the syntax. The painted runes must show the same text as line
+// with only the ANSI escape sequences added, since the cursor is placed by
+// the width of line rather than the painted runes.
 type Painter interface {
 	// Paint line表示Operation.buf中的内容。
 	// pos 表示Operation.buf中光标的位置。
 	Paint(line []rune, pos int) []rune
 }
 
+// FuncPainter returns a Painter which paints the line by f.
+func FuncPainter(f func(line []rune, pos int) []rune) Painter {
+	return painterFunc(f)
+}
+
+type painterFunc func(line []rune, pos int) []rune
+
+func (f painterFunc) Paint(line []rune, pos int) []rune {
+	return f(line, pos)
+}
+
 type defaultPainter struct{}
 
 func (p *defaultPainter) Paint(line []rune, _ int) []rune {
@@ -17,6 +17,7 @@ const (
 	VK_UP       = 0x26
 	VK_RIGHT    = 0x27
 	VK_DOWN     = 0x28
+	VK_INSERT   = 0x2D
 	VK_DELETE   = 0x2E
 	VK_LSHIFT   = 0xA0
 	VK_RSHIFT   = 0xA1
@@ -81,6 +82,8 @@ next:
 			target = CharPrev
 		case VK_DOWN:
 			target = CharNext
+		case VK_INSERT:
+			return copy(buf, "\033[2~"), nil
 		}
 		if target != 0 {
 			return r.write(buf, target)
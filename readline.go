@@ -18,7 +18,11 @@
 package readline
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"regexp"
+	"time"
 )
 
 type Instance struct {
@@ -27,20 +31,164 @@ type Instance struct {
 	Operation *Operation
 }
 
+// CtrlDBehavior decides what Ctrl+D does, it's always io.EOF if the buffer is empty.
+type CtrlDBehavior int
+
+const (
+	// DeleteOrEOF deletes the character under the cursor
+	DeleteOrEOF CtrlDBehavior = iota
+	// AlwaysEOF returns io.EOF even if there is something in the buffer
+	AlwaysEOF
+	// ListCompletions lists the candidates as bash's possible-completions,
+	// unlike pressing Tab nothing is inserted to the line
+	ListCompletions
+)
+
+// BellStyle decides how Terminal.Bell rings, i.e. when the completion fails.
+type BellStyle int
+
+const (
+	// BellAudible writes "\a" to the terminal
+	BellAudible BellStyle = iota
+	// BellVisible flashes the screen by the reverse video
+	BellVisible
+	// BellNone keeps quiet
+	BellNone
+)
+
 type Config struct {
 	// prompt supports ANSI escape sequence, so we can color some characters even in windows
 	Prompt string
+	// RightPrompt returns the text drawn flush right on the first line of
+	// the input like RPROMPT of zsh, it's called on every redraw and hidden
+	// while the input reaches it.
+	RightPrompt func() []rune
+	// ContinuationPrompt is drawn before the lines after the first one of
+	// a multi-line input, see IsComplete.
+	ContinuationPrompt string
+	// IsComplete is called when Enter is pressed, a newline is inserted
+	// instead of submitting the line if it returns false, i.e. for an
+	// unclosed bracket. Up and Down move between the lines of the input
+	// then, and Home and End go to the start and the end of the line.
+	IsComplete func(line []rune) bool
 
 	// readline will persist historys to file where HistoryFile specified
 	HistoryFile string
-	// specify the max length of historys, it's 500 by default, set it to -1 to disable history
+	// specify the max length of historys, it's 500 by default, set it to -1 to disable history.
+	// The oldest items are dropped beyond it, and HistoryFile is trimmed too.
 	HistoryLimit           int
 	DisableAutoSaveHistory bool
+	// trim HistoryFile to the last HistoryLimit items once no item is added
+	// in HistoryAutoSaveInterval, rather than once it holds twice as many.
+	// Every item is written as soon as it's added either way, so nothing
+	// is lost by a crash.
+	HistoryAutoSave bool
+	// DefaultHistoryAutoSaveInterval by default
+	HistoryAutoSaveInterval time.Duration
+	// how the duplicated items are dropped, DedupConsecutive by default
+	HistoryDedup HistoryDedup
 	// enable case-insensitive history searching
 	HistorySearchFold bool
+	// Up and Down recall only the items starting with the text before the
+	// cursor if the line isn't empty, the cursor stays after that text.
+	HistorySearchPrefix bool
+	// SearchPromptFunc renders the status line of the incremental search,
+	// matchIndex is the position of the current match among the matchCount
+	// items containing query, counted from the most recent one and starting
+	// at 1, it's 0 if there is no match. The default one is the bash style
+	// "bck-i-search: query".
+	SearchPromptFunc func(query string, direction SearchDirection, matchIndex, matchCount int, failed bool) string
+
+	// Translator localizes the messages readline shows, key is one of the
+	// Msg* constants. The english message is used if it returns "".
+	Translator func(key string, args ...interface{}) string
 
 	// AutoCompleter will called once user press TAB
 	AutoComplete AutoCompleter
+	// AutoComplete is not called until the word before the cursor has
+	// CompleteMinChars runes, the words are separated as WordBreakFunc says.
+	// There is no candidate before then.
+	CompleteMinChars int
+	// pressing one of these runes in complete select mode accepts the selected
+	// candidate and then inserts the rune, i.e. '/' to descend into a directory.
+	// A trailing space or the rune itself at the end of the candidate is dropped.
+	CompletionAcceptChars []rune
+	// remember the typed line when a candidate is accepted, so that Ctrl+X
+	// Ctrl+G can restore it to refine the query. It's forgotten once the
+	// line is edited.
+	CompletionKeepQuery bool
+	// at most CompletionMaxCandidates candidates are listed, the rest is
+	// shown as "+N more". It's DefaultCompletionMaxCandidates by default,
+	// set it to -1 to list all of them.
+	CompletionMaxCandidates int
+	// MaxCompletionCandidates keeps the menu short, at most this many
+	// candidates are listed as CompletionMaxCandidates does. It's 0 by
+	// default, which leaves the limit to CompletionMaxCandidates.
+	MaxCompletionCandidates int
+	// CompletionWordRegex defines the words to be completed, i.e. `\w+` to
+	// complete "ve" in "std::ve". AutoComplete only receives the part of the
+	// match before the cursor, and an accepted candidate replaces the rest of
+	// it. AutoComplete receives the whole line if it's nil.
+	CompletionWordRegex *regexp.Regexp
+	// show "already complete" with the comment of the candidate below the
+	// input if the word is already a complete candidate, instead of ringing
+	// the bell.
+	CompleteExactMatchHint bool
+	// written before the selected candidate in the complete select mode,
+	// i.e. "> ", it's DefaultCompletionSelectMarker if NO_COLOR is set.
+	// The selected candidate is highlighted unless NO_COLOR is set.
+	CompletionSelectMarker string
+	// list the candidates column by column instead of row by row, so they
+	// are read from top to bottom.
+	CompletionColumnMajor bool
+	// at most CompletionMaxRows rows of candidates are shown if it's set,
+	// they scroll as the selection moves past the edge.
+	CompletionMaxRows int
+	// the colors of the completion menu, they are read on every redraw
+	CompletionStyle CompletionStyle
+	// CandidateWidthFunc returns the display width of a candidate and its
+	// comment, i.e. to skip the ANSI escape sequences in them. It's the
+	// width of the runes by default.
+	CandidateWidthFunc func(candidate, comment []rune) int
+	// line up the comments of the candidates in a column after the widest
+	// candidate, by default a comment follows its candidate.
+	CompletionAlignComments bool
+	// draw the completion menu above the prompt rather than below the
+	// input, so the prompt doesn't scroll on the last line of the screen.
+	// The lines above are overwritten, so the menu goes below unless
+	// FuncGetCursorPos tells there is room above.
+	CompletionMenuAbove bool
+	// OnCompleteSelected is called with the candidate accepted in the
+	// complete select mode and its index among the candidates, the
+	// candidate includes the typed part of it.
+	OnCompleteSelected func(candidate []rune, index int)
+	// accept the first candidate if Enter is pressed in the complete select
+	// mode before any candidate is selected, by default the line is submitted.
+	CompletionEnterAccepts bool
+	// list the candidates of the next word after a single candidate ending
+	// with a space is accepted, i.e. the subcommands after "git ". The menu
+	// is closed if there is none.
+	ChainCompletion bool
+	// list the candidates as the user types, without pressing Tab. They are
+	// listed once no key is pressed in IncrementalCompletionDelay, and Up
+	// or Down selects one of them.
+	IncrementalCompletion bool
+	// DefaultIncrementalCompletionDelay by default
+	IncrementalCompletionDelay time.Duration
+	// treat the shell-style quoted words, i.e. "my file", as a single word,
+	// AutoComplete receives the word unquoted. The accepted candidate is
+	// quoted if it contains spaces. It's ignored if CompletionWordRegex is
+	// set.
+	CompleteQuoteAware bool
+	// match the names of a PrefixCompleter case-insensitively, i.e. "GIT"
+	// completes "git", the typed word is replaced by the accepted name.
+	CompleteIgnoreCase bool
+	// match the candidates with the word before the cursor by FuzzyMatcher,
+	// i.e. "gp" matches "grep" and "git-prune". AutoComplete is asked with
+	// the word removed, and the accepted candidate replaces the word.
+	FuzzyComplete bool
+	// DefaultFuzzyMatcher by default, the candidates are sorted by score
+	FuzzyMatcher func(pattern, candidate string) (matched bool, score int)
 
 	// Any key press will pass to Listener
 	// NOTE: Listener will be triggered by (nil, 0, 0) immediately
@@ -52,22 +200,95 @@ type Config struct {
 
 	// 在EnableMask为false时，如何将Operation.buf中的缓存输出到终端。
 	// 默认的defaultPainter的行为时原样打印。
+	// Use FuncPainter to paint by a function, see Painter.
 	Painter Painter
 
 	// If VimMode is true, readline will in vim.insert mode by default
 	VimMode bool
+	// use a bar cursor in vim.insert mode and a block cursor in vim.normal mode
+	VimCursorShapes bool
+	// VimModeIndicator returns the text showing the vim mode, VIM_INSERT or
+	// VIM_NORMAL, it's drawn flush right on the first line before
+	// RightPrompt, see DefaultVimModeIndicator.
+	VimModeIndicator func(mode int) []rune
+	// the cursor shape used in the overwrite mode which is toggled by the
+	// Insert key, the cursor is left untouched if it's CursorShapeDefault.
+	OverwriteCursorShape CursorShape
 
 	InterruptPrompt string
 	EOFPrompt       string
 
+	// Hint returns the text drawn dimmed below the input as the user types,
+	// i.e. a preview of the command, nothing is drawn if it's empty. It's
+	// not called while the candidates or the search are shown, and the
+	// status line set by SetStatusLine takes its place.
+	Hint func(line []rune, pos int) []rune
+
+	// AcceptLine is called when Enter is pressed, the line is not submitted
+	// if it returns false, msg is shown dimmed below the input until the
+	// next key then, or the bell rings if it's empty. The line left at
+	// io.EOF is submitted anyway.
+	AcceptLine func(line []rune) (accept bool, msg []rune)
+
+	// what Ctrl+D does when the buffer is not empty, DeleteOrEOF by default
+	CtrlDBehavior CtrlDBehavior
+	// how the bell rings, BellAudible by default
+	BellStyle BellStyle
+
+	// how many killed texts are kept for Meta+Y after Ctrl+Y, the
+	// consecutive kills in the same direction are kept as one.
+	// DefaultKillRingSize by default.
+	KillRingSize int
+	// the literal tabs in the line are drawn as the spaces to the next
+	// multiple of TabWidth columns, DefaultTabWidth by default.
+	TabWidth int
+	// RuneWidthFunc returns the cells taken by a rune, it replaces the
+	// built-in widths which draw an emoji sequence in a single wide cell,
+	// i.e. for a terminal drawing the ambiguous runes wide. The tabs are
+	// expanded by TabWidth still.
+	RuneWidthFunc func(r rune) int
+
+	// WordBreakFunc reports whether r separates the words for the word
+	// movements and deletions such as Ctrl+W, IsWordBreak by default. Use
+	// FilePathWordBreak to treat a path as a single word.
+	WordBreakFunc func(r rune) bool
+
+	// ask the terminal to surround the pasted text by \033[200~ and
+	// \033[201~ while reading a line, so the newlines in it are inserted
+	// rather than submitting the line.
+	EnableBracketedPaste bool
+
+	// ask the terminal to report the mouse while reading a line, clicking
+	// the input moves the cursor there and the wheel recalls the history.
+	// The text can't be selected by the mouse then in most terminals.
+	EnableMouse bool
+
 	FuncGetWidth func() int
+	// FuncGetCursorPos returns the 1-based cursor position, it's used instead
+	// of asking the terminal by \033[6n if set, i.e. in tests or for the
+	// terminals which don't answer. The terminal is asked if it fails.
+	FuncGetCursorPos func() (row, col int, err error)
 
 	Stdin       io.ReadCloser
 	StdinWriter io.Writer
-	Stdout      io.Writer
-	Stderr      io.Writer
+	// OnEOF is called when Stdin is drained, the returned reader takes its
+	// place if ok is true, i.e. to read from the terminal after a script.
+	// Otherwise the line left in the buffer is submitted and io.EOF is
+	// returned then. StdinWriter doesn't prefill the returned reader, and
+	// it's closed on Close if it's an io.Closer.
+	OnEOF  func() (stdin io.Reader, ok bool)
+	Stdout io.Writer
+	Stderr io.Writer
+	// drop the escape sequences, i.e. the colors of the prompt and the
+	// candidates, written to Stdout if it's not a terminal.
+	StripANSIWhenNotTTY bool
+	// the read runes, the decoded keys and the escape sequences are logged
+	// to Logger if it's set, to find out why a key doesn't work. The runes
+	// typed while EnableMask is set are not logged.
+	Logger io.Writer
 
 	// 在将Operation.buf中的内容输出到终端时，用MaskRune替换其中的每个rune。
+	// the masked lines are not added to the history, see Instance.SetMaskRune
 	EnableMask bool
 	// 替换字符，password 读取时用到了这个值并且没有设置值。
 	// 所以默认readPassword的行为时输入字符不会移动光标也不会显示。
@@ -86,6 +307,22 @@ type Config struct {
 	// 第一个返回值。
 	FuncFilterInputRune func(rune) (rune, bool)
 
+	// KeyBindings binds the functions to the keys, they take precedence over
+	// the default bindings, which are used if the function returns false.
+	// The function can change the buffer by op, i.e. op.SetBufferWithPos.
+	KeyBindings map[rune]func(op *Operation) bool
+	// KeySequenceBindings is KeyBindings for the two-key sequences like
+	// Ctrl+X Ctrl+E, it takes precedence over KeyBindings. The keys are
+	// handled one by one if the function returns false, except the ones
+	// after Ctrl+X which are always a sequence.
+	KeySequenceBindings map[[2]rune]func(op *Operation) bool
+
+	// called when user press Ctrl+X Ctrl+R, the returned config replaces the
+	// current one as SetConfig does, it should be a new Config rather than
+	// the modified current one. Returning nil keeps the current config.
+	// Note that Instance.Config still refers to the previous config.
+	OnReload func() *Config
+
 	// force use interactive even stdout is not a tty
 	FuncIsTerminal      func() bool
 	FuncMakeRaw         func() error
@@ -106,6 +343,12 @@ func (c *Config) useInteractive() bool {
 	return c.FuncIsTerminal()
 }
 
+// screenWidth returns the width reported by FuncGetWidth, but never
+// a width the layout can't work with.
+func (c *Config) screenWidth() int {
+	return sanitizeWidth(c.FuncGetWidth())
+}
+
 func (c *Config) Init() error {
 	if c.inited {
 		return nil
@@ -120,20 +363,44 @@ func (c *Config) Init() error {
 	if c.Stdout == nil {
 		c.Stdout = Stdout
 	}
+	if _, ok := c.Stdout.(*stripANSIWriter); c.StripANSIWhenNotTTY && !ok && !isTerminalWriter(c.Stdout) {
+		c.Stdout = &stripANSIWriter{w: c.Stdout}
+	}
 	if c.Stderr == nil {
 		c.Stderr = Stderr
 	}
+	if c.KillRingSize <= 0 {
+		c.KillRingSize = DefaultKillRingSize
+	}
+	if c.TabWidth <= 0 {
+		c.TabWidth = DefaultTabWidth
+	}
+	if c.Painter == nil {
+		c.Painter = &defaultPainter{}
+	}
+	if c.WordBreakFunc == nil {
+		c.WordBreakFunc = IsWordBreak
+	}
 	if c.HistoryLimit == 0 {
 		c.HistoryLimit = 500
 	}
+	if c.HistoryAutoSaveInterval <= 0 {
+		c.HistoryAutoSaveInterval = DefaultHistoryAutoSaveInterval
+	}
+	if c.IncrementalCompletionDelay <= 0 {
+		c.IncrementalCompletionDelay = DefaultIncrementalCompletionDelay
+	}
+	if c.CompletionMaxCandidates == 0 {
+		c.CompletionMaxCandidates = DefaultCompletionMaxCandidates
+	}
 
 	if c.InterruptPrompt == "" {
-		c.InterruptPrompt = "^C"
+		c.InterruptPrompt = c.translate(MsgInterrupt)
 	} else if c.InterruptPrompt == "\n" {
 		c.InterruptPrompt = ""
 	}
 	if c.EOFPrompt == "" {
-		c.EOFPrompt = "^D"
+		c.EOFPrompt = c.translate(MsgEOF)
 	} else if c.EOFPrompt == "\n" {
 		c.EOFPrompt = ""
 	}
@@ -161,6 +428,14 @@ func (c *Config) Init() error {
 	return nil
 }
 
+// logf writes a line to w, i.e. Config.Logger, if it's set.
+func logf(w io.Writer, format string, a ...interface{}) {
+	if w == nil {
+		return
+	}
+	fmt.Fprintf(w, format+"\n", a...)
+}
+
 func (c Config) Clone() *Config {
 	c.opHistory = nil
 	c.opSearch = nil
@@ -175,15 +450,17 @@ func (c *Config) SetPainter(p Painter) {
 	c.Painter = p
 }
 
+// SetPainterFunc paints the line by f, see FuncPainter.
+func (c *Config) SetPainterFunc(f func(line []rune, pos int) []rune) {
+	c.Painter = FuncPainter(f)
+}
+
 func NewEx(cfg *Config) (*Instance, error) {
 	t, err := NewTerminal(cfg)
 	if err != nil {
 		return nil, err
 	}
 	rl := t.Readline()
-	if cfg.Painter == nil {
-		cfg.Painter = &defaultPainter{}
-	}
 	return &Instance{
 		Config:    cfg,
 		Terminal:  t,
@@ -203,6 +480,22 @@ func (i *Instance) SetPrompt(s string) {
 	i.Operation.SetPrompt(s)
 }
 
+func (i *Instance) Prompt() string {
+	return i.Operation.Prompt()
+}
+
+func (i *Instance) PromptWidth() int {
+	return i.Operation.PromptWidth()
+}
+
+func (i *Instance) KillRing() [][]rune {
+	return i.Operation.KillRing()
+}
+
+func (i *Instance) SetKillRing(ring [][]rune) {
+	i.Operation.SetKillRing(ring)
+}
+
 func (i *Instance) SetMaskRune(r rune) {
 	i.Operation.SetMaskRune(r)
 }
@@ -244,8 +537,9 @@ func (i *Instance) ReadPasswordEx(prompt string, l Listener) ([]byte, error) {
 	return i.Operation.PasswordEx(prompt, l)
 }
 
+// ReadPassword reads a line without echoing it, see Operation.ReadPassword
 func (i *Instance) ReadPassword(prompt string) ([]byte, error) {
-	return i.Operation.Password(prompt)
+	return i.Operation.ReadPassword(prompt)
 }
 
 type Result struct {
@@ -266,11 +560,24 @@ func (i *Instance) Line() *Result {
 	return &Result{ret, err}
 }
 
-// Readline err is one of (nil, io.EOF, readline.ErrInterrupt)
+// Readline err is one of (nil, ErrEOF, ErrInterrupt), ErrEOF is io.EOF.
+// It's ErrClosed if the Instance is closed.
 func (i *Instance) Readline() (string, error) {
 	return i.Operation.String()
 }
 
+// ReadlineWithTimeout is Readline which returns ErrTimeout if no line is
+// submitted in d, see Operation.ReadlineWithTimeout
+func (i *Instance) ReadlineWithTimeout(d time.Duration) (string, error) {
+	return i.Operation.ReadlineWithTimeout(d)
+}
+
+// ReadlineWithContext is Readline which returns ctx.Err() once ctx is
+// done, see Operation.ReadlineWithContext
+func (i *Instance) ReadlineWithContext(ctx context.Context) (string, error) {
+	return i.Operation.ReadlineWithContext(ctx)
+}
+
 func (i *Instance) ReadlineWithDefault(what string) (string, error) {
 	i.Operation.SetBuffer(what)
 	return i.Operation.String()
@@ -280,6 +587,16 @@ func (i *Instance) SaveHistory(content string) error {
 	return i.Operation.SaveHistory(content)
 }
 
+// SetStatusLine shows s below the input, see Operation.SetStatusLine
+func (i *Instance) SetStatusLine(s string) {
+	i.Operation.SetStatusLine(s)
+}
+
+// AddHistory adds content to the history without persisting it
+func (i *Instance) AddHistory(content string) {
+	i.Operation.AddHistory(content)
+}
+
 // same as readline
 func (i *Instance) ReadSlice() ([]byte, error) {
 	return i.Operation.Slice()
@@ -339,6 +656,58 @@ func (i *Instance) SetConfig(cfg *Config) *Config {
 	return old
 }
 
+// WriteAbove writes b above the line being read, see Operation.WriteAbove
+func (i *Instance) WriteAbove(b []byte) {
+	i.Operation.WriteAbove(b)
+}
+
+// Clear clears the screen, see Operation.Clear
+func (i *Instance) Clear() {
+	i.Operation.Clear()
+}
+
+// SetAutoComplete replaces the completer, see Operation.SetAutoComplete
+func (i *Instance) SetAutoComplete(ac AutoCompleter) {
+	i.Operation.SetAutoComplete(ac)
+}
+
+// DismissCompletion closes the completion menu, see Operation.DismissCompletion
+func (i *Instance) DismissCompletion() bool {
+	return i.Operation.DismissCompletion()
+}
+
+// SearchHistory returns the matched history items, see Operation.SearchHistory
+func (i *Instance) SearchHistory(pattern string, forward bool) ([]string, error) {
+	return i.Operation.SearchHistory(pattern, forward)
+}
+
+// BufferSnapshot returns a copy of the line being edited and the cursor
+// position, see Operation.BufferSnapshot
+func (i *Instance) BufferSnapshot() (rs []rune, pos int) {
+	return i.Operation.BufferSnapshot()
+}
+
+// SetBufferWithPos replaces the line being edited, see Operation.SetBufferWithPos
+func (i *Instance) SetBufferWithPos(rs []rune, pos int) {
+	i.Operation.SetBufferWithPos(rs, pos)
+}
+
+// MoveWordForward moves the cursor by a word, see Operation.MoveWordForward
+func (i *Instance) MoveWordForward(bigWord bool) {
+	i.Operation.MoveWordForward(bigWord)
+}
+
+// MoveWordBackward moves the cursor by a word, see Operation.MoveWordBackward
+func (i *Instance) MoveWordBackward(bigWord bool) {
+	i.Operation.MoveWordBackward(bigWord)
+}
+
+// TriggerComplete lists the candidates as pressing Tab does, see
+// Operation.TriggerComplete
+func (i *Instance) TriggerComplete() bool {
+	return i.Operation.TriggerComplete()
+}
+
 func (i *Instance) Refresh() {
 	i.Operation.Refresh()
 }
@@ -1,7 +1,20 @@
 package readline
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -25,3 +38,2005 @@ func TestRace(t *testing.T) {
 
 	rl.Readline()
 }
+
+func TestPromptWidth(t *testing.T) {
+	rl, err := NewEx(&Config{Prompt: "\033[31m»\033[0m "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if w := rl.PromptWidth(); w != 2 {
+		t.Fatalf("want width 2, got %v", w)
+	}
+	rl.SetPrompt("你好> ")
+	if p := rl.Prompt(); p != "你好> " {
+		t.Fatalf("unexpected prompt %q", p)
+	}
+	if w := rl.PromptWidth(); w != 6 {
+		t.Fatalf("want width 6, got %v", w)
+	}
+}
+
+func TestSetPromptWhileReading(t *testing.T) {
+	r, w := io.Pipe()
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Prompt:           "> ",
+		Stdin:            r,
+		Stdout:           out,
+		FuncIsTerminal:   func() bool { return true },
+		FuncMakeRaw:      func() error { return nil },
+		FuncExitRaw:      func() error { return nil },
+		FuncGetWidth:     func() int { return 80 },
+		FuncGetCursorPos: func() (int, int, error) { return 1, 1, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	ret := make(chan string, 1)
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	w.Write([]byte("xy"))
+	for rl.Operation.buf.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	rl.SetPrompt("[main]\n$ ")
+	if width := rl.PromptWidth(); width != 2 {
+		t.Fatalf("want width 2, got %v", width)
+	}
+	w.Write([]byte("\r"))
+	if line := <-ret; line != "xy" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if !strings.Contains(out.String(), "\033[J\033[2K\r[main]\n$ xy") {
+		t.Fatalf("prompt not redrawn: %q", out.String())
+	}
+}
+
+func TestHint(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Stdin:            ioutil.NopCloser(strings.NewReader("ab\r")),
+		Stdout:           out,
+		FuncIsTerminal:   func() bool { return true },
+		FuncMakeRaw:      func() error { return nil },
+		FuncExitRaw:      func() error { return nil },
+		FuncGetWidth:     func() int { return 80 },
+		FuncGetCursorPos: func() (int, int, error) { return 1, 1, nil },
+		Hint: func(line []rune, pos int) []rune {
+			return []rune("runs " + string(line))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "ab" {
+		t.Fatal("result not expect", line, err)
+	}
+	if !strings.Contains(out.String(), "\r\n\033[2mruns ab\033[0m\033[A\r") {
+		t.Fatalf("hint not drawn: %q", out.String())
+	}
+}
+
+func TestBracketedPasteIsData(t *testing.T) {
+	payload := "ls\033[200~rm -rf /\x03\x04\r\n\033[Aecho\tdone\r\033[201~\r"
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader(payload)),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	line, err := rl.Readline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "lsrm -rf /\n[Aecho\tdone\n" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestBracketedPasteSplitRead(t *testing.T) {
+	r, w := io.Pipe()
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Stdin:                r,
+		Stdout:               out,
+		FuncIsTerminal:       func() bool { return true },
+		FuncMakeRaw:          func() error { return nil },
+		FuncExitRaw:          func() error { return nil },
+		FuncGetWidth:         func() int { return 80 },
+		FuncGetCursorPos:     func() (int, int, error) { return 1, 1, nil },
+		EnableBracketedPaste: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	go func() {
+		w.Write([]byte("\033[200~a\rb\033[20"))
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("1~\r"))
+	}()
+	line, err := rl.Readline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "a\nb" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	rl.Close()
+	if !strings.Contains(out.String(), "\033[?2004h") || !strings.Contains(out.String(), "\033[?2004l") {
+		t.Fatalf("bracketed paste mode not toggled: %q", out.String())
+	}
+}
+
+func TestGetOffsetWithFuncGetCursorPos(t *testing.T) {
+	term, err := NewTerminal(&Config{
+		Stdin:            ioutil.NopCloser(strings.NewReader("")),
+		Stdout:           ioutil.Discard,
+		FuncIsTerminal:   func() bool { return false },
+		FuncGetCursorPos: func() (int, int, error) { return 3, 7, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	ret := make(chan string, 1)
+	term.GetOffset(func(offset string) { ret <- offset })
+	select {
+	case offset := <-ret:
+		if offset != "3;7" {
+			t.Fatalf("unexpected offset %q", offset)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestReadlineAfterClose(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := rl.Readline(); err != ErrClosed {
+			t.Fatal("unexpected error", err)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	cfg := &Config{}
+	if msg := cfg.translate(MsgMoreCandidates, 3); msg != "+3 more" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+	cfg.Translator = func(key string, args ...interface{}) string {
+		if key == MsgSearchBackward {
+			return "反向搜索: " + args[0].(string)
+		}
+		return ""
+	}
+	if msg := cfg.defaultSearchPrompt("ls", S_DIR_BCK, 0, 0, true); msg != "failing 反向搜索: ls" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestEditInEditor(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	dir, err := ioutil.TempDir("", "readline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "edit.sh")
+	err = ioutil.WriteFile(script, []byte(`printf 'echo bar\n' > "$1"
+echo editing; echo editing >&2`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("EDITOR", os.Getenv("EDITOR"))
+
+	for _, c := range []struct {
+		editor string
+		want   string
+	}{
+		{sh + " " + script, "echo bar"},
+		// the line is kept if the editor fails
+		{"false", "echo foo"},
+	} {
+		os.Setenv("EDITOR", c.editor)
+		stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		rl, err := NewEx(&Config{
+			Stdin:          ioutil.NopCloser(strings.NewReader("echo foo\x18\x05\r")),
+			Stdout:         stdout,
+			Stderr:         stderr,
+			FuncIsTerminal: func() bool { return false },
+			FuncMakeRaw:    func() error { return nil },
+			FuncExitRaw:    func() error { return nil },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := rl.Readline()
+		rl.Close()
+		if err != nil || line != c.want {
+			t.Fatalf("%v: result not expect %q %v", c.editor, line, err)
+		}
+		// the editor writes to the configured streams
+		edited := c.want == "echo bar"
+		if strings.Contains(stdout.String(), "editing") != edited || strings.Contains(stderr.String(), "editing") != edited {
+			t.Fatalf("%v: output not expect %q %q", c.editor, stdout, stderr)
+		}
+	}
+}
+
+func TestCtrlXConsumed(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		input string
+		cfg   Config
+	}{
+		// ^X is the target of f, ^E is a command of the normal mode
+		{"vim", "ab\033f\x18\x05\r", Config{VimMode: true}},
+		{"binding", "ab\x18\x05\r", Config{KeyBindings: map[rune]func(op *Operation) bool{
+			CharCtrlX: func(op *Operation) bool { return true },
+		}}},
+	} {
+		cfg := c.cfg
+		cfg.Stdin = ioutil.NopCloser(strings.NewReader(c.input))
+		cfg.Stdout = ioutil.Discard
+		cfg.FuncIsTerminal = func() bool { return false }
+		rl, err := NewEx(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the reading goes on as no editor is run
+		line, err := rl.ReadlineWithTimeout(time.Second)
+		rl.Close()
+		if err != nil || line != "ab" {
+			t.Fatalf("%v: result not expect %q %v", c.name, line, err)
+		}
+	}
+}
+
+func TestCtrlDBehavior(t *testing.T) {
+	for _, c := range []struct {
+		behavior CtrlDBehavior
+		input    string
+		want     string
+		err      error
+		output   string
+	}{
+		{DeleteOrEOF, "abc\x01\x04\r", "bc", nil, ""},
+		{DeleteOrEOF, "\x04", "", io.EOF, ""},
+		{AlwaysEOF, "abc\x01\x04", "", io.EOF, ""},
+		{AlwaysEOF, "\x04", "", io.EOF, ""},
+		// listed without inserting the common prefix
+		{ListCompletions, "he\x04\r", "he", nil, "hello"},
+		{ListCompletions, "x\x04\r", "x", nil, "\a"},
+	} {
+		var m sync.Mutex
+		out := bytes.NewBuffer(nil)
+		rl, err := NewEx(&Config{
+			Stdin: ioutil.NopCloser(strings.NewReader(c.input)),
+			Stdout: writerFunc(func(b []byte) (int, error) {
+				m.Lock()
+				defer m.Unlock()
+				return out.Write(b)
+			}),
+			FuncIsTerminal: func() bool { return false },
+			FuncGetWidth:   func() int { return 80 },
+			CtrlDBehavior:  c.behavior,
+			AutoComplete:   NewPrefixCompleter(PcItem("hello", ""), PcItem("help", "")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := rl.Readline()
+		rl.Close()
+		if line != c.want || err != c.err {
+			t.Fatalf("%v %q: result not expect %q %v", c.behavior, c.input, line, err)
+		}
+		m.Lock()
+		if !strings.Contains(out.String(), c.output) {
+			t.Fatalf("%v %q: output not expect %q", c.behavior, c.input, out.String())
+		}
+		m.Unlock()
+	}
+}
+
+func TestMoveWord(t *testing.T) {
+	cfg := &Config{
+		Painter:        &defaultPainter{},
+		FuncIsTerminal: func() bool { return false },
+	}
+	buf := NewRuneBuffer(ioutil.Discard, "", cfg, 80)
+	line := "cd /usr/local-bin x"
+
+	for _, c := range []struct {
+		bigWord bool
+		want    []int
+	}{
+		{false, []int{4, 8, 14, 18, 19}},
+		{true, []int{3, 18, 19}},
+	} {
+		buf.SetWithIdx(0, []rune(line))
+		var got []int
+		for buf.Pos() < len(line) {
+			buf.MoveWordForward(c.bigWord)
+			got = append(got, buf.Pos())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Fatalf("forward %v: result not expect %v", c.bigWord, got)
+		}
+		for i := len(c.want) - 2; i >= 0; i-- {
+			buf.MoveWordBackward(c.bigWord)
+			if buf.Pos() != c.want[i] {
+				t.Fatalf("backward %v: result not expect %v", c.bigWord, buf.Pos())
+			}
+		}
+	}
+
+	// Ctrl+W uses the same word break
+	cfg.WordBreakFunc = func(r rune) bool { return r == ' ' || r == '/' }
+	buf.Set([]rune(line))
+	buf.BackEscapeWord()
+	buf.BackEscapeWord()
+	if got := string(buf.Runes()); got != "cd /usr/" {
+		t.Fatal("result not expect", got)
+	}
+}
+
+func TestCtrlWordBreak(t *testing.T) {
+	for _, c := range []struct {
+		input     string
+		wordBreak func(rune) bool
+		want      string
+	}{
+		{"vim /usr/local/bin\x17\x19\x19\r", nil, "vim /usr/local/binbin"},
+		{"vim /usr/local/bin\x17\x19\x19\r", FilePathWordBreak, "vim /usr/local/bin/usr/local/bin"},
+		// Meta+Backspace does the same
+		{"vim /usr/local/bin\033\x7f\r", FilePathWordBreak, "vim "},
+		// the text after the cursor is kept, and yanked back exactly
+		{"abc def\x01\033f\x17\x05\x19\r", nil, "defabc "},
+	} {
+		rl, err := NewEx(&Config{
+			Stdin:          ioutil.NopCloser(strings.NewReader(c.input)),
+			Stdout:         ioutil.Discard,
+			FuncIsTerminal: func() bool { return false },
+			FuncMakeRaw:    func() error { return nil },
+			FuncExitRaw:    func() error { return nil },
+			WordBreakFunc:  c.wordBreak,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := rl.Readline()
+		rl.Close()
+		if err != nil || line != c.want {
+			t.Fatalf("%q: result not expect %q %v", c.input, line, err)
+		}
+	}
+}
+
+func TestKillRing(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("one two three\x17\x17\x01\x0b\x19\033y\033y\r")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		KillRingSize:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// Meta+Y rotates back to the first one
+	if line, err := rl.Readline(); err != nil || line != "one " {
+		t.Fatal("result not expect", line, err)
+	}
+	ringString := func() string {
+		var ret []string
+		for _, item := range rl.KillRing() {
+			ret = append(ret, string(item))
+		}
+		return fmt.Sprintf("%q", ret)
+	}
+	if ring := ringString(); ring != `["one " "two three"]` {
+		t.Fatal("result not expect", ring)
+	}
+
+	rl.SetKillRing([][]rune{[]rune("a"), []rune("b"), []rune("c")})
+	if ring := ringString(); ring != `["a" "b"]` {
+		t.Fatal("result not expect", ring)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin: ioutil.NopCloser(strings.NewReader(
+			"hello world\x15\x1f\x1f\033_\r" + "ab\033b\x0b\x1fc\x1f\x1f\x1f\r")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// Ctrl+U is undone, then the typed runes, then redone
+	if line, err := rl.Readline(); err != nil || line != "hello world" {
+		t.Fatal("result not expect", line, err)
+	}
+	// the edits of the previous line are forgotten
+	if line, err := rl.Readline(); err != nil || line != "" {
+		t.Fatal("result not expect", line, err)
+	}
+}
+
+func TestOverwriteMode(t *testing.T) {
+	var (
+		m   sync.Mutex
+		out bytes.Buffer
+	)
+	input := "abcd\x01\033[2~xy\r" +
+		// the runes are appended at the end of the line
+		"ab\x02xyz\r" +
+		// the overwritten runes are undone at once
+		"abc\x01xy\x1f\r" +
+		// back to the insert mode
+		"\033[2~ab\x01x\r"
+	rl, err := NewEx(&Config{
+		Stdin: ioutil.NopCloser(strings.NewReader(input)),
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			m.Lock()
+			defer m.Unlock()
+			return out.Write(b)
+		}),
+		OverwriteCursorShape: CursorShapeBar,
+		FuncIsTerminal:       func() bool { return false },
+		FuncMakeRaw:          func() error { return nil },
+		FuncExitRaw:          func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	for _, want := range []string{"xycd", "axyz", "abc", "xab"} {
+		if line, err := rl.Readline(); err != nil || line != want {
+			t.Fatalf("result not expect %q %v", line, err)
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	// the bar is shown in the overwrite mode, and the default one after
+	bar := strings.Index(out.String(), "\033[6 q")
+	if bar < 0 || strings.LastIndex(out.String(), "\033[0 q") < bar {
+		t.Fatalf("cursor shape not expect %q", out.String())
+	}
+}
+
+func TestBufferSnapshot(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	line := []rune("echo hello")
+	rl.SetBufferWithPos(line, 4)
+	line[0] = 'E'
+	rs, pos := rl.BufferSnapshot()
+	if string(rs) != "echo hello" || pos != 4 {
+		t.Fatal("result not expect", string(rs), pos)
+	}
+	rs[0] = 'E'
+	if rs, _ = rl.BufferSnapshot(); string(rs) != "echo hello" {
+		t.Fatal("buffer is changed by the caller", string(rs))
+	}
+
+	rl.SetBufferWithPos([]rune("ls"), 10)
+	if rs, pos = rl.BufferSnapshot(); string(rs) != "ls" || pos != 2 {
+		t.Fatal("result not expect", string(rs), pos)
+	}
+}
+
+func TestFuncPainter(t *testing.T) {
+	read := func(painter Painter) string {
+		out := bytes.NewBuffer(nil)
+		rl, err := NewEx(&Config{
+			Prompt:           "> ",
+			Stdin:            ioutil.NopCloser(strings.NewReader("select 1\x02\x02\r")),
+			Stdout:           out,
+			FuncIsTerminal:   func() bool { return true },
+			FuncMakeRaw:      func() error { return nil },
+			FuncExitRaw:      func() error { return nil },
+			FuncGetWidth:     func() int { return 80 },
+			FuncGetCursorPos: func() (int, int, error) { return 1, 1, nil },
+			Painter:          painter,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rl.Close()
+		if line, err := rl.Readline(); err != nil || line != "select 1" {
+			t.Fatal("result not expect", line, err)
+		}
+		return out.String()
+	}
+
+	painted := read(FuncPainter(func(line []rune, pos int) []rune {
+		return []rune(strings.Replace(string(line), "select", "\033[1mselect\033[0m", 1))
+	}))
+	if !strings.Contains(painted, "\033[1mselect\033[0m 1") {
+		t.Fatalf("line not painted: %q", painted)
+	}
+	// the cursor is placed as if the line is not painted
+	if plain := read(nil); strings.NewReplacer("\033[1m", "", "\033[0m", "").Replace(painted) != plain {
+		t.Fatalf("result not expect %q, want %q", painted, plain)
+	}
+}
+
+func TestReadlineWithTimeout(t *testing.T) {
+	r, w := io.Pipe()
+	var written int64
+	rl, err := NewEx(&Config{
+		Stdin: r,
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			atomic.AddInt64(&written, int64(len(b)))
+			return len(b), nil
+		}),
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go w.Write([]byte("ab"))
+	if line, err := rl.ReadlineWithTimeout(100 * time.Millisecond); err != ErrTimeout {
+		t.Fatal("result not expect", line, err)
+	}
+	// the key typed after the timeout is neither handled nor echoed
+	time.Sleep(10 * time.Millisecond)
+	before := atomic.LoadInt64(&written)
+	w.Write([]byte("c"))
+	time.Sleep(20 * time.Millisecond)
+	if after := atomic.LoadInt64(&written); after != before {
+		t.Fatalf("output after the timeout: %d bytes", after-before)
+	}
+	// the input and the key are kept
+	go w.Write([]byte("\r"))
+	if line, err := rl.ReadlineWithTimeout(time.Second); err != nil || line != "abc" {
+		t.Fatal("result not expect", line, err)
+	}
+
+	ret := make(chan error, 1)
+	go func() {
+		_, err := rl.ReadlineWithTimeout(time.Hour)
+		ret <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// Close unblocks the read as Readline
+	rl.Close()
+	if err := <-ret; err != io.EOF && err != ErrClosed {
+		t.Fatal("result not expect", err)
+	}
+}
+
+func TestReadlineWithContext(t *testing.T) {
+	r, w := io.Pipe()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		AutoComplete:   NewPrefixCompleter(PcItem("ab", ""), PcItem("ac", "")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		w.Write([]byte("a\t"))
+		for !inCompleteMode(rl) {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	if line, err := rl.ReadlineWithContext(ctx); err != context.Canceled {
+		t.Fatal("result not expect", line, err)
+	}
+	if inCompleteMode(rl) {
+		t.Fatal("complete mode is left active")
+	}
+
+	// the key typed after the cancel is kept for the next read
+	w.Write([]byte("b"))
+	time.Sleep(10 * time.Millisecond)
+	if inCompleteMode(rl) || string(rl.Operation.buf.Runes()) != "a" {
+		t.Fatal("key handled after the cancel")
+	}
+	go w.Write([]byte("\r"))
+	if line, err := rl.ReadlineWithContext(context.Background()); err != nil || line != "ab" {
+		t.Fatal("result not expect", line, err)
+	}
+}
+
+func inCompleteMode(rl *Instance) bool {
+	rl.Operation.m.Lock()
+	defer rl.Operation.m.Unlock()
+	return rl.Operation.IsInCompleteMode()
+}
+
+func TestReflowOnWidthChange(t *testing.T) {
+	var m sync.Mutex
+	out := bytes.NewBuffer(nil)
+	output := func() string {
+		m.Lock()
+		defer m.Unlock()
+		return out.String()
+	}
+	r, w := io.Pipe()
+	var width int32 = 20
+	onWidthChanged := make(chan func(), 1)
+	rl, err := NewEx(&Config{
+		Prompt: "> ",
+		Stdin:  r,
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			m.Lock()
+			defer m.Unlock()
+			return out.Write(b)
+		}),
+		FuncIsTerminal:     func() bool { return true },
+		FuncMakeRaw:        func() error { return nil },
+		FuncExitRaw:        func() error { return nil },
+		FuncGetWidth:       func() int { return int(atomic.LoadInt32(&width)) },
+		FuncGetCursorPos:   func() (int, int, error) { return 1, 1, nil },
+		FuncOnWidthChanged: func(f func()) { onWidthChanged <- f },
+		AutoComplete:       NewPrefixCompleter(PcItem("hello", ""), PcItem("help", "")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	reflow := <-onWidthChanged
+
+	ret := make(chan string, 1)
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	line := strings.Repeat("x", 30)
+	w.Write([]byte(line))
+	for rl.Operation.buf.Len() < len(line) {
+		time.Sleep(time.Millisecond)
+	}
+	m.Lock()
+	out.Reset()
+	m.Unlock()
+	atomic.StoreInt32(&width, 40)
+	reflow()
+	// the line fits in one line now, it's redrawn by ioloop
+	want := "\033[J\033[2K\r> " + line
+	for output() != want {
+		if !strings.HasPrefix(want, output()) {
+			t.Fatalf("result not expect %q", output())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.Write([]byte("\r"))
+	if got := <-ret; got != line {
+		t.Fatal("result not expect", got)
+	}
+
+	// resized while the candidates are listed
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	w.Write([]byte("hel\t"))
+	for i := 0; i < 20; i++ {
+		atomic.StoreInt32(&width, int32(20+i))
+		reflow()
+	}
+	w.Write([]byte("\r"))
+	if got := <-ret; got != "hel" {
+		t.Fatal("result not expect", got)
+	}
+}
+
+func TestReadChar(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("y\033[Aab\r")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if r, err := rl.Terminal.ReadChar(); err != nil || r != 'y' {
+		t.Fatal("result not expect", r, err)
+	}
+	// the escape sequence is decoded
+	if r, err := rl.Terminal.ReadChar(); err != nil || r != CharPrev {
+		t.Fatal("result not expect", r, err)
+	}
+	// the line editing goes on
+	if line, err := rl.Readline(); err != nil || line != "ab" {
+		t.Fatal("result not expect", line, err)
+	}
+	if _, err := rl.Terminal.ReadChar(); err != io.EOF {
+		t.Fatal("result not expect", err)
+	}
+}
+
+func TestMouseClick(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	input := "hello world" +
+		"\033[<0;5;5M\033[<0;5;5m" + "X" +
+		// on the prompt and below the input
+		"\033[<0;1;5M\033[<0;5;6M" + "Y\r" +
+		// the wheel recalls the history
+		"\033[<64;5;5M\r"
+	rl, err := NewEx(&Config{
+		Prompt:         "> ",
+		Stdin:          ioutil.NopCloser(strings.NewReader(input)),
+		Stdout:         out,
+		EnableMouse:    true,
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 80 },
+		// the cursor is in the 5th row
+		FuncGetCursorPos: func() (int, int, error) { return 5, 14, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	for _, want := range []string{"heXYllo world", "heXYllo world"} {
+		if line, err := rl.Readline(); err != nil || line != want {
+			t.Fatal("result not expect", line, err)
+		}
+		if !strings.HasPrefix(out.String(), "\033[?1000;1006h") ||
+			!strings.HasSuffix(out.String(), "\033[?1000;1006l") {
+			t.Fatalf("mouse reporting not toggled: %q", out.String())
+		}
+		out.Reset()
+	}
+}
+
+func TestFeedRunes(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// fed before reading, it doesn't block
+	rl.Terminal.FeedRunes([]rune("world")...)
+	rl.Terminal.FeedRunes(CharLineStart)
+	rl.Terminal.FeedRunes([]rune("hello ")...)
+	rl.Terminal.FeedRunes(MetaForward, '!', CharEnter)
+	if line, err := rl.Readline(); err != nil || line != "hello world!" {
+		t.Fatal("result not expect", line, err)
+	}
+
+	rl.Terminal.FeedRunes([]rune("dropped")...)
+	rl.Close()
+	rl.Terminal.FeedRunes([]rune("after close")...)
+}
+
+func TestAcceptLine(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("\rb\r\001a\rc")),
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 80 },
+		AcceptLine: func(line []rune) (bool, []rune) {
+			switch {
+			case len(line) == 0:
+				return false, []rune("empty")
+			case line[0] != 'a':
+				return false, nil
+			}
+			return true, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "ab" {
+		t.Fatal("result not expect", line, err)
+	}
+	if !strings.Contains(out.String(), "\033[2mempty") {
+		t.Fatalf("message not shown: %q", out.String())
+	}
+	if !strings.Contains(out.String(), "\a") {
+		t.Fatalf("bell not rung: %q", out.String())
+	}
+	// flushed at io.EOF
+	if line, err := rl.Readline(); err != nil || line != "c" {
+		t.Fatal("result not expect", line, err)
+	}
+}
+
+func TestMultiLine(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	input := "foo(\r" + "bar)" +
+		"\033[A" + "X" + // up
+		"\001" + "Y" + // home
+		"\033[B" + "\005" + "\r" // down, end
+	rl, err := NewEx(&Config{
+		Prompt:             ">>> ",
+		ContinuationPrompt: "... ",
+		Stdin:              ioutil.NopCloser(strings.NewReader(input)),
+		Stdout:             out,
+		FuncIsTerminal:     func() bool { return true },
+		FuncMakeRaw:        func() error { return nil },
+		FuncExitRaw:        func() error { return nil },
+		FuncGetWidth:       func() int { return 80 },
+		IsComplete: func(line []rune) bool {
+			return strings.Count(string(line), "(") == strings.Count(string(line), ")")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "Yfoo(X\nbar)" {
+		t.Fatalf("result not expect: %q %v", line, err)
+	}
+	if !strings.HasSuffix(out.String(), ">>> Yfoo(X\r\n... bar)\n") {
+		t.Fatalf("output not expect: %q", out.String())
+	}
+}
+
+func TestMultiLineLayout(t *testing.T) {
+	cfg := &Config{ContinuationPrompt: ".. "}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	buf := NewRuneBuffer(ioutil.Discard, "> ", cfg, 10)
+	buf.SetWithIdx(3, []rune("abcdefgh\nxy\nz"))
+
+	for _, c := range []struct {
+		idx       int
+		line, col int
+	}{
+		{0, 0, 2},
+		{7, 0, 9},
+		// the first line fills the screen
+		{8, 1, 0},
+		{9, 1, 3},
+		{11, 1, 5},
+		{13, 2, 4},
+	} {
+		if line, col := buf.screenPos(c.idx); line != c.line || col != c.col {
+			t.Fatal("position not expect", c.idx, line, col)
+		}
+	}
+	if n := buf.LineCount(-1); n != 3 {
+		t.Fatal("line count not expect", n)
+	}
+	if seq := string(buf.getBackspaceSequence()); seq != "\033[2A\r\033[5C" {
+		t.Fatalf("sequence not expect: %q", seq)
+	}
+
+	buf.SetWithIdx(11, buf.Runes())
+	if !buf.MoveLineUp() || buf.Pos() != 2 {
+		t.Fatal("pos not expect", buf.Pos())
+	}
+	if buf.MoveLineUp() {
+		t.Fatal("moved above the first line")
+	}
+	buf.MoveToLogicalLineEnd()
+	if !buf.MoveLineDown() || buf.Pos() != 11 {
+		t.Fatal("pos not expect", buf.Pos())
+	}
+	if !buf.MoveLineDown() || buf.Pos() != 13 {
+		t.Fatal("pos not expect", buf.Pos())
+	}
+	buf.MoveToLogicalLineStart()
+	if buf.MoveLineDown() || buf.Pos() != 12 {
+		t.Fatal("pos not expect", buf.Pos())
+	}
+}
+
+func TestKeyBindings(t *testing.T) {
+	appendRunes := func(s string) func(op *Operation) bool {
+		return func(op *Operation) bool {
+			rs, _ := op.BufferSnapshot()
+			rs = append(rs, []rune(s)...)
+			op.SetBufferWithPos(rs, len(rs))
+			return true
+		}
+	}
+	input := "hello\x14" + // Ctrl+T
+		"\x18u" + // Ctrl+X u
+		"a\x07a" + "\x07z" + // Ctrl+G a, Ctrl+G z
+		"\r\r"
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader(input)),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		KeyBindings: map[rune]func(op *Operation) bool{
+			CharTranspose: func(op *Operation) bool {
+				rs, pos := op.BufferSnapshot()
+				op.SetBufferWithPos([]rune(strings.ToUpper(string(rs))), pos)
+				return true
+			},
+			CharEnter: func(op *Operation) bool {
+				if rs, _ := op.BufferSnapshot(); string(rs) != "aaZ" {
+					return false
+				}
+				op.SetBuffer("done")
+				return true
+			},
+		},
+		KeySequenceBindings: map[[2]rune]func(op *Operation) bool{
+			{CharCtrlX, 'u'}: func(op *Operation) bool {
+				if rs, _ := op.BufferSnapshot(); string(rs) != "HELLO" {
+					t.Errorf("Ctrl+T not bound: %q", string(rs))
+				}
+				op.SetBuffer("")
+				return true
+			},
+			{CharBell, 'z'}: appendRunes("Z"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "done" {
+		t.Fatal("result not expect", line, err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	var (
+		m   sync.Mutex
+		out bytes.Buffer
+	)
+	reloaded := 0
+	cfg := &Config{
+		Prompt: "a> ",
+		Stdin:  ioutil.NopCloser(strings.NewReader("ls\x18\x12\r" + "pwd\x18\x12\r")),
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			m.Lock()
+			defer m.Unlock()
+			return out.Write(b)
+		}),
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	}
+	cfg.OnReload = func() *Config {
+		reloaded++
+		if reloaded > 1 {
+			return nil
+		}
+		newCfg := *cfg
+		newCfg.Prompt = "b> "
+		return &newCfg
+	}
+	rl, err := NewEx(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// the line is kept and redrawn after the new prompt
+	if line, err := rl.Readline(); err != nil || line != "ls" {
+		t.Fatal("result not expect", line, err)
+	}
+	if prompt := rl.Operation.GetConfig().Prompt; prompt != "b> " || reloaded != 1 {
+		t.Fatal("config not reloaded", prompt, reloaded)
+	}
+	m.Lock()
+	if !strings.Contains(out.String(), "b> ls") {
+		t.Fatalf("new prompt not drawn %q", out.String())
+	}
+	out.Reset()
+	m.Unlock()
+
+	// nil keeps the config and rings the bell
+	if line, err := rl.Readline(); err != nil || line != "pwd" {
+		t.Fatal("result not expect", line, err)
+	}
+	if prompt := rl.Operation.GetConfig().Prompt; prompt != "b> " || reloaded != 2 {
+		t.Fatal("config changed", prompt, reloaded)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if !strings.ContainsRune(out.String(), CharBell) {
+		t.Fatalf("bell not rung %q", out.String())
+	}
+}
+
+func TestBellStyle(t *testing.T) {
+	out := make(chan string, 3)
+	cfg := &Config{
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			out <- string(b)
+			return len(b), nil
+		}),
+		FuncIsTerminal: func() bool { return false },
+	}
+	term, err := NewTerminal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	for _, c := range []struct {
+		style BellStyle
+		want  []string
+	}{
+		{BellAudible, []string{"\a"}},
+		{BellVisible, []string{"\033[?5h", "\033[?5l"}},
+		{BellNone, nil},
+	} {
+		newCfg := *cfg
+		newCfg.BellStyle = c.style
+		if err := term.SetConfig(&newCfg); err != nil {
+			t.Fatal(err)
+		}
+		term.Bell()
+		for _, want := range c.want {
+			if got := <-out; got != want {
+				t.Fatalf("bell %v not expect: %q", c.style, got)
+			}
+		}
+		select {
+		case got := <-out:
+			t.Fatalf("bell %v not expect: %q", c.style, got)
+		case <-time.After(2 * visibleBellDuration):
+		}
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestEOFAndInterrupt(t *testing.T) {
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("ab\001\004\r" + "\004" + "x\003")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	// Ctrl+D deletes on a non-empty line
+	if line, err := rl.Readline(); err != nil || line != "b" {
+		t.Fatal("result not expect", line, err)
+	}
+	if _, err := rl.Readline(); !errors.Is(err, ErrEOF) || errors.Is(err, ErrInterrupt) {
+		t.Fatal("result not expect", err)
+	}
+	if line, err := rl.Readline(); !errors.Is(err, ErrInterrupt) || line != "x" {
+		t.Fatal("result not expect", line, err)
+	}
+	if !errors.Is(&InterruptError{}, ErrInterrupt) {
+		t.Fatal("InterruptError is not ErrInterrupt")
+	}
+}
+
+func TestClear(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Prompt:         "> ",
+		Stdin:          ioutil.NopCloser(strings.NewReader("ab\x14\r")),
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 80 },
+		KeyBindings: map[rune]func(op *Operation) bool{
+			CharTranspose: func(op *Operation) bool {
+				op.Clear()
+				return true
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	rl.Clear()
+	if out.String() != "\033[H\033[J" {
+		t.Fatalf("output not expect: %q", out.String())
+	}
+	out.Reset()
+	if line, err := rl.Readline(); err != nil || line != "ab" {
+		t.Fatal("result not expect", line, err)
+	}
+	if !strings.Contains(out.String(), "\033[H\033[J\033[2K\r> ab") {
+		t.Fatalf("output not expect: %q", out.String())
+	}
+}
+
+func TestWriteAbove(t *testing.T) {
+	var m sync.Mutex
+	out := bytes.NewBuffer(nil)
+	r, w := io.Pipe()
+	rl, err := NewEx(&Config{
+		Prompt: "> ",
+		Stdin:  r,
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			m.Lock()
+			defer m.Unlock()
+			return out.Write(b)
+		}),
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 10 },
+		AutoComplete:   NewPrefixCompleter(PcItem("hello", ""), PcItem("help", "")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	go func() {
+		// wrapped, the cursor is after "hello"
+		w.Write([]byte("hello world\033[D\033[D\033[D\033[D\033[D\033[D"))
+		for {
+			if _, pos := rl.Operation.BufferSnapshot(); pos == 5 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		m.Lock()
+		out.Reset()
+		m.Unlock()
+		rl.WriteAbove([]byte("msg"))
+		w.Write([]byte("\r"))
+	}()
+	if line, err := rl.Readline(); err != nil || line != "hello world" {
+		t.Fatal("result not expect", line, err)
+	}
+	m.Lock()
+	defer m.Unlock()
+	want := "\033[J\033[2K\r" + // the input is cleaned
+		"msg\n" +
+		"> hello world" + "\033[1A\r\033[7C" // the cursor is restored
+	if !strings.HasPrefix(out.String(), want) {
+		t.Fatalf("output not expect: %q", out.String())
+	}
+	out.Reset()
+	m.Unlock()
+
+	// written while the candidates are listed by Tab
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < 20; i++ {
+			rl.WriteAbove([]byte("msg"))
+		}
+	}()
+	go func() {
+		w.Write([]byte("hel\t"))
+		<-written
+		w.Write([]byte("\r"))
+	}()
+	if line, err := rl.Readline(); err != nil || line != "hel" {
+		t.Fatal("result not expect", line, err)
+	}
+	m.Lock()
+	if n := strings.Count(out.String(), "msg\n"); n != 20 {
+		t.Fatalf("%d messages written: %q", n, out.String())
+	}
+}
+
+func TestSetStatusLine(t *testing.T) {
+	var m sync.Mutex
+	out := bytes.NewBuffer(nil)
+	r, w := io.Pipe()
+	var rl *Instance
+	rl, err := NewEx(&Config{
+		Prompt: "> ",
+		Stdin:  r,
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			m.Lock()
+			defer m.Unlock()
+			return out.Write(b)
+		}),
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 20 },
+		Listener: FuncListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+			if key == '!' {
+				rl.SetStatusLine("bang")
+			}
+			return nil, 0, false
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	ret := make(chan string, 1)
+	go func() {
+		line, _ := rl.Readline()
+		ret <- line
+	}()
+	w.Write([]byte("ab"))
+	for rl.Operation.buf.Len() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	rl.SetStatusLine("invalid")
+	m.Lock()
+	// drawn below the input, the cursor is moved back after "> ab"
+	if !strings.HasSuffix(out.String(), "> ab\r\ninvalid\033[0m\033[A\r\033[4C") {
+		t.Fatalf("output not expect: %q", out.String())
+	}
+	m.Unlock()
+
+	// set by the Listener
+	w.Write([]byte("!"))
+	for rl.Operation.buf.StatusLine() != "bang" {
+		time.Sleep(time.Millisecond)
+	}
+	rl.SetStatusLine("")
+	if s := rl.Operation.buf.StatusLine(); s != "" {
+		t.Fatalf("status line not cleared: %q", s)
+	}
+
+	rl.SetStatusLine("invalid")
+	w.Write([]byte("\r"))
+	if line := <-ret; line != "ab!" {
+		t.Fatal("result not expect", line)
+	}
+	// cleared on submit
+	if s := rl.Operation.buf.StatusLine(); s != "" {
+		t.Fatalf("status line not cleared: %q", s)
+	}
+}
+
+func TestSplitMultibyteRead(t *testing.T) {
+	for _, stdin := range []io.Reader{
+		// a 3-byte rune is read byte by byte
+		iotest.OneByteReader(strings.NewReader("你好\r")),
+		// or the read is interrupted
+		&chunkReader{chunks: []string{"\xe4", "\xbd", "\xa0好\r"}, err: errors.New("read /dev/stdin: interrupted system call")},
+	} {
+		rl, err := NewEx(&Config{
+			Stdin:          ioutil.NopCloser(stdin),
+			Stdout:         ioutil.Discard,
+			FuncIsTerminal: func() bool { return false },
+			FuncMakeRaw:    func() error { return nil },
+			FuncExitRaw:    func() error { return nil },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := rl.Readline()
+		rl.Close()
+		if err != nil || line != "你好" {
+			t.Fatalf("result not expect: %q %v", line, err)
+		}
+	}
+}
+
+// chunkReader returns the chunks one by one, each followed by err.
+type chunkReader struct {
+	chunks []string
+	err    error
+	failed bool
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if len(c.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if c.failed = !c.failed; !c.failed {
+		return 0, c.err
+	}
+	n := copy(b, c.chunks[0])
+	c.chunks[0] = c.chunks[0][n:]
+	if len(c.chunks[0]) == 0 {
+		c.chunks = c.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestOnEOF(t *testing.T) {
+	stdins := []string{"c\r"}
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("ab")),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		OnEOF: func() (io.Reader, bool) {
+			if len(stdins) == 0 {
+				return nil, false
+			}
+			stdin := strings.NewReader(stdins[0])
+			stdins = stdins[1:]
+			return stdin, true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "abc" {
+		t.Fatal("result not expect", line, err)
+	}
+	if _, err := rl.Readline(); err != io.EOF {
+		t.Fatal("result not expect", err)
+	}
+}
+
+func TestRightPrompt(t *testing.T) {
+	cfg := &Config{
+		RightPrompt: func() []rune { return []rune("\033[2m[12:00]") },
+	}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	buf := NewRuneBuffer(ioutil.Discard, "> ", cfg, 20)
+	for _, c := range []struct {
+		line, expected string
+	}{
+		{"hello", "> \033[10C\033[2m[12:00]\033[0m\r\033[2Chello"},
+		// a space is left before it
+		{"hello wor", "> \033[10C\033[2m[12:00]\033[0m\r\033[2Chello wor"},
+		{"hello worl", "> hello worl"},
+		// only the first line counts
+		{"hi\nhello world", "> \033[10C\033[2m[12:00]\033[0m\r\033[2Chi\r\nhello world"},
+	} {
+		buf.Set([]rune(c.line))
+		if output := string(buf.output()); output != c.expected {
+			t.Fatalf("output not expect: %q", output)
+		}
+	}
+
+	// placed by the new width
+	buf.OnWidthChange(30)
+	buf.Set([]rune("hello worl"))
+	if output := string(buf.output()); output != "> \033[20C\033[2m[12:00]\033[0m\r\033[2Chello worl" {
+		t.Fatalf("output not expect: %q", output)
+	}
+}
+
+func TestTerminalWidth(t *testing.T) {
+	width := int32(0)
+	term, err := NewTerminal(&Config{
+		Stdout:       ioutil.Discard,
+		FuncGetWidth: func() int { return int(atomic.LoadInt32(&width)) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	// not a tty
+	if w := term.Width(); w != DefaultScreenWidth {
+		t.Fatal("width not expect", w)
+	}
+	atomic.StoreInt32(&width, 120)
+	if w := term.Width(); w != 120 {
+		t.Fatal("width not expect", w)
+	}
+}
+
+func TestHistorySearchPrefix(t *testing.T) {
+	input := "gi\033[A\033[A\033[BX\r" +
+		// an empty line recalls the previous item as usual
+		"\033[A\r" +
+		// down goes back to the typed text
+		"gi\033[A\033[B\033[B\r"
+	rl, err := NewEx(&Config{
+		Stdin:               ioutil.NopCloser(strings.NewReader(input)),
+		Stdout:              ioutil.Discard,
+		HistorySearchPrefix: true,
+		FuncIsTerminal:      func() bool { return true },
+		FuncMakeRaw:         func() error { return nil },
+		FuncExitRaw:         func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	for _, item := range []string{"git status", "ls", "git log"} {
+		rl.AddHistory(item)
+	}
+
+	for _, want := range []string{"giXt log", "giXt log", "gi"} {
+		if line, err := rl.Readline(); err != nil || line != want {
+			t.Fatal("result not expect", line, err)
+		}
+	}
+}
+
+func TestSearchPromptFunc(t *testing.T) {
+	input := "\x12ls\x12x\x07\x13p\x07\r"
+	history := []string{"ls -l", "pwd", "ls"}
+
+	var m sync.Mutex
+	var calls []string
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader(input)),
+		Stdout:         ioutil.Discard,
+		FuncIsTerminal: func() bool { return false },
+		SearchPromptFunc: func(query string, dir SearchDirection, matchIndex, matchCount int, failed bool) string {
+			m.Lock()
+			calls = append(calls, fmt.Sprintf("%q %v %d/%d %v", query, dir, matchIndex, matchCount, failed))
+			m.Unlock()
+			return "search: " + query
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range history {
+		rl.AddHistory(item)
+	}
+	if _, err := rl.Readline(); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+
+	m.Lock()
+	got := strings.Join(calls, "\n")
+	m.Unlock()
+	expected := []string{
+		`"" bck 0/0 false`,
+		`"l" bck 1/2 false`,
+		`"ls" bck 1/2 false`,
+		// ^R again goes to the older match
+		`"ls" bck 2/2 false`,
+		`"lsx" bck 0/0 true`,
+		`"" fwd 0/0 false`,
+		// there is no newer item
+		`"p" fwd 0/1 true`,
+	}
+	if got != strings.Join(expected, "\n") {
+		t.Fatalf("calls not expect:\n%s", got)
+	}
+
+	// without SearchPromptFunc the bash style prompt is shown
+	out := &bytes.Buffer{}
+	rl, err = NewEx(&Config{
+		Stdin: ioutil.NopCloser(strings.NewReader(input)),
+		Stdout: writerFunc(func(b []byte) (int, error) {
+			m.Lock()
+			defer m.Unlock()
+			return out.Write(b)
+		}),
+		FuncIsTerminal: func() bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range history {
+		rl.AddHistory(item)
+	}
+	if _, err := rl.Readline(); err != nil {
+		t.Fatal(err)
+	}
+	rl.Close()
+	m.Lock()
+	defer m.Unlock()
+	for _, want := range []string{"bck-i-search: ls", "failing bck-i-search: lsx", "failing fwd-i-search: p"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("%q not found in %q", want, out.String())
+		}
+	}
+}
+
+func TestVimTextObjects(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		VimMode:        true,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	for _, c := range []struct {
+		keys, expect string
+	}{
+		{"echo hello world\033bbdiw\r", "echo  world"},
+		{"echo hello world\033bbciwbye\033p\r", "echo byehello world"},
+		{"echo hello world\033bbhdiw\r", "echohello world"},
+		{`say "hi there" ok` + "\033Fhdi\"\r", `say "" ok`},
+		{`say "hi there" ok` + "\0330ci\"bye\r", `say "bye" ok`},
+		{"say 'hi'\033bdi\"\r", "say 'hi'"},
+		{"echo hello\033ccbye\r", "bye"},
+	} {
+		rl.Terminal.FeedRunes([]rune(c.keys)...)
+		if line, err := rl.Readline(); err != nil || line != c.expect {
+			t.Fatalf("result not expect %q %q %v", c.keys, line, err)
+		}
+	}
+}
+
+func TestVimReplaceAndToggleCase(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		VimMode:        true,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	for _, c := range []struct {
+		keys, expect string
+	}{
+		{"héllo\0330rHlrÉ\r", "HÉllo"},
+		{"hello\0330~~\r", "HEllo"},
+		{"héllo wörld\0330" + "3~w20~\r", "HÉLlo WÖRLD"},
+		{"hello\0330" + "3rx\r", "xxxlo"},
+		// not enough characters
+		{"hello\033hh3rx\r", "hello"},
+		// past the last character
+		{"hello\033~rx\r", "hello"},
+	} {
+		rl.Terminal.FeedRunes([]rune(c.keys)...)
+		if line, err := rl.Readline(); err != nil || line != c.expect {
+			t.Fatalf("result not expect %q %q %v", c.keys, line, err)
+		}
+	}
+}
+
+func TestVimCount(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	rl, err := NewEx(&Config{
+		Stdin:          r,
+		Stdout:         ioutil.Discard,
+		VimMode:        true,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	for _, c := range []struct {
+		keys, expect string
+	}{
+		{"hello\0330" + "2li-\r", "he-llo"},
+		// clamped at the end of the line
+		{"hello\0330" + "10li-\r", "hello-"},
+		{"hello\033" + "3hi-\r", "he-llo"},
+		{"a b c d e\0330" + "3wi-\r", "a b c -d e"},
+		{"a b c d e\033" + "2bi-\r", "a b c -d e"},
+		{"a b c d e\0330" + "3dw\r", " d e"},
+		{"a b c d e\0330d3w\r", " d e"},
+		{"a b c d e\0330" + "2d2w\r", " e"},
+		// the deleted text is pasted as a whole
+		{"hello\0330" + "2xp\r", "hello"},
+		{"hello\0330" + "2xx$p\r", "lohel"},
+		{"a b c\0330" + "2cwx\r", "x c"},
+		// 0 is a count only after a digit
+		{"hello world\033" + "10hi-\r", "h-ello world"},
+		{"hello\033hh0i-\r", "-hello"},
+		// a long count neither overflows nor makes a command succeed
+		{"hello\0330" + "99999999999999999999999x\r", ""},
+		{"hello\033" + "99999999999999999999999hi-\r", "-hello"},
+		{"hello\0330" + "99999999999999999999999rx\r", "hello"},
+		{"a b c\0330" + "99999999999999999999999d99999999999999999999999w\r", ""},
+	} {
+		rl.Terminal.FeedRunes([]rune(c.keys)...)
+		if line, err := rl.Readline(); err != nil || line != c.expect {
+			t.Fatalf("result not expect %q %q %v", c.keys, line, err)
+		}
+	}
+}
+
+func TestVimCountRefresh(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	cfg := &Config{
+		Painter:        &defaultPainter{},
+		FuncIsTerminal: func() bool { return true },
+	}
+	buf := NewRuneBuffer(out, "> ", cfg, 80)
+	buf.SetWithIdx(0, []rune("hello world"))
+
+	// the line is redrawn once for the whole count
+	out.Reset()
+	buf.repeat(3, buf.MoveForward)
+	if buf.Pos() != 3 || strings.Count(out.String(), "\033[J") != 1 {
+		t.Fatalf("result not expect %d %q", buf.Pos(), out.String())
+	}
+	out.Reset()
+	buf.repeatKill(2, func() { buf.Delete() })
+	if string(buf.Runes()) != "hel world" || strings.Count(out.String(), "\033[J") != 1 {
+		t.Fatalf("result not expect %q %q", string(buf.Runes()), out.String())
+	}
+	if ring := buf.KillRing(); len(ring) != 1 || string(ring[0]) != "lo" {
+		t.Fatalf("kills not merged %q", ring)
+	}
+}
+
+func TestVimModeIndicator(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Prompt:           "> ",
+		Stdin:            ioutil.NopCloser(strings.NewReader("ab\033i\r")),
+		Stdout:           out,
+		VimMode:          true,
+		VimModeIndicator: DefaultVimModeIndicator,
+		FuncIsTerminal:   func() bool { return true },
+		FuncMakeRaw:      func() error { return nil },
+		FuncExitRaw:      func() error { return nil },
+		FuncGetWidth:     func() int { return 40 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "ab" {
+		t.Fatal("result not expect", line, err)
+	}
+	// redrawn by Esc and i, the cursor is moved back after the prompt
+	output := out.String()
+	normal := strings.Index(output, "\033[25C-- NORMAL --\033[0m\r\033[2Cab")
+	if normal < 0 || !strings.Contains(output[normal:], "\033[25C-- INSERT --\033[0m\r\033[2Cab") {
+		t.Fatalf("output not expect: %q", output)
+	}
+
+	rl.SetVimMode(false)
+	if len(rl.Operation.buf.modeIndicator) != 0 {
+		t.Fatal("indicator not expect", string(rl.Operation.buf.modeIndicator))
+	}
+}
+
+func TestVimCursorShapes(t *testing.T) {
+	var (
+		m   sync.Mutex
+		out bytes.Buffer
+	)
+	// output returns the written bytes since the last call
+	output := func() string {
+		m.Lock()
+		defer m.Unlock()
+		s := out.String()
+		out.Reset()
+		return s
+	}
+	newInstance := func() *Instance {
+		rl, err := NewEx(&Config{
+			Stdin: ioutil.NopCloser(strings.NewReader("ab\033\r")),
+			Stdout: writerFunc(func(b []byte) (int, error) {
+				m.Lock()
+				defer m.Unlock()
+				return out.Write(b)
+			}),
+			VimMode:         true,
+			VimCursorShapes: true,
+			FuncIsTerminal:  func() bool { return true },
+			FuncMakeRaw:     func() error { return nil },
+			FuncExitRaw:     func() error { return nil },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line, err := rl.Readline(); err != nil || line != "ab" {
+			t.Fatal("result not expect", line, err)
+		}
+		return rl
+	}
+
+	// the bar in the insert mode, the block in the normal mode
+	rl := newInstance()
+	s := output()
+	bar := strings.Index(s, "\033[6 q")
+	if bar < 0 || !strings.Contains(s[bar:], "\033[2 q") {
+		t.Fatalf("cursor shape not expect %q", s)
+	}
+	// restored on Close
+	rl.Close()
+	if s := output(); !strings.HasSuffix(s, "\033[0 q") {
+		t.Fatalf("cursor shape not restored %q", s)
+	}
+
+	// restored when the vim mode is switched off
+	rl = newInstance()
+	defer rl.Close()
+	output()
+	rl.SetVimMode(false)
+	if s := output(); strings.LastIndex(s, "\033[0 q") <= strings.LastIndex(s, "\033[6 q") {
+		t.Fatalf("cursor shape not restored %q", s)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	logger := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("ab\033[D\033OHc\033b\r")),
+		Stdout:         ioutil.Discard,
+		Logger:         logger,
+		FuncIsTerminal: func() bool { return false },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "cab" {
+		t.Fatal("result not expect", line, err)
+	}
+	for _, want := range []string{
+		"read 'a'\n",
+		"escape: CSI D\nescape: key '\\x02' (2)\n",
+		"escape: SS3 H\nescape: key '\\x01' (1)\n",
+		// the meta keys are negative
+		fmt.Sprintf("escape: key %q (%d)\n", MetaBackward, MetaBackward),
+	} {
+		if !strings.Contains(logger.String(), want) {
+			t.Fatalf("%q not logged: %q", want, logger.String())
+		}
+	}
+
+	// the masked input isn't logged
+	logger.Reset()
+	rl.SetMaskRune('*')
+	rl.Config.StdinWriter.Write([]byte("secret\r"))
+	if line, err := rl.Readline(); err != nil || line != "secret" {
+		t.Fatal("result not expect", line, err)
+	}
+	if strings.Contains(logger.String(), "'s'") || !strings.Contains(logger.String(), "read (masked)") {
+		t.Fatalf("masked input logged: %q", logger.String())
+	}
+
+	// Debug goes to the logger too
+	logger.Reset()
+	SetDebugLogger(logger)
+	defer SetDebugLogger(nil)
+	Debug("hello", 1)
+	if logger.String() != "hello 1\n" {
+		t.Fatalf("result not expect %q", logger.String())
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, err := NewEx(&Config{
+		Stdin:          ioutil.NopCloser(strings.NewReader("xy\x17\rsécret\x15ok\rabc\x03\x19\r")),
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	if line, err := rl.Readline(); err != nil || line != "" {
+		t.Fatal("result not expect", line, err)
+	}
+	// the password is killed and typed again
+	if pass, err := rl.ReadPassword("password: "); err != nil || string(pass) != "ok" {
+		t.Fatal("result not expect", string(pass), err)
+	}
+	buf := rl.Operation.buf.buf
+	for _, r := range buf[:cap(buf)] {
+		if r != 0 {
+			t.Fatalf("buffer not wiped %q", string(buf[:cap(buf)]))
+		}
+	}
+	if pass, err := rl.ReadPassword("password: "); !errors.Is(err, ErrInterrupt) || pass != nil {
+		t.Fatal("result not expect", string(pass), err)
+	}
+	if strings.Contains(out.String(), "cret") || strings.Contains(out.String(), "abc") {
+		t.Fatalf("password echoed: %q", out.String())
+	}
+	if rl.Operation.GetConfig().EnableMask {
+		t.Fatal("config not restored")
+	}
+	// only the text killed before is yanked
+	if line, err := rl.Readline(); err != nil || line != "xy" {
+		t.Fatal("result not expect", line, err)
+	}
+}
+
+func TestTabWidth(t *testing.T) {
+	cfg := &Config{TabWidth: 4, ContinuationPrompt: ". "}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	buf := NewRuneBuffer(ioutil.Discard, "> ", cfg, 20)
+	for _, c := range []struct {
+		line     string
+		idx      int
+		expected string
+	}{
+		// to the next tab stop after the prompt
+		{"a\tb", 3, "> a b"},
+		{"\tb", 2, ">   b"},
+		// the cursor goes back over the spaces
+		{"ab\tc", 2, "> ab    c\b\b\b\b\b"},
+		// the tab stops of each line start at the screen edge
+		{"a\n\tb", 4, "> a\r\n.   b"},
+		// the painted colors take no space
+		{"\033[31ma\033[0m\tb", 14, "> \033[31ma\033[0m b"},
+	} {
+		buf.SetWithIdx(c.idx, []rune(c.line))
+		if output := string(buf.output()); output != c.expected {
+			t.Fatalf("output not expect: %q", output)
+		}
+	}
+
+	// the tab fills the line
+	buf.SetWithIdx(0, []rune("abcdefghijklmnopq\tr"))
+	if line, col := buf.screenPos(19); line != 1 || col != 1 {
+		t.Fatal("position not expect", line, col)
+	}
+	// the width goes to the tab stop of Config.TabWidth too
+	cfg.TabWidth = 8
+	buf.SetWithIdx(0, []rune("a\tb"))
+	if w := buf.CurrentWidth(2); w != 8 {
+		t.Fatal("width not expect", w)
+	}
+
+	cfg = &Config{}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TabWidth != DefaultTabWidth {
+		t.Fatal("tab width not expect", cfg.TabWidth)
+	}
+}
+
+func TestRuneWidthFunc(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	buf := NewRuneBuffer(ioutil.Discard, "> ", cfg, 20)
+	// the cursor goes back over the emoji sequence as a wide cell
+	buf.SetWithIdx(1, []rune("a👨\u200d👩"))
+	if seq := string(buf.getBackspaceSequence()); seq != "\b\b" {
+		t.Fatalf("sequence not expect: %q", seq)
+	}
+
+	// a terminal drawing the ambiguous runes wide
+	cfg.RuneWidthFunc = func(r rune) int {
+		if r == '☭' {
+			return 2
+		}
+		return runes.Width(r)
+	}
+	buf.SetWithIdx(1, []rune("a☭b"))
+	if seq := string(buf.getBackspaceSequence()); seq != "\b\b\b" {
+		t.Fatalf("sequence not expect: %q", seq)
+	}
+	if line, col := buf.screenPos(3); line != 0 || col != 6 {
+		t.Fatal("position not expect", line, col)
+	}
+}
+
+func TestClusterEditing(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	family := "👩‍👩‍👧‍👦"
+	buf := NewRuneBuffer(ioutil.Discard, "> ", cfg, 80)
+	buf.Set([]rune("a" + family + "b"))
+
+	buf.MoveBackward()
+	buf.MoveBackward()
+	if buf.Pos() != 1 {
+		t.Fatal("pos not expect", buf.Pos())
+	}
+	buf.MoveForward()
+	if buf.Pos() != 8 {
+		t.Fatal("pos not expect", buf.Pos())
+	}
+	buf.Backspace()
+	if s := string(buf.Runes()); s != "ab" {
+		t.Fatalf("buffer not expect: %q", s)
+	}
+
+	buf.Set([]rune("a" + family + "b"))
+	buf.SetWithIdx(1, buf.Runes())
+	if !buf.Delete() || string(buf.Runes()) != "ab" {
+		t.Fatalf("buffer not expect: %q", string(buf.Runes()))
+	}
+}
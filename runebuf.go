@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 )
 
 type runeBufferBck struct {
@@ -22,7 +23,9 @@ type RuneBuffer struct {
 
 	hadClean    bool
 	interactive bool
-	cfg         *Config
+	// set while repeat calls f, the line is redrawn once after the calls
+	repeating bool
+	cfg       *Config
 
 	// 终端屏幕的宽度
 	width int
@@ -31,13 +34,161 @@ type RuneBuffer struct {
 
 	offset string
 
-	lastKill []rune
+	killRing killRing
+
+	// the states before the edits, see Undo and Redo
+	undoStack []runeBufferBck
+	redoStack []runeBufferBck
+	// the state before the current key, it's pushed to undoStack if the
+	// key changes the buffer.
+	editBck *runeBufferBck
+	// whether the current key and the previous one insert a rune, a run
+	// of the inserted runes is undone at once.
+	inserting, lastInserting bool
+
+	// typed runes replace the rune under the cursor instead of being inserted
+	overwrite bool
+
+	// drawn on the line below the input
+	statusLine []rune
+	// drawn dimmed in place of an empty statusLine, see Config.Hint
+	hint []rune
+	// drawn before Config.RightPrompt, see Config.VimModeIndicator
+	modeIndicator []rune
 
 	sync.Mutex
 }
 
-func (r *RuneBuffer) pushKill(text []rune) {
-	r.lastKill = append([]rune{}, text...)
+func (r *RuneBuffer) pushKill(text []rune, dir killDir) {
+	r.killRing.push(text, dir, r.cfg.KillRingSize)
+}
+
+// newKey is called before each key, so the consecutive kills can be
+// merged, see Config.KillRingSize, and the edits by the previous key can
+// be undone.
+func (r *RuneBuffer) newKey(key rune) {
+	r.Lock()
+	r.killRing.newKey()
+	r.recordEdit()
+	r.lastInserting, r.inserting = r.inserting, IsPrintable(key)
+	r.Unlock()
+}
+
+func (r *RuneBuffer) snapshot() *runeBufferBck {
+	return &runeBufferBck{runes.Copy(r.buf), r.idx}
+}
+
+// recordEdit pushes the state before the current key to the undo stack if
+// the buffer is changed since then.
+func (r *RuneBuffer) recordEdit() {
+	if r.editBck != nil && !runes.Equal(r.editBck.buf, r.buf) {
+		// the previous rune is inserted in the same step
+		if !r.inserting || !r.lastInserting {
+			r.undoStack = append(r.undoStack, *r.editBck)
+		}
+		r.redoStack = nil
+	} else {
+		r.inserting = false
+	}
+	r.editBck = r.snapshot()
+}
+
+// ResetUndo forgets the edits, it's called once a new line is read.
+func (r *RuneBuffer) ResetUndo() {
+	r.Lock()
+	r.undoStack, r.redoStack = nil, nil
+	r.editBck = nil
+	r.inserting, r.lastInserting = false, false
+	r.Unlock()
+}
+
+// wipe zeroes the runes left in the memory of the buffer and its undo
+// history, i.e. after reading a password.
+func (r *RuneBuffer) wipe() {
+	r.Lock()
+	defer r.Unlock()
+	zeroRunes(r.buf[:cap(r.buf)])
+	for _, bck := range append(r.undoStack, r.redoStack...) {
+		zeroRunes(bck.buf)
+	}
+	if r.editBck != nil {
+		zeroRunes(r.editBck.buf)
+	}
+	for _, item := range r.killRing.items {
+		zeroRunes(item)
+	}
+	r.buf, r.idx = r.buf[:0], 0
+	r.undoStack, r.redoStack = nil, nil
+	r.editBck = nil
+	r.killRing = killRing{}
+}
+
+// swapKillRing replaces the kill ring by k and returns the old one, so the
+// texts killed in a password are kept apart.
+func (r *RuneBuffer) swapKillRing(k killRing) killRing {
+	r.Lock()
+	defer r.Unlock()
+	old := r.killRing
+	r.killRing = k
+	return old
+}
+
+func zeroRunes(rs []rune) {
+	for i := range rs {
+		rs[i] = 0
+	}
+}
+
+// Undo reverts the last edit, a run of the inserted runes is reverted at
+// once. It returns false if there is nothing to undo.
+func (r *RuneBuffer) Undo() (success bool) {
+	r.Refresh(func() {
+		r.recordEdit()
+		n := len(r.undoStack)
+		if n == 0 {
+			return
+		}
+		r.redoStack = append(r.redoStack, *r.snapshot())
+		r.buf, r.idx = r.undoStack[n-1].buf, r.undoStack[n-1].idx
+		r.undoStack = r.undoStack[:n-1]
+		r.editBck = r.snapshot()
+		r.inserting = false
+		success = true
+	})
+	return
+}
+
+// Redo reapplies the edit reverted by Undo, it returns false if there is
+// nothing to redo.
+func (r *RuneBuffer) Redo() (success bool) {
+	r.Refresh(func() {
+		r.recordEdit()
+		n := len(r.redoStack)
+		if n == 0 {
+			return
+		}
+		r.undoStack = append(r.undoStack, *r.snapshot())
+		r.buf, r.idx = r.redoStack[n-1].buf, r.redoStack[n-1].idx
+		r.redoStack = r.redoStack[:n-1]
+		r.editBck = r.snapshot()
+		r.inserting = false
+		success = true
+	})
+	return
+}
+
+// KillRing returns a copy of the killed texts, the most recent one first.
+func (r *RuneBuffer) KillRing() [][]rune {
+	r.Lock()
+	defer r.Unlock()
+	return r.killRing.list()
+}
+
+// SetKillRing replaces the killed texts, ring[0] is the one to be yanked.
+func (r *RuneBuffer) SetKillRing(ring [][]rune) {
+	r.Lock()
+	defer r.Unlock()
+	r.killRing.set(ring, r.cfg.KillRingSize)
 }
 
 func (r *RuneBuffer) OnWidthChange(newWidth int) {
@@ -80,16 +231,18 @@ func (r *RuneBuffer) SetConfig(cfg *Config) {
 	r.Unlock()
 }
 
+// SetMask masks the input by m, 0 turns the masking off.
 func (r *RuneBuffer) SetMask(m rune) {
 	r.Lock()
 	r.cfg.MaskRune = m
+	r.cfg.EnableMask = m != 0
 	r.Unlock()
 }
 
 func (r *RuneBuffer) CurrentWidth(x int) int {
 	r.Lock()
 	defer r.Unlock()
-	return runes.WidthAll(r.buf[:x])
+	return r.widthAll(r.buf[:x])
 }
 
 func (r *RuneBuffer) PromptLen() int {
@@ -99,8 +252,109 @@ func (r *RuneBuffer) PromptLen() int {
 	return width
 }
 
+// Prompt returns the current prompt, including the color escapes.
+func (r *RuneBuffer) Prompt() string {
+	r.Lock()
+	prompt := string(r.prompt)
+	r.Unlock()
+	return prompt
+}
+
+// widthAt returns the cells taken by rs[i], see Config.RuneWidthFunc. A
+// tab alone takes Config.TabWidth cells rather than the global TabWidth.
+func (r *RuneBuffer) widthAt(rs []rune, i int) int {
+	if rs[i] == '\t' {
+		return r.cfg.TabWidth
+	}
+	if f := r.cfg.RuneWidthFunc; f != nil {
+		return f(rs[i])
+	}
+	return runes.WidthAt(rs, i)
+}
+
+// widthAll returns the cells taken by rs drawn from a tab stop, the tabs
+// go to the next tab stops of Config.TabWidth as the line is drawn.
+func (r *RuneBuffer) widthAll(rs []rune) (width int) {
+	for i := range rs {
+		if rs[i] == '\t' {
+			width += tabAdvance(width, r.cfg.TabWidth)
+			continue
+		}
+		width += r.widthAt(rs, i)
+	}
+	return
+}
+
+// promptLen returns the width of the last line of the prompt, which the
+// input follows.
 func (r *RuneBuffer) promptLen() int {
-	return runes.WidthAll(runes.ColorFilter(r.prompt))
+	return r.widthAll(runes.ColorFilter(r.prompt[r.promptLines():]))
+}
+
+// promptLines returns the index after the last '\n' of the prompt, that is
+// the runes of the lines above the input.
+func (r *RuneBuffer) promptLines() int {
+	for i := len(r.prompt) - 1; i >= 0; i-- {
+		if r.prompt[i] == '\n' {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// contPromptLen returns the width of Config.ContinuationPrompt which is
+// drawn before the lines after the first one of the input.
+func (r *RuneBuffer) contPromptLen() int {
+	return r.widthAll(runes.ColorFilter([]rune(r.cfg.ContinuationPrompt)))
+}
+
+// position returns where the cursor is after drawing rs after the prompt on
+// a screen of width, line is counted from the first line of the input.
+// The cursor goes to the next line if a line fills the screen, as
+// isInLineEdge forces.
+func (r *RuneBuffer) position(rs []rune, width int) (line, col int) {
+	col = r.promptLen()
+	wrapped := false
+	for i, c := range rs {
+		if c == '\n' {
+			// \r\n doesn't go further after a wrap
+			if !wrapped {
+				line++
+			}
+			col = r.contPromptLen()
+			wrapped = false
+			continue
+		}
+		wrapped = false
+		if c == '\t' {
+			col += tabAdvance(col, r.cfg.TabWidth)
+			// the spaces of the tab go on in the next line
+			for width > 0 && col > width {
+				line++
+				col -= width
+			}
+		} else {
+			col += r.widthAt(rs, i)
+		}
+		if width > 0 && col >= width {
+			line++
+			col = 0
+			wrapped = true
+		}
+	}
+	return line, col
+}
+
+// promptLineCount returns how many lines of the prompt are above the input,
+// the lines are assumed to be narrower than the screen.
+func (r *RuneBuffer) promptLineCount() int {
+	cnt := 0
+	for _, c := range r.prompt {
+		if c == '\n' {
+			cnt++
+		}
+	}
+	return cnt
 }
 
 // RuneSlice i为负时，光标左边复制i个字符并返回
@@ -127,6 +381,13 @@ func (r *RuneBuffer) Runes() []rune {
 	return newr
 }
 
+// Snapshot returns a copy of the runes and the cursor position.
+func (r *RuneBuffer) Snapshot() ([]rune, int) {
+	r.Lock()
+	defer r.Unlock()
+	return runes.Copy(r.buf), r.idx
+}
+
 func (r *RuneBuffer) Pos() int {
 	r.Lock()
 	defer r.Unlock()
@@ -153,7 +414,7 @@ func (r *RuneBuffer) MoveBackward() {
 		if r.idx == 0 {
 			return
 		}
-		r.idx--
+		r.idx = runes.PrevCluster(r.buf, r.idx)
 	})
 }
 
@@ -161,8 +422,36 @@ func (r *RuneBuffer) WriteString(s string) {
 	r.WriteRunes([]rune(s))
 }
 
+// WriteRune inserts s at the cursor, or replaces the rune under the cursor
+// in the overwrite mode.
 func (r *RuneBuffer) WriteRune(s rune) {
-	r.WriteRunes([]rune{s})
+	r.Lock()
+	overwrite := r.overwrite && r.idx < len(r.buf)
+	r.Unlock()
+	if !overwrite {
+		r.WriteRunes([]rune{s})
+		return
+	}
+	r.Refresh(func() {
+		r.buf[r.idx] = s
+		r.idx++
+	})
+}
+
+// ToggleOverwrite switches between the insert and the overwrite mode,
+// and returns true if the overwrite mode is on.
+func (r *RuneBuffer) ToggleOverwrite() bool {
+	r.Lock()
+	r.overwrite = !r.overwrite
+	overwrite := r.overwrite
+	r.Unlock()
+	return overwrite
+}
+
+func (r *RuneBuffer) IsOverwrite() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.overwrite
 }
 
 func (r *RuneBuffer) WriteRunes(s []rune) {
@@ -173,12 +462,29 @@ func (r *RuneBuffer) WriteRunes(s []rune) {
 	})
 }
 
+// ReplaceAround replaces the before runes before the cursor and the after runes
+// after it by s, and moves the cursor to the end of s.
+func (r *RuneBuffer) ReplaceAround(before, after int, s []rune) {
+	r.Refresh(func() {
+		if before > r.idx {
+			before = r.idx
+		}
+		if r.idx+after > len(r.buf) {
+			after = len(r.buf) - r.idx
+		}
+		start := r.idx - before
+		tail := append(runes.Copy(s), r.buf[r.idx+after:]...)
+		r.buf = append(r.buf[:start], tail...)
+		r.idx = start + len(s)
+	})
+}
+
 func (r *RuneBuffer) MoveForward() {
 	r.Refresh(func() {
 		if r.idx == len(r.buf) {
 			return
 		}
-		r.idx++
+		r.idx = runes.NextCluster(r.buf, r.idx)
 	})
 }
 
@@ -189,15 +495,58 @@ func (r *RuneBuffer) IsCursorInEnd() bool {
 }
 
 func (r *RuneBuffer) Replace(ch rune) {
+	r.ReplaceN(ch, 1)
+}
+
+// ReplaceN replaces n runes from the cursor with ch like "r" of vim, the
+// cursor is left on the last one. Nothing is replaced if there are fewer
+// than n runes.
+func (r *RuneBuffer) ReplaceN(ch rune, n int) (success bool) {
 	r.Refresh(func() {
-		r.buf[r.idx] = ch
+		if n <= 0 || r.idx+n > len(r.buf) {
+			return
+		}
+		for i := r.idx; i < r.idx+n; i++ {
+			r.buf[i] = ch
+		}
+		r.idx += n - 1
+		success = true
+	})
+	return
+}
+
+// ToggleCase toggles the case of at most n runes from the cursor like "~"
+// of vim, and moves the cursor after them but not past the last rune.
+func (r *RuneBuffer) ToggleCase(n int) (success bool) {
+	r.Refresh(func() {
+		if n <= 0 || r.idx >= len(r.buf) {
+			return
+		}
+		end := r.idx + n
+		if end > len(r.buf) {
+			end = len(r.buf)
+		}
+		for i := r.idx; i < end; i++ {
+			switch ch := r.buf[i]; {
+			case unicode.IsUpper(ch):
+				r.buf[i] = unicode.ToLower(ch)
+			case unicode.IsLower(ch):
+				r.buf[i] = unicode.ToUpper(ch)
+			}
+		}
+		r.idx = end
+		if r.idx == len(r.buf) {
+			r.idx--
+		}
+		success = true
 	})
+	return
 }
 
 func (r *RuneBuffer) Erase() {
 	r.Refresh(func() {
 		r.idx = 0
-		r.pushKill(r.buf[:])
+		r.pushKill(r.buf[:], killNone)
 		r.buf = r.buf[:0]
 	})
 }
@@ -209,27 +558,46 @@ func (r *RuneBuffer) Delete() (success bool) {
 			// 光标不在
 			return
 		}
-		// 将删除字符存储到r.lastKill中
-		r.pushKill(r.buf[r.idx : r.idx+1])
+		end := runes.NextCluster(r.buf, r.idx)
+		// 将删除字符存储到r.killRing中
+		r.pushKill(r.buf[r.idx:end], killForward)
 		// 从buf中移除被删除的字符
-		r.buf = append(r.buf[:r.idx], r.buf[r.idx+1:]...)
+		r.buf = append(r.buf[:r.idx], r.buf[end:]...)
 		success = true
 	})
 	return
 }
 
+// isWordBreak reports whether ch separates the words, see
+// Config.WordBreakFunc. A WORD (bigWord) is separated by spaces only, like
+// W in vim.
+func (r *RuneBuffer) isWordBreak(ch rune, bigWord bool) bool {
+	if bigWord {
+		return unicode.IsSpace(ch)
+	}
+	if r.cfg.WordBreakFunc != nil {
+		return r.cfg.WordBreakFunc(ch)
+	}
+	return IsWordBreak(ch)
+}
+
+// isWordStart reports whether a word starts at i.
+func (r *RuneBuffer) isWordStart(i int, bigWord bool) bool {
+	return !r.isWordBreak(r.buf[i], bigWord) && r.isWordBreak(r.buf[i-1], bigWord)
+}
+
 func (r *RuneBuffer) DeleteWord() {
 	if r.idx == len(r.buf) {
 		return
 	}
 	init := r.idx
-	for init < len(r.buf) && IsWordBreak(r.buf[init]) {
+	for init < len(r.buf) && r.isWordBreak(r.buf[init], false) {
 		init++
 	}
 	for i := init + 1; i < len(r.buf); i++ {
-		if !IsWordBreak(r.buf[i]) && IsWordBreak(r.buf[i-1]) {
-			r.pushKill(r.buf[r.idx : i-1])
+		if r.isWordStart(i, false) {
 			r.Refresh(func() {
+				r.pushKill(r.buf[r.idx:i-1], killForward)
 				r.buf = append(r.buf[:r.idx], r.buf[i-1:]...)
 			})
 			return
@@ -238,14 +606,118 @@ func (r *RuneBuffer) DeleteWord() {
 	r.Kill()
 }
 
+// DeleteInnerWord deletes the word under the cursor like "diw" of vim,
+// or the spaces if the cursor is between words. The punctuation runs are
+// words on their own.
+func (r *RuneBuffer) DeleteInnerWord() (success bool) {
+	r.Refresh(func() {
+		idx := r.idx
+		if idx == len(r.buf) {
+			idx--
+		}
+		if idx < 0 {
+			return
+		}
+		class := func(ch rune) int {
+			switch {
+			case unicode.IsSpace(ch):
+				return 0
+			case !r.isWordBreak(ch, false):
+				return 1
+			}
+			return 2
+		}
+		c := class(r.buf[idx])
+		start, end := idx, idx+1
+		for start > 0 && class(r.buf[start-1]) == c {
+			start--
+		}
+		for end < len(r.buf) && class(r.buf[end]) == c {
+			end++
+		}
+		r.deleteRange(start, end)
+		success = true
+	})
+	return
+}
+
+// DeleteInnerQuote deletes the text between the pair of quotes around the
+// cursor, or the next pair after it, like `di"` of vim. The quotes are
+// paired from the beginning of the line.
+func (r *RuneBuffer) DeleteInnerQuote(quote rune) (success bool) {
+	r.Refresh(func() {
+		lineStart, lineEnd := r.lineBounds(r.idx)
+		open := -1
+		for i := lineStart; i < lineEnd; i++ {
+			if r.buf[i] != quote {
+				continue
+			}
+			if open < 0 {
+				open = i
+				continue
+			}
+			if i >= r.idx {
+				r.deleteRange(open+1, i)
+				success = true
+				return
+			}
+			open = -1
+		}
+	})
+	return
+}
+
+// repeatKill calls f n times in one Refresh, the texts killed by the calls
+// are merged into one item of the kill ring, i.e. for "3x" of vim.
+func (r *RuneBuffer) repeatKill(n int, f func()) {
+	r.repeat(n, func() {
+		f()
+		r.Lock()
+		r.killRing.chain()
+		r.Unlock()
+	})
+}
+
+// repeat calls f n times and redraws the line once, i.e. for a count of
+// vim. The calls of Refresh by f don't draw.
+func (r *RuneBuffer) repeat(n int, f func()) {
+	r.Lock()
+	r.clean()
+	r.repeating = true
+	r.Unlock()
+	for i := 0; i < n; i++ {
+		f()
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.repeating = false
+	if r.interactive {
+		r.print()
+	}
+}
+
+// deleteRange moves buf[start:end] to the kill ring, it's called with the
+// lock held.
+func (r *RuneBuffer) deleteRange(start, end int) {
+	r.pushKill(r.buf[start:end], killNone)
+	r.buf = append(r.buf[:start], r.buf[end:]...)
+	r.idx = start
+}
+
 func (r *RuneBuffer) MoveToPrevWord() (success bool) {
+	return r.MoveWordBackward(false)
+}
+
+// MoveWordBackward moves the cursor to the start of the previous word, or
+// WORD if bigWord is true.
+func (r *RuneBuffer) MoveWordBackward(bigWord bool) (success bool) {
 	r.Refresh(func() {
 		if r.idx == 0 {
 			return
 		}
 
 		for i := r.idx - 1; i > 0; i-- {
-			if !IsWordBreak(r.buf[i]) && IsWordBreak(r.buf[i-1]) {
+			if r.isWordStart(i, bigWord) {
 				r.idx = i
 				success = true
 				return
@@ -264,7 +736,7 @@ func (r *RuneBuffer) KillFront() {
 		}
 
 		length := len(r.buf) - r.idx
-		r.pushKill(r.buf[:r.idx])
+		r.pushKill(r.buf[:r.idx], killBackward)
 		copy(r.buf[:length], r.buf[r.idx:])
 		r.idx = 0
 		r.buf = r.buf[:length]
@@ -273,7 +745,7 @@ func (r *RuneBuffer) KillFront() {
 
 func (r *RuneBuffer) Kill() {
 	r.Refresh(func() {
-		r.pushKill(r.buf[r.idx:])
+		r.pushKill(r.buf[r.idx:], killForward)
 		r.buf = r.buf[:r.idx]
 	})
 }
@@ -299,9 +771,15 @@ func (r *RuneBuffer) Transpose() {
 }
 
 func (r *RuneBuffer) MoveToNextWord() {
+	r.MoveWordForward(false)
+}
+
+// MoveWordForward moves the cursor to the start of the next word, or WORD
+// if bigWord is true.
+func (r *RuneBuffer) MoveWordForward(bigWord bool) {
 	r.Refresh(func() {
 		for i := r.idx + 1; i < len(r.buf); i++ {
-			if !IsWordBreak(r.buf[i]) && IsWordBreak(r.buf[i-1]) {
+			if r.isWordStart(i, bigWord) {
 				r.idx = i
 				return
 			}
@@ -312,19 +790,26 @@ func (r *RuneBuffer) MoveToNextWord() {
 }
 
 func (r *RuneBuffer) MoveToEndWord() {
+	r.MoveToEndOfWord(false)
+}
+
+// MoveToEndOfWord moves the cursor to the end of the word, or WORD if
+// bigWord is true.
+func (r *RuneBuffer) MoveToEndOfWord(bigWord bool) {
 	r.Refresh(func() {
 		// already at the end, so do nothing
 		if r.idx == len(r.buf) {
 			return
 		}
 		// if we are at the end of a word already, go to next
-		if !IsWordBreak(r.buf[r.idx]) && IsWordBreak(r.buf[r.idx+1]) {
+		if r.idx+1 < len(r.buf) &&
+			!r.isWordBreak(r.buf[r.idx], bigWord) && r.isWordBreak(r.buf[r.idx+1], bigWord) {
 			r.idx++
 		}
 
 		// keep going until at the end of a word
 		for i := r.idx + 1; i < len(r.buf); i++ {
-			if IsWordBreak(r.buf[i]) && !IsWordBreak(r.buf[i-1]) {
+			if r.isWordBreak(r.buf[i], bigWord) && !r.isWordBreak(r.buf[i-1], bigWord) {
 				r.idx = i - 1
 				return
 			}
@@ -339,41 +824,65 @@ func (r *RuneBuffer) BackEscapeWord() {
 			return
 		}
 		for i := r.idx - 1; i > 0; i-- {
-			if !IsWordBreak(r.buf[i]) && IsWordBreak(r.buf[i-1]) {
-				r.pushKill(r.buf[i:r.idx])
+			if r.isWordStart(i, false) {
+				r.pushKill(r.buf[i:r.idx], killBackward)
 				r.buf = append(r.buf[:i], r.buf[r.idx:]...)
 				r.idx = i
 				return
 			}
 		}
 
-		r.buf = r.buf[:0]
+		// the text after the cursor is kept
+		r.pushKill(r.buf[:r.idx], killBackward)
+		r.buf = append(r.buf[:0], r.buf[r.idx:]...)
 		r.idx = 0
 	})
 }
 
 func (r *RuneBuffer) Yank() {
-	if len(r.lastKill) == 0 {
-		return
-	}
 	r.Refresh(func() {
-		buf := make([]rune, 0, len(r.buf)+len(r.lastKill))
+		text := r.killRing.yank()
+		buf := make([]rune, 0, len(r.buf)+len(text))
 		buf = append(buf, r.buf[:r.idx]...)
-		buf = append(buf, r.lastKill...)
+		buf = append(buf, text...)
 		buf = append(buf, r.buf[r.idx:]...)
 		r.buf = buf
-		r.idx += len(r.lastKill)
+		r.idx += len(text)
 	})
 }
 
+// YankPop replaces the text just yanked by the previous killed one, it
+// returns false if the previous key is not Ctrl+Y or Meta+Y.
+func (r *RuneBuffer) YankPop() (success bool) {
+	r.Refresh(func() {
+		start := r.idx - r.killRing.yankLen
+		if start < 0 {
+			return
+		}
+		text, ok := r.killRing.yankPop()
+		if !ok {
+			return
+		}
+		buf := make([]rune, 0, len(r.buf)+len(text))
+		buf = append(buf, r.buf[:start]...)
+		buf = append(buf, text...)
+		buf = append(buf, r.buf[r.idx:]...)
+		r.buf = buf
+		r.idx = start + len(text)
+		success = true
+	})
+	return
+}
+
 func (r *RuneBuffer) Backspace() {
 	r.Refresh(func() {
 		if r.idx == 0 {
 			return
 		}
 
-		r.idx--
-		r.buf = append(r.buf[:r.idx], r.buf[r.idx+1:]...)
+		start := runes.PrevCluster(r.buf, r.idx)
+		r.buf = append(r.buf[:start], r.buf[r.idx:]...)
+		r.idx = start
 	})
 }
 
@@ -387,13 +896,84 @@ func (r *RuneBuffer) MoveToLineEnd() {
 	})
 }
 
+// lineBounds returns the start and the end of the line at idx of a
+// multi-line input, the end is the index of '\n' or len(r.buf).
+func (r *RuneBuffer) lineBounds(idx int) (start, end int) {
+	start, end = idx, idx
+	for start > 0 && r.buf[start-1] != '\n' {
+		start--
+	}
+	for end < len(r.buf) && r.buf[end] != '\n' {
+		end++
+	}
+	return start, end
+}
+
+// MoveToLogicalLineStart moves the cursor to the start of its line of a
+// multi-line input, which is the start of the input for a single line.
+func (r *RuneBuffer) MoveToLogicalLineStart() {
+	r.Refresh(func() {
+		r.idx, _ = r.lineBounds(r.idx)
+	})
+}
+
+// MoveToLogicalLineEnd moves the cursor to the end of its line of a
+// multi-line input.
+func (r *RuneBuffer) MoveToLogicalLineEnd() {
+	r.Refresh(func() {
+		_, r.idx = r.lineBounds(r.idx)
+	})
+}
+
+// MoveLineUp moves the cursor to the previous line of a multi-line input,
+// keeping the column as possible. It returns false on the first line.
+func (r *RuneBuffer) MoveLineUp() (success bool) {
+	r.Refresh(func() {
+		start, _ := r.lineBounds(r.idx)
+		if start == 0 {
+			return
+		}
+		prev, _ := r.lineBounds(start - 1)
+		r.idx = r.columnIdx(prev, start-1, r.widthAll(r.buf[start:r.idx]))
+		success = true
+	})
+	return
+}
+
+// MoveLineDown moves the cursor to the next line of a multi-line input,
+// keeping the column as possible. It returns false on the last line.
+func (r *RuneBuffer) MoveLineDown() (success bool) {
+	r.Refresh(func() {
+		start, end := r.lineBounds(r.idx)
+		if end == len(r.buf) {
+			return
+		}
+		_, next := r.lineBounds(end + 1)
+		r.idx = r.columnIdx(end+1, next, r.widthAll(r.buf[start:r.idx]))
+		success = true
+	})
+	return
+}
+
+// columnIdx returns the index in r.buf[start:end] which is at most width
+// wide from start.
+func (r *RuneBuffer) columnIdx(start, end, width int) int {
+	idx := start
+	for idx < end && r.widthAll(r.buf[start:idx+1]) <= width {
+		idx++
+	}
+	return idx
+}
+
 // LineCount prompt和其后的输入占屏幕多少行
 func (r *RuneBuffer) LineCount(width int) int {
+	r.Lock()
+	defer r.Unlock()
 	if width == -1 {
 		width = r.width
 	}
-	return LineCount(width,
-		runes.WidthAll(r.buf)+r.PromptLen())
+	line, _ := r.position(r.buf, width)
+	return line + 1
 }
 
 func (r *RuneBuffer) MoveTo(ch rune, prevChar, reverse bool) (success bool) {
@@ -429,12 +1009,41 @@ func (r *RuneBuffer) isInLineEdge() bool {
 	if isWindows {
 		return false
 	}
-	sp := r.getSplitByLine(r.buf)
-	return len(sp[len(sp)-1]) == 0
+	if len(r.buf) == 0 || r.buf[len(r.buf)-1] == '\n' || r.width == 0 {
+		return false
+	}
+	_, col := r.position(r.buf, r.width)
+	return col == 0
 }
 
-func (r *RuneBuffer) getSplitByLine(rs []rune) []string {
-	return SplitByLine(r.promptLen(), r.width, rs)
+// screenPos returns the line, counted from the first line of the input,
+// and the column where the rune at idx is drawn.
+func (r *RuneBuffer) screenPos(idx int) (line, col int) {
+	return r.position(r.buf[:idx], r.width)
+}
+
+// MoveToScreenPos moves the cursor to the rune drawn at the 0-based col of
+// the line which is dy lines below the cursor, i.e. where the mouse is
+// clicked. It returns false if there is no input there.
+func (r *RuneBuffer) MoveToScreenPos(dy, col int) (success bool) {
+	r.Refresh(func() {
+		if r.width == 0 {
+			return
+		}
+		line, _ := r.screenPos(r.idx)
+		line += dy
+		for i := 0; i <= len(r.buf); i++ {
+			l, c := r.screenPos(i)
+			if l > line {
+				break
+			}
+			if l == line && c <= col {
+				r.idx = i
+				success = true
+			}
+		}
+	})
+	return
 }
 
 // IdxLine prompt到光标位置的字符串占屏幕的行数-1
@@ -449,8 +1058,24 @@ func (r *RuneBuffer) idxLine(width int) int {
 	if width == 0 {
 		return 0
 	}
-	sp := r.getSplitByLine(r.buf[:r.idx])
-	return len(sp) - 1
+	line, _ := r.position(r.buf[:r.idx], width)
+	return line
+}
+
+// CursorColumn returns the screen column of the cursor, counted from 0.
+func (r *RuneBuffer) CursorColumn() int {
+	r.Lock()
+	defer r.Unlock()
+	_, col := r.screenPos(r.idx)
+	return col
+}
+
+// CursorLine returns the line of the cursor, counted from the first line
+// of the prompt.
+func (r *RuneBuffer) CursorLine() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.promptLineCount() + r.idxLine(r.width)
 }
 
 // CursorLineCount 背景：prompt与其后的输入形成的行数
@@ -467,7 +1092,7 @@ func (r *RuneBuffer) Refresh(f func()) {
 
 	// 非交互模式，即输入r中存储的输入内容并不会显示在目标输出中。
 	// 这种情况下只需执行操作r.buf的函数。不必清空输入在终端上产生的记录。
-	if !r.interactive {
+	if !r.interactive || r.repeating {
 		if f != nil {
 			f()
 		}
@@ -497,29 +1122,49 @@ func (r *RuneBuffer) print() {
 func (r *RuneBuffer) output() []byte {
 	buf := bytes.NewBuffer(nil)
 	buf.WriteString(string(r.prompt))
+	r.writeRightPrompt(buf)
 	if r.cfg.EnableMask && len(r.buf) > 0 {
-		buf.Write([]byte(strings.Repeat(string(r.cfg.MaskRune), len(r.buf)-1)))
-		if r.buf[len(r.buf)-1] == '\n' {
-			buf.Write([]byte{'\n'})
-		} else {
-			buf.Write([]byte(string(r.cfg.MaskRune)))
-		}
-		if len(r.buf) > r.idx {
-			buf.Write(r.getBackspaceSequence())
+		for _, e := range r.buf {
+			if e == '\n' {
+				r.writeNewline(buf)
+			} else {
+				buf.WriteRune(r.cfg.MaskRune)
+			}
 		}
-
 	} else {
-		for _, e := range r.cfg.Painter.Paint(r.buf, r.idx) {
-			if e == '\t' {
-				buf.WriteString(strings.Repeat(" ", TabWidth))
-			} else {
+		// the column of the painted runes, to expand the tabs
+		col := r.promptLen()
+		inEscape := false
+		painted := r.cfg.Painter.Paint(r.buf, r.idx)
+		for i, e := range painted {
+			switch {
+			case inEscape:
+				// the escape sequence ends with a letter, i.e. "\033[31m"
+				inEscape = e == '[' || e < 0x40 || e > 0x7e
+				buf.WriteRune(e)
+			case e == '\033':
+				inEscape = true
 				buf.WriteRune(e)
+			case e == '\t':
+				n := tabAdvance(col, r.cfg.TabWidth)
+				buf.WriteString(strings.Repeat(" ", n))
+				col += n
+			case e == '\n':
+				r.writeNewline(buf)
+				col = r.contPromptLen()
+			default:
+				buf.WriteRune(e)
+				col += r.widthAt(painted, i)
+			}
+			if r.width > 0 && col >= r.width {
+				col %= r.width
 			}
 		}
 		if r.isInLineEdge() {
 			buf.Write([]byte(" \b"))
 		}
 	}
+	r.writeStatusLine(buf)
 	// cursor position
 	if len(r.buf) > r.idx {
 		buf.Write(r.getBackspaceSequence())
@@ -527,34 +1172,178 @@ func (r *RuneBuffer) output() []byte {
 	return buf.Bytes()
 }
 
-func (r *RuneBuffer) getBackspaceSequence() []byte {
-	var sep = map[int]bool{}
-
-	var i int
-	for {
-		if i >= runes.WidthAll(r.buf) {
-			break
+// writeRightPrompt draws Config.RightPrompt flush right on the first line
+// of the input if there is room, the cursor must be after the prompt and is
+// moved back there.
+func (r *RuneBuffer) writeRightPrompt(buf *bytes.Buffer) {
+	if r.width == 0 {
+		return
+	}
+	var rp []rune
+	if r.cfg.RightPrompt != nil {
+		rp = r.cfg.RightPrompt()
+	}
+	if len(r.modeIndicator) > 0 {
+		if len(rp) > 0 {
+			rp = append(append(runes.Copy(r.modeIndicator), ' '), rp...)
+		} else {
+			rp = r.modeIndicator
 		}
+	}
+	// the last column is left empty to avoid the wrapping
+	start := r.width - 1 - r.widthAll(runes.ColorFilter(rp))
+	_, end := r.lineBounds(0)
+	// it's hidden once the input reaches it, a space is left between them
+	if line, col := r.position(r.buf[:end], r.width); line > 0 || col >= start || len(rp) == 0 {
+		return
+	}
+	promptLen := r.promptLen()
+	buf.WriteString("\033[" + strconv.Itoa(start-promptLen) + "C")
+	buf.WriteString(string(rp))
+	buf.WriteString("\033[0m\r")
+	if promptLen > 0 {
+		buf.WriteString("\033[" + strconv.Itoa(promptLen) + "C")
+	}
+}
 
-		if i == 0 {
-			i -= r.promptLen()
-		}
-		i += r.width
+// writeNewline starts the next line of the input by the continuation prompt.
+func (r *RuneBuffer) writeNewline(buf *bytes.Buffer) {
+	buf.WriteString("\r\n")
+	buf.WriteString(r.cfg.ContinuationPrompt)
+}
+
+// writeStatusLine draws the status line below the input, the cursor must be
+// at the end of the input and is moved back there.
+func (r *RuneBuffer) writeStatusLine(buf *bytes.Buffer) {
+	status := r.statusLine
+	if len(status) == 0 && len(r.hint) > 0 {
+		status = append([]rune("\033[2m"), r.hint...)
+	}
+	if len(status) == 0 || r.width == 0 {
+		return
+	}
+	if r.widthAll(runes.ColorFilter(status)) >= r.width {
+		status = runes.TruncateToWidth(runes.ColorFilter(status), r.width-1)
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(string(status))
+	buf.WriteString("\033[0m\033[A\r")
 
-		sep[i] = true
+	_, col := r.position(r.buf, r.width)
+	if col > 0 {
+		buf.WriteString("\033[" + strconv.Itoa(col) + "C")
 	}
-	var buf []byte
-	for i := len(r.buf); i > r.idx; i-- {
-		// move input to the left of one
-		buf = append(buf, '\b')
-		if sep[i] {
-			// up one line, go to the start of the line and move cursor right to the end (r.width)
-			buf = append(buf, "\033[A\r"+"\033["+strconv.Itoa(r.width)+"C"...)
+}
+
+// SetStatusLine sets the line drawn below the input, an empty s removes it.
+func (r *RuneBuffer) SetStatusLine(s string) {
+	r.Refresh(func() {
+		r.setStatusLine(s)
+	})
+}
+
+func (r *RuneBuffer) setStatusLine(s string) {
+	r.statusLine = nil
+	if s != "" {
+		// only the first line is shown
+		if idx := strings.IndexByte(s, '\n'); idx >= 0 {
+			s = s[:idx]
 		}
+		r.statusLine = []rune(s)
 	}
+}
 
-	return buf
+func (r *RuneBuffer) StatusLine() string {
+	r.Lock()
+	defer r.Unlock()
+	return string(r.statusLine)
+}
 
+// ClearStatusLine removes the status line and the hint without redrawing,
+// they will be erased by the next refresh.
+func (r *RuneBuffer) ClearStatusLine() {
+	r.Lock()
+	r.statusLine = nil
+	r.hint = nil
+	r.Unlock()
+}
+
+// StatusLineCount returns how many lines the status line takes.
+func (r *RuneBuffer) StatusLineCount() int {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.statusLine) == 0 && len(r.hint) == 0 || r.width == 0 {
+		return 0
+	}
+	return 1
+}
+
+// SetHint sets the hint drawn below the input, the line is redrawn only if
+// it's changed, which is reported.
+func (r *RuneBuffer) SetHint(hint []rune) bool {
+	if idx := runes.Index('\n', hint); idx >= 0 {
+		hint = hint[:idx]
+	}
+	r.Lock()
+	changed := !runes.Equal(r.hint, hint)
+	r.Unlock()
+	if changed {
+		r.Refresh(func() {
+			r.hint = runes.Copy(hint)
+		})
+	}
+	return changed
+}
+
+// setModeIndicator sets the text drawn before Config.RightPrompt, it
+// returns false if it's not changed.
+func (r *RuneBuffer) setModeIndicator(indicator []rune) bool {
+	r.Lock()
+	defer r.Unlock()
+	if runes.Equal(r.modeIndicator, indicator) {
+		return false
+	}
+	r.modeIndicator = runes.Copy(indicator)
+	return true
+}
+
+// getBackspaceSequence moves the cursor from the end of the input back to
+// r.idx.
+func (r *RuneBuffer) getBackspaceSequence() []byte {
+	if r.width == 0 {
+		if tail := r.buf[r.idx:]; runes.Index('\t', tail) < 0 || runes.Index('\n', tail) >= 0 {
+			return bytes.Repeat([]byte{'\b'}, r.widthAll(tail))
+		}
+		// the width of the tabs depends on where they are drawn
+		_, endCol := r.position(r.buf, 0)
+		_, col := r.position(r.buf[:r.idx], 0)
+		return bytes.Repeat([]byte{'\b'}, endCol-col)
+	}
+	endLine, endCol := r.position(r.buf, r.width)
+	line, col := r.position(r.buf[:r.idx], r.width)
+	if line == endLine {
+		return bytes.Repeat([]byte{'\b'}, endCol-col)
+	}
+	buf := bytes.NewBufferString("\033[" + strconv.Itoa(endLine-line) + "A\r")
+	if col > 0 {
+		buf.WriteString("\033[" + strconv.Itoa(col) + "C")
+	}
+	return buf.Bytes()
+}
+
+// Submit moves the cursor to the end of the input and prints s and a
+// newline after it, then the buffer is reset and the input is returned.
+func (r *RuneBuffer) Submit(s string) []rune {
+	r.Refresh(func() {
+		r.idx = len(r.buf)
+	})
+	r.Lock()
+	defer r.Unlock()
+	// the cursor is already on the next line
+	if r.interactive && (s != "" || !r.isInLineEdge()) {
+		io.WriteString(r.w, s+"\n")
+	}
+	return r.Reset()
 }
 
 func (r *RuneBuffer) Reset() []rune {
@@ -566,9 +1355,9 @@ func (r *RuneBuffer) Reset() []rune {
 
 func (r *RuneBuffer) calWidth(m int) int {
 	if m > 0 {
-		return runes.WidthAll(r.buf[r.idx : r.idx+m])
+		return r.widthAll(r.buf[r.idx : r.idx+m])
 	}
-	return runes.WidthAll(r.buf[r.idx+m : r.idx])
+	return r.widthAll(r.buf[r.idx+m : r.idx])
 }
 
 func (r *RuneBuffer) SetStyle(start, end int, style string) {
@@ -602,10 +1391,14 @@ func (r *RuneBuffer) Set(buf []rune) {
 
 func (r *RuneBuffer) SetPrompt(prompt string) {
 	r.Lock()
-	r.prompt = []rune(prompt)
+	r.setPrompt(prompt)
 	r.Unlock()
 }
 
+func (r *RuneBuffer) setPrompt(prompt string) {
+	r.prompt = []rune(prompt)
+}
+
 // 将prompt和prompt之后在屏幕中的输入都清空。
 //
 // 参数：
@@ -653,5 +1446,5 @@ func (r *RuneBuffer) cleanWithIdxLine(idxLine int) {
 		return
 	}
 	r.hadClean = true
-	r.cleanOutput(r.w, idxLine)
+	r.cleanOutput(r.w, idxLine+r.promptLineCount())
 }
@@ -7,8 +7,21 @@ import (
 )
 
 var runes = Runes{}
+
+// TabWidth is the width of a tab for Runes.Width, and the distance of the
+// tab stops of SplitByLine. They don't know the Config, the line being
+// edited is drawn by Config.TabWidth instead.
 var TabWidth = 4
 
+// DefaultTabWidth is the default Config.TabWidth
+const DefaultTabWidth = 8
+
+// tabAdvance returns how many columns a tab at col takes to reach the next
+// tab stop.
+func tabAdvance(col, tabWidth int) int {
+	return tabWidth - col%tabWidth
+}
+
 type Runes struct{}
 
 func (Runes) EqualRune(a, b rune, fold bool) bool {
@@ -141,8 +154,65 @@ var doubleWidth = []*unicode.RangeTable{
 	unicode.Hangul,
 	unicode.Hiragana,
 	unicode.Katakana,
+	emoji,
+}
+
+// emoji are the pictographs drawn in two cells by the terminals, the ones
+// of the BMP are those with the emoji presentation by default.
+var emoji = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x231a, 0x231b, 1},
+		{0x23e9, 0x23ec, 1},
+		{0x23f0, 0x23f3, 3},
+		{0x25fd, 0x25fe, 1},
+		{0x2614, 0x2615, 1},
+		{0x2648, 0x2653, 1},
+		{0x267f, 0x2693, 20},
+		{0x26a1, 0x26a1, 1},
+		{0x26aa, 0x26ab, 1},
+		{0x26bd, 0x26be, 1},
+		{0x26c4, 0x26c5, 1},
+		{0x26ce, 0x26d4, 6},
+		{0x26ea, 0x26ea, 1},
+		{0x26f2, 0x26f3, 1},
+		{0x26f5, 0x26fa, 5},
+		{0x26fd, 0x26fd, 1},
+		{0x2705, 0x2705, 1},
+		{0x270a, 0x270b, 1},
+		{0x2728, 0x2728, 1},
+		{0x274c, 0x274e, 2},
+		{0x2753, 0x2755, 1},
+		{0x2757, 0x2757, 1},
+		{0x2795, 0x2797, 1},
+		{0x27b0, 0x27bf, 15},
+		{0x2b1b, 0x2b1c, 1},
+		{0x2b50, 0x2b55, 5},
+	},
+	R32: []unicode.Range32{
+		{0x1f004, 0x1f004, 1},
+		{0x1f0cf, 0x1f0cf, 1},
+		{0x1f18e, 0x1f18e, 1},
+		{0x1f191, 0x1f19a, 1},
+		{0x1f300, 0x1f64f, 1},
+		{0x1f680, 0x1f6ff, 1},
+		{0x1f7e0, 0x1f7eb, 1},
+		{0x1f90c, 0x1f9ff, 1},
+		{0x1fa70, 0x1faff, 1},
+	},
 }
 
+const zeroWidthJoiner = '\u200d'
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func isEmojiModifier(r rune) bool {
+	return r >= 0x1f3fb && r <= 0x1f3ff
+}
+
+// Width returns the cells taken by r alone, see WidthAt for the runes in
+// a grapheme cluster.
 func (Runes) Width(r rune) int {
 	if r == '\t' {
 		return TabWidth
@@ -156,13 +226,114 @@ func (Runes) Width(r rune) int {
 	return 1
 }
 
-func (Runes) WidthAll(r []rune) (length int) {
+// IsClusterBoundary reports whether a grapheme cluster starts at r[i], that
+// is the cursor may stop before it. The marks, the zero width joiner and
+// the runes it joins, the skin tone modifiers and the regional indicators
+// of a flag stay with the runes before them.
+func (Runes) IsClusterBoundary(r []rune, i int) bool {
+	if i <= 0 || i >= len(r) {
+		return true
+	}
+	prev, c := r[i-1], r[i]
+	switch {
+	case prev == '\r' && c == '\n':
+		return false
+	case unicode.Is(unicode.Cc, prev) || unicode.Is(unicode.Cc, c):
+		return true
+	case c == zeroWidthJoiner || unicode.In(c, unicode.Mn, unicode.Me, unicode.Mc):
+		return false
+	// the tags of the subdivision flags
+	case c >= 0xe0020 && c <= 0xe007f:
+		return false
+	case prev == zeroWidthJoiner:
+		return false
+	case isEmojiModifier(c) && unicode.Is(emoji, prev):
+		return false
+	case isRegionalIndicator(prev) && isRegionalIndicator(c):
+		n := 0
+		for j := i - 1; j >= 0 && isRegionalIndicator(r[j]); j-- {
+			n++
+		}
+		return n%2 == 0
+	}
+	return true
+}
+
+// NextCluster returns the index of the grapheme cluster after the one at
+// r[i], or len(r).
+func (rs Runes) NextCluster(r []rune, i int) int {
+	if i >= len(r) {
+		return len(r)
+	}
+	i++
+	for !rs.IsClusterBoundary(r, i) {
+		i++
+	}
+	return i
+}
+
+// PrevCluster returns the index of the grapheme cluster before r[i], or 0.
+func (rs Runes) PrevCluster(r []rune, i int) int {
+	if i <= 0 {
+		return 0
+	}
+	i--
+	for !rs.IsClusterBoundary(r, i) {
+		i--
+	}
+	return i
+}
+
+// WidthAt returns the cells taken by rs[i] after the runes before it, so
+// that an emoji sequence is drawn as a single wide cell: the runes joined
+// by a zero width joiner, the skin tone modifiers and the second regional
+// indicator of a flag take no cells.
+func (rs Runes) WidthAt(r []rune, i int) int {
+	c := r[i]
+	if i > 0 {
+		prev := r[i-1]
+		if prev == zeroWidthJoiner && rs.Width(c) > 0 {
+			return 0
+		}
+		if isEmojiModifier(c) && unicode.Is(emoji, prev) {
+			return 0
+		}
+	}
+	if isRegionalIndicator(c) {
+		n := 0
+		for j := i - 1; j >= 0 && isRegionalIndicator(r[j]); j-- {
+			n++
+		}
+		if n%2 == 1 {
+			return 0
+		}
+		return 2
+	}
+	return rs.Width(c)
+}
+
+func (rs Runes) WidthAll(r []rune) (length int) {
 	for i := 0; i < len(r); i++ {
-		length += runes.Width(r[i])
+		length += rs.WidthAt(r, i)
 	}
 	return
 }
 
+// TruncateToWidth returns the longest prefix of r whose display width is
+// not greater than width. A wide rune which doesn't fit is dropped as a
+// whole, and the zero width runes following a kept rune (i.e. combining
+// marks) are kept with it.
+func (Runes) TruncateToWidth(r []rune, width int) []rune {
+	w := 0
+	for i := 0; i < len(r); i++ {
+		w += runes.WidthAt(r, i)
+		if w > width {
+			return r[:i]
+		}
+	}
+	return r
+}
+
 func (Runes) Backspace(r []rune) []byte {
 	return bytes.Repeat([]byte{'\b'}, runes.WidthAll(r))
 }
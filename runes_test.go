@@ -16,6 +16,16 @@ func TestRuneWidth(t *testing.T) {
 		{[]rune("a"), 1},
 		{[]rune("你"), 2},
 		{runes.ColorFilter([]rune("☭\033[13;1m你")), 3},
+		// combining marks
+		{[]rune("e\u0301"), 1},
+		{[]rune("\u0645\u064e"), 1},
+		// emoji sequences
+		{[]rune("😀"), 2},
+		{[]rune("👨\u200d👩\u200d👧"), 2},
+		{[]rune("👍\U0001f3fd"), 2},
+		{[]rune("❤\ufe0f"), 1},
+		// flags
+		{[]rune("\U0001f1fa\U0001f1f8\U0001f1ec\U0001f1e7"), 4},
 	}
 	for _, r := range rs {
 		if w := runes.WidthAll(r.r); w != r.length {
@@ -66,3 +76,67 @@ func TestAggRunes(t *testing.T) {
 		}
 	}
 }
+
+func TestTruncateToWidth(t *testing.T) {
+	rs := []struct {
+		r     string
+		width int
+		e     string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 3, "abc"},
+		{"abc", 2, "ab"},
+		{"abc", 0, ""},
+		{"a你好", 2, "a"},
+		{"a你好", 3, "a你"},
+		{"你好b", 1, ""},
+		{"你好b", 4, "你好"},
+		{"e\u0301x", 1, "e\u0301"},
+		{"你\u0301好", 2, "你\u0301"},
+		// the emoji sequence is kept as a whole
+		{"👨\u200d👩x", 2, "👨\u200d👩"},
+		{"👨\u200d👩x", 1, ""},
+	}
+	for _, r := range rs {
+		ret := string(runes.TruncateToWidth([]rune(r.r), r.width))
+		if ret != r.e {
+			t.Fatalf("truncate %q to %v: want %q, got %q", r.r, r.width, r.e, ret)
+		}
+	}
+}
+
+func TestClusterBoundary(t *testing.T) {
+	rs := []struct {
+		r        string
+		clusters []string
+	}{
+		{"ab", []string{"a", "b"}},
+		{"e\u0301x", []string{"e\u0301", "x"}},
+		{"👩‍👩‍👧‍👦!", []string{"👩‍👩‍👧‍👦", "!"}},
+		{"👍\U0001f3fd👍", []string{"👍\U0001f3fd", "👍"}},
+		{"❤\ufe0fa", []string{"❤\ufe0f", "a"}},
+		{"\U0001f1fa\U0001f1f8\U0001f1ec\U0001f1e7\U0001f1fa", []string{"\U0001f1fa\U0001f1f8", "\U0001f1ec\U0001f1e7", "\U0001f1fa"}},
+		{"a\r\nb", []string{"a", "\r\n", "b"}},
+	}
+	for _, r := range rs {
+		rr := []rune(r.r)
+		var clusters []string
+		for i := 0; i < len(rr); {
+			next := runes.NextCluster(rr, i)
+			clusters = append(clusters, string(rr[i:next]))
+			i = next
+		}
+		if !reflect.DeepEqual(clusters, r.clusters) {
+			t.Fatalf("clusters of %q: want %q, got %q", r.r, r.clusters, clusters)
+		}
+		var back []string
+		for i := len(rr); i > 0; {
+			prev := runes.PrevCluster(rr, i)
+			back = append([]string{string(rr[prev:i])}, back...)
+			i = prev
+		}
+		if !reflect.DeepEqual(back, r.clusters) {
+			t.Fatalf("clusters of %q backward: want %q, got %q", r.r, r.clusters, back)
+		}
+	}
+}
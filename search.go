@@ -12,11 +12,35 @@ const (
 	S_STATE_FAILING
 )
 
+// SearchDirection is the direction of the incremental history search given
+// to Config.SearchPromptFunc, S_DIR_BCK or S_DIR_FWD.
+type SearchDirection int
+
 const (
 	S_DIR_BCK = iota
 	S_DIR_FWD
 )
 
+func (d SearchDirection) String() string {
+	if d == S_DIR_FWD {
+		return "fwd"
+	}
+	return "bck"
+}
+
+// defaultSearchPrompt is the bash style label, i.e. "failing bck-i-search: foo"
+func (c *Config) defaultSearchPrompt(query string, dir SearchDirection, matchIndex, matchCount int, failed bool) string {
+	key := MsgSearchBackward
+	if dir == S_DIR_FWD {
+		key = MsgSearchForward
+	}
+	prompt := c.translate(key, query)
+	if failed {
+		prompt = c.translate(MsgSearchFailing, prompt)
+	}
+	return prompt
+}
+
 type opSearch struct {
 	inMode    bool
 	state     int
@@ -77,7 +101,8 @@ func (o *opSearch) search(isChange bool) bool {
 	}
 	o.history.current = elem
 
-	item := o.history.showItem(o.history.current.Value)
+	// copy it, the edits in the buffer must not be written back to history
+	item := runes.Copy(o.history.showItem(o.history.current.Value))
 	start, end := 0, 0
 	if o.dir == S_DIR_BCK {
 		start, end = idx, idx+len(o.data)
@@ -114,8 +139,12 @@ func (o *opSearch) SearchMode(dir int) bool {
 
 func (o *opSearch) ExitSearchMode(revert bool) {
 	if revert {
+		if !o.history.contains(o.source) {
+			// dropped by Config.HistoryLimit while searching
+			o.source = o.history.history.Back()
+		}
 		o.history.current = o.source
-		o.buf.Set(o.history.showItem(o.history.current.Value))
+		o.buf.Set(runes.Copy(o.history.showItem(o.history.current.Value)))
 	}
 	o.markStart, o.markEnd = 0, 0
 	o.state = S_STATE_FOUND
@@ -141,20 +170,23 @@ func (o *opSearch) SearchRefresh(x int) {
 		o.buf.SetStyle(o.markStart, o.markEnd, "4")
 	}
 
-	lineCnt := o.buf.CursorLineCount()
+	lineCnt := o.buf.CursorLineCount() + o.buf.StatusLineCount()
 	buf := bytes.NewBuffer(nil)
 	buf.Write(bytes.Repeat([]byte("\n"), lineCnt))
 	buf.WriteString("\033[J")
-	if o.state == S_STATE_FAILING {
-		buf.WriteString("failing ")
+	promptFunc := o.cfg.SearchPromptFunc
+	if promptFunc == nil {
+		promptFunc = o.cfg.defaultSearchPrompt
 	}
-	if o.dir == S_DIR_BCK {
-		buf.WriteString("bck")
-	} else if o.dir == S_DIR_FWD {
-		buf.WriteString("fwd")
+	failed := o.state == S_STATE_FAILING
+	matchIndex, matchCount := 0, 0
+	if len(o.data) > 0 {
+		matchIndex, matchCount = o.history.countMatches(o.data, o.history.current)
+		if failed {
+			matchIndex = 0
+		}
 	}
-	buf.WriteString("-i-search: ")
-	buf.WriteString(string(o.data))         // keyword
+	buf.WriteString(promptFunc(string(o.data), SearchDirection(o.dir), matchIndex, matchCount, failed))
 	buf.WriteString("\033[4m \033[0m")      // _
 	fmt.Fprintf(buf, "\r\033[%dA", lineCnt) // move prev
 	if x > 0 {
@@ -7,6 +7,8 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 type Terminal struct {
@@ -18,9 +20,44 @@ type Terminal struct {
 	kickChan  chan struct{}
 	wg        sync.WaitGroup
 	isReading int32
-	sleeping  int32
+	// set to 1 by StopRead, the loop stops after the key being read.
+	stopRead int32
+	sleeping int32
+	// set to 1 once the cursor shape is changed, so we can restore it on Close.
+	cursorShaped int32
+	// set to 1 while the bracketed paste mode is enabled.
+	bracketedPaste int32
+	// set to 1 while the mouse reporting is enabled.
+	mouse int32
+	// how many times EnterRawMode is called without ExitRawMode, so
+	// ReadChar can be called while reading a line.
+	rawDepth int32
+
+	// the next rune goes to charChan rather than outchan while ReadChar
+	// is waiting.
+	charM       sync.Mutex
+	charReading int32
+	charChan    chan rune
+	// the rune received from pauseChan rather than outchan stops the loop
+	// until the next read, see ReadRuneAndPause.
+	pauseChan chan rune
+
+	// the runes given by FeedRunes, feedloop sends them to outchan.
+	feedM    sync.Mutex
+	feed     []rune
+	feedChan chan struct{}
+	// the runes given by UnreadRunes, they're sent before reading stdin
+	// once the read is kicked.
+	unread   []rune
+	feedDone chan struct{}
+	// closed once the ioloop exits, outchan is closed after the feedloop
+	// returns.
+	ioDone chan struct{}
 
 	sizeChan chan string
+
+	// the reader returned by Config.OnEOF, it replaces Config.Stdin
+	stdin io.Reader
 }
 
 func NewTerminal(cfg *Config) (*Terminal, error) {
@@ -28,13 +65,19 @@ func NewTerminal(cfg *Config) (*Terminal, error) {
 		return nil, err
 	}
 	t := &Terminal{
-		cfg:      cfg,
-		kickChan: make(chan struct{}, 1),
-		outchan:  make(chan rune),
-		stopChan: make(chan struct{}, 1),
-		sizeChan: make(chan string, 1),
+		cfg:       cfg,
+		kickChan:  make(chan struct{}, 1),
+		outchan:   make(chan rune),
+		stopChan:  make(chan struct{}, 1),
+		sizeChan:  make(chan string, 1),
+		charChan:  make(chan rune),
+		pauseChan: make(chan rune),
+		feedChan:  make(chan struct{}, 1),
+		feedDone:  make(chan struct{}),
+		ioDone:    make(chan struct{}),
 	}
 
+	go t.feedloop()
 	go t.ioloop()
 	return t, nil
 }
@@ -54,11 +97,36 @@ func (t *Terminal) SleepToResume() {
 }
 
 func (t *Terminal) EnterRawMode() (err error) {
-	return t.cfg.FuncMakeRaw()
+	if atomic.AddInt32(&t.rawDepth, 1) > 1 {
+		return nil
+	}
+	cfg := t.GetConfig()
+	err = cfg.FuncMakeRaw()
+	if cfg.EnableBracketedPaste && cfg.FuncIsTerminal() &&
+		atomic.CompareAndSwapInt32(&t.bracketedPaste, 0, 1) {
+		t.Write([]byte("\033[?2004h"))
+	}
+	if cfg.EnableMouse && cfg.FuncIsTerminal() &&
+		atomic.CompareAndSwapInt32(&t.mouse, 0, 1) {
+		t.Write([]byte("\033[?1000;1006h"))
+	}
+	return err
 }
 
 func (t *Terminal) ExitRawMode() (err error) {
-	return t.cfg.FuncExitRaw()
+	if n := atomic.AddInt32(&t.rawDepth, -1); n > 0 {
+		return nil
+	} else if n < 0 {
+		// Close exits anyway
+		atomic.StoreInt32(&t.rawDepth, 0)
+	}
+	if atomic.CompareAndSwapInt32(&t.bracketedPaste, 1, 0) {
+		t.Write([]byte("\033[?2004l"))
+	}
+	if atomic.CompareAndSwapInt32(&t.mouse, 1, 0) {
+		t.Write([]byte("\033[?1000;1006l"))
+	}
+	return t.GetConfig().FuncExitRaw()
 }
 
 func (t *Terminal) Write(b []byte) (int, error) {
@@ -76,13 +144,28 @@ type termSize struct {
 	top  int
 }
 
+// GetOffset passes the cursor position as "row;col" to f, it's asked by
+// Config.FuncGetCursorPos if set, otherwise by the DSR (\033[6n) request.
 func (t *Terminal) GetOffset(f func(offset string)) {
+	if getPos := t.GetConfig().FuncGetCursorPos; getPos != nil {
+		if row, col, err := getPos(); err == nil {
+			f(fmt.Sprintf("%d;%d", row, col))
+			return
+		}
+	}
 	go func() {
 		f(<-t.sizeChan)
 	}()
 	t.Write([]byte("\033[6n"))
 }
 
+// Width returns the width of the screen, which is asked by
+// Config.FuncGetWidth every time, so it's the latest one after a resize.
+// It's DefaultScreenWidth if the width is unknown, i.e. not a tty.
+func (t *Terminal) Width() int {
+	return t.GetConfig().screenWidth()
+}
+
 func (t *Terminal) Print(s string) {
 	fmt.Fprintf(t.cfg.Stdout, "%s", s)
 }
@@ -104,8 +187,124 @@ func (t *Terminal) ReadRune() rune {
 	return ch
 }
 
+// ReadRuneTimeout is ReadRune which gives up after d, ok is false if so.
+func (t *Terminal) ReadRuneTimeout(d time.Duration) (r rune, ok bool) {
+	select {
+	case ch, ok := <-t.outchan:
+		if !ok {
+			return 0, true
+		}
+		return ch, true
+	case <-time.After(d):
+		return 0, false
+	}
+}
+
+// ReadRuneAndPause is ReadRune which stops reading stdin after the rune
+// until the next KickRead, so another program can read it meanwhile.
+// paused is false if the reading goes on, i.e. the rune is fed or pasted.
+func (t *Terminal) ReadRuneAndPause() (r rune, paused bool) {
+	select {
+	case r = <-t.outchan:
+		return r, false
+	case r = <-t.pauseChan:
+		return r, true
+	}
+}
+
+// ReadChar reads a single key without the line editing, i.e. for a y/n
+// prompt, the escape sequences are decoded as they are for Readline. If a
+// line is being read, the next key goes to ReadChar instead.
+// It returns io.EOF if stdin is drained, or ErrClosed after Close.
+func (t *Terminal) ReadChar() (rune, error) {
+	if t.IsClosed() {
+		return 0, ErrClosed
+	}
+	t.charM.Lock()
+	defer t.charM.Unlock()
+	t.EnterRawMode()
+	defer t.ExitRawMode()
+
+	atomic.StoreInt32(&t.charReading, 1)
+	defer atomic.StoreInt32(&t.charReading, 0)
+	t.KickRead()
+	select {
+	case r, ok := <-t.charChan:
+		if !ok {
+			return 0, io.EOF
+		}
+		return r, nil
+	case <-t.stopChan:
+		return 0, ErrClosed
+	}
+}
+
+// FeedRunes sends the runes to the Operation as if they're typed, the
+// escape sequences are not decoded so CharLineStart, MetaForward, etc. can
+// be given directly, it's mostly for testing the key handling.
+// It doesn't block, the runes are sent in order once they're read, and
+// dropped on Close or once stdin is drained.
+func (t *Terminal) FeedRunes(rs ...rune) {
+	if len(rs) == 0 {
+		return
+	}
+	t.feedM.Lock()
+	t.feed = append(t.feed, rs...)
+	t.feedM.Unlock()
+	select {
+	case t.feedChan <- struct{}{}:
+	default:
+	}
+}
+
+func (t *Terminal) feedloop() {
+	defer close(t.feedDone)
+	for {
+		select {
+		case <-t.feedChan:
+		case <-t.ioDone:
+			return
+		}
+		for {
+			t.feedM.Lock()
+			if len(t.feed) == 0 {
+				t.feedM.Unlock()
+				break
+			}
+			r := t.feed[0]
+			t.feed = t.feed[1:]
+			t.feedM.Unlock()
+			select {
+			case t.outchan <- r:
+			case <-t.ioDone:
+				return
+			}
+		}
+	}
+}
+
 func (t *Terminal) IsReading() bool {
-	return atomic.LoadInt32(&t.isReading) == 1
+	return atomic.LoadInt32(&t.isReading) == 1 && atomic.LoadInt32(&t.stopRead) == 0
+}
+
+// StopRead stops reading once the key being read is sent, until the next
+// KickRead. A blocking read of stdin can't be interrupted, so the key typed
+// after it is still sent.
+func (t *Terminal) StopRead() {
+	atomic.StoreInt32(&t.stopRead, 1)
+	// the kick of the read given up
+	select {
+	case <-t.kickChan:
+	default:
+	}
+}
+
+// UnreadRunes puts rs back ahead of stdin, so the keys kept by a read given
+// up are handled in order by the next read.
+func (t *Terminal) UnreadRunes(rs ...rune) {
+	t.feedM.Lock()
+	t.unread = append(t.unread, rs...)
+	t.feedM.Unlock()
 }
 
 func (t *Terminal) KickRead() {
@@ -122,7 +321,11 @@ func (t *Terminal) ioloop() {
 	t.wg.Add(1)
 	defer func() {
 		t.wg.Done()
+		// the feedloop may be sending to outchan
+		close(t.ioDone)
+		<-t.feedDone
 		close(t.outchan)
+		close(t.charChan)
 	}()
 
 	type readRune struct {
@@ -155,11 +358,22 @@ func (t *Terminal) ioloop() {
 		}()
 	*/
 	for {
+		if expectNextChar && atomic.LoadInt32(&t.stopRead) == 1 {
+			expectNextChar = false
+		}
 		if !expectNextChar {
 			atomic.StoreInt32(&t.isReading, 0)
 			select {
 			case <-t.kickChan:
+				atomic.StoreInt32(&t.stopRead, 0)
 				atomic.StoreInt32(&t.isReading, 1)
+				t.feedM.Lock()
+				unread := t.unread
+				t.unread = nil
+				t.feedM.Unlock()
+				if !t.sendRunes(unread) {
+					return
+				}
 			case <-t.stopChan:
 				return
 			}
@@ -178,12 +392,30 @@ func (t *Terminal) ioloop() {
 			}
 		*/
 
-		r, _, err := buf.ReadRune()
+		r, err := readFullRune(buf)
+		logger, masked := t.keyLogger()
+		if err == nil && logger != nil {
+			if masked {
+				logf(logger, "read (masked)")
+			} else {
+				logf(logger, "read %q", r)
+			}
+		}
 		if err != nil {
-			if strings.Contains(err.Error(), "interrupted system call") {
+			if isInterrupted(err) {
 				expectNextChar = true
 				continue
 			}
+			if onEOF := t.GetConfig().OnEOF; err == io.EOF && onEOF != nil {
+				if stdin, ok := onEOF(); ok && stdin != nil {
+					t.m.Lock()
+					t.stdin = stdin
+					t.m.Unlock()
+					buf.Reset(stdin)
+					expectNextChar = true
+					continue
+				}
+			}
 			break
 		}
 
@@ -201,10 +433,33 @@ func (t *Terminal) ioloop() {
 				continue
 			}
 			r = escapeKey(r, buf)
+			logf(logger, "escape: key %q (%d)", r, r)
 		} else if isEscapeEx {
 			isEscapeEx = false
 			if key := readEscKey(r, buf); key != nil {
+				logf(logger, "escape: CSI %s%c", key.attr, key.typ)
+				if key.typ == '~' && key.attr == "200" {
+					pasted, err := readPaste(buf)
+					if masked {
+						logf(logger, "paste: %d runes (masked)", len(pasted))
+					} else {
+						logf(logger, "paste: %q", string(pasted))
+					}
+					if !t.sendPaste(pasted) || err != nil {
+						return
+					}
+					expectNextChar = true
+					continue
+				}
+				if mouse, ok := key.mouse(); ok {
+					if !t.sendMouse(mouse) {
+						return
+					}
+					expectNextChar = true
+					continue
+				}
 				r = escapeExKey(key)
+				logf(logger, "escape: key %q (%d)", r, r)
 				// offset
 				if key.typ == 'R' {
 					if _, _, ok := key.Get2(); ok {
@@ -224,7 +479,9 @@ func (t *Terminal) ioloop() {
 		} else if isEscapeSS3 {
 			isEscapeSS3 = false
 			if key := readEscKey(r, buf); key != nil {
+				logf(logger, "escape: SS3 %s%c", key.attr, key.typ)
 				r = escapeSS3Key(key)
+				logf(logger, "escape: key %q (%d)", r, r)
 			}
 			if r == 0 {
 				expectNextChar = true
@@ -233,6 +490,16 @@ func (t *Terminal) ioloop() {
 		}
 
 		expectNextChar = true
+		if r != CharEsc && atomic.CompareAndSwapInt32(&t.charReading, 1, 0) {
+			// stop until the next read
+			expectNextChar = false
+			select {
+			case <-t.stopChan:
+				return
+			case t.charChan <- r:
+			}
+			continue
+		}
 		switch r {
 		case CharEsc:
 			if t.cfg.VimMode {
@@ -257,14 +524,115 @@ func (t *Terminal) ioloop() {
 			case <-t.stopChan:
 				return
 			case t.outchan <- r:
+			case t.pauseChan <- r:
+				// stop until the next read
+				expectNextChar = false
 			}
 		}
 	}
 
 }
 
+// readFullRune reads a rune from buf, a multibyte rune split by an interrupted
+// read is completed by reading more rather than decoded as utf8.RuneError.
+func readFullRune(buf *bufio.Reader) (rune, error) {
+	r, size, err := buf.ReadRune()
+	if err != nil || r != utf8.RuneError || size != 1 {
+		return r, err
+	}
+	buf.UnreadRune()
+	for n := 2; n <= utf8.UTFMax; {
+		b, err := buf.Peek(n)
+		if utf8.FullRune(b) {
+			break
+		}
+		if err == nil {
+			n++
+		} else if !isInterrupted(err) {
+			break
+		}
+	}
+	r, _, err = buf.ReadRune()
+	return r, err
+}
+
+// isInterrupted reports whether a read fails by a signal, it should be
+// retried then.
+func isInterrupted(err error) bool {
+	return strings.Contains(err.Error(), "interrupted system call")
+}
+
+// sendPaste sends the pasted runes between CharPasteStart and CharPasteEnd,
+// it returns false if the terminal is closed.
+func (t *Terminal) sendPaste(pasted []rune) bool {
+	return t.sendRunes(append(append([]rune{CharPasteStart}, pasted...), CharPasteEnd))
+}
+
+// sendRunes sends rs to outchan, it returns false if the terminal is closed.
+func (t *Terminal) sendRunes(rs []rune) bool {
+	for _, r := range rs {
+		select {
+		case <-t.stopChan:
+			return false
+		case t.outchan <- r:
+		}
+	}
+	return true
+}
+
+// sendMouse sends a mouse press after CharMouse, the releases are dropped.
+// It returns false if the terminal is closed.
+func (t *Terminal) sendMouse(mouse []rune) bool {
+	if len(mouse) == 0 {
+		return true
+	}
+	for _, r := range append([]rune{CharMouse}, mouse...) {
+		select {
+		case <-t.stopChan:
+			return false
+		case t.outchan <- r:
+		}
+	}
+	return true
+}
+
+// how long the screen is flashed by BellVisible
+const visibleBellDuration = 100 * time.Millisecond
+
+// CursorShape is the parameter of DECSCUSR (\033[<n> q)
+type CursorShape int
+
+const (
+	// CursorShapeDefault is the shape configured by the user in the terminal
+	CursorShapeDefault CursorShape = iota
+	CursorShapeBlinkingBlock
+	CursorShapeBlock
+	CursorShapeBlinkingUnderline
+	CursorShapeUnderline
+	CursorShapeBlinkingBar
+	CursorShapeBar
+)
+
+// SetCursorShape changes the shape of the cursor, it will be restored to
+// CursorShapeDefault on Close since most terminals can't report the original one.
+func (t *Terminal) SetCursorShape(shape CursorShape) {
+	atomic.StoreInt32(&t.cursorShaped, 1)
+	fmt.Fprintf(t, "\033[%d q", shape)
+}
+
+// Bell rings the bell as Config.BellStyle says.
 func (t *Terminal) Bell() {
-	fmt.Fprintf(t, "%c", CharBell)
+	switch t.GetConfig().BellStyle {
+	case BellNone:
+	case BellVisible:
+		// flash the screen by the reverse video
+		t.Write([]byte("\033[?5h"))
+		time.AfterFunc(visibleBellDuration, func() {
+			t.Write([]byte("\033[?5l"))
+		})
+	default:
+		fmt.Fprintf(t, "%c", CharBell)
+	}
 }
 
 func (t *Terminal) Close() error {
@@ -274,11 +642,25 @@ func (t *Terminal) Close() error {
 	if closer, ok := t.cfg.Stdin.(io.Closer); ok {
 		closer.Close()
 	}
+	t.m.Lock()
+	stdin := t.stdin
+	t.m.Unlock()
+	if closer, ok := stdin.(io.Closer); ok {
+		closer.Close()
+	}
 	close(t.stopChan)
 	t.wg.Wait()
+	if atomic.LoadInt32(&t.cursorShaped) == 1 {
+		t.SetCursorShape(CursorShapeDefault)
+	}
 	return t.ExitRawMode()
 }
 
+// IsClosed reports whether Close is called.
+func (t *Terminal) IsClosed() bool {
+	return atomic.LoadInt32(&t.closed) == 1
+}
+
 func (t *Terminal) GetConfig() *Config {
 	t.m.Lock()
 	cfg := *t.cfg
@@ -286,11 +668,29 @@ func (t *Terminal) GetConfig() *Config {
 	return &cfg
 }
 
+// keyLogger returns Config.Logger, and whether the input is masked so the
+// runes must not be logged.
+func (t *Terminal) keyLogger() (logger io.Writer, masked bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.cfg.Logger, t.cfg.EnableMask
+}
+
 func (t *Terminal) getStdin() io.Reader {
 	t.m.Lock()
-	r := t.cfg.Stdin
-	t.m.Unlock()
-	return r
+	defer t.m.Unlock()
+	if t.stdin != nil {
+		return t.stdin
+	}
+	return t.cfg.Stdin
+}
+
+// updateConfig runs f which changes the Config in place, under the lock
+// GetConfig copies it with.
+func (t *Terminal) updateConfig(f func()) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	f()
 }
 
 func (t *Terminal) SetConfig(c *Config) error {
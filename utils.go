@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strconv"
@@ -86,6 +87,9 @@ const (
 	// 同 MetaBackspace 用来删除光标左边的单词部分。光标位置上的字符保留。整体向左移动。
 	// 如果光标处不是单词字符，则删除其左边的字符直到删除完一个单词。
 	CharCtrlW = 23
+	// CharCtrlX 通过^X输入，作为前缀键与下一个键组合使用。
+	// ^X^R 通过 Config.OnReload 重新加载配置。
+	CharCtrlX = 24
 	// CharCtrlY 通过^Y输入
 	// 将上次删除的字符串。插入到光标左边的位置。光标依旧在其原来的字符上。
 	CharCtrlY = 25
@@ -96,6 +100,8 @@ const (
 	// 使用 ^[输入。
 	// 在vim 模式中使用作为退出编辑模式.
 	CharEsc = 27
+	// CharUndo 通过^_输入，撤销上一次编辑，连续输入的字符作为一次编辑撤销。
+	CharUndo = 31
 	// CharO ASCII 79
 	// ^]O
 	// 	expectNextChar = true
@@ -116,6 +122,32 @@ const (
 	MetaDelete
 	MetaBackspace
 	MetaTranspose
+	// MetaYank replaces the text just yanked by Ctrl+Y with the previous
+	// killed one.
+	MetaYank
+	// MetaRedo \033_ reapplies the edit reverted by CharUndo.
+	MetaRedo
+	// MetaBigBackward and MetaBigForward move by a WORD which is separated
+	// by spaces only, they're sent by Alt+Left and Alt+Right.
+	MetaBigBackward
+	MetaBigForward
+)
+
+// keys without an ASCII code, they are decoded from escape sequences.
+const (
+	// CharInsert \033[2~ toggles the overwrite mode.
+	CharInsert rune = -iota - 100
+	// CharPasteStart and CharPasteEnd surround the runes of a bracketed
+	// paste (\033[200~ ... \033[201~), the runes between them are data.
+	CharPasteStart
+	CharPasteEnd
+	// CharPageUp \033[5~ and CharPageDown \033[6~ recall the oldest and
+	// the newest history item.
+	CharPageUp
+	CharPageDown
+	// CharMouse is followed by the button, the 1-based column and row of a
+	// mouse press (\033[<b;x;yM), see Config.EnableMouse.
+	CharMouse
 )
 
 // WaitForResume need to call before current process got suspend.
@@ -156,6 +188,102 @@ func Restore(fd int, state *State) error {
 	return nil
 }
 
+// noColor reports whether the colors are disabled by NO_COLOR,
+// see https://no-color.org
+func noColor() bool {
+	return os.Getenv("NO_COLOR") != ""
+}
+
+// isTerminalWriter reports whether w writes to a terminal.
+func isTerminalWriter(w io.Writer) bool {
+	f, ok := w.(interface{ Fd() uintptr })
+	return ok && IsTerminal(int(f.Fd()))
+}
+
+const (
+	stripText = iota
+	// after ESC
+	stripEsc
+	// ESC followed by the intermediate bytes, i.e. ESC ( B
+	stripEscIntermediate
+	// in a CSI sequence, ESC [ params intermediates final
+	stripCSI
+	// in an OSC string, terminated by BEL or ESC \
+	stripOSC
+	// after ESC in an OSC string
+	stripOSCEsc
+)
+
+// stripANSIWriter drops the escape sequences written to w and passes the
+// rest through, see Config.StripANSIWhenNotTTY. A sequence may be split
+// across writes.
+type stripANSIWriter struct {
+	w io.Writer
+	// guards state, the writes of the goroutines are kept apart too
+	m     sync.Mutex
+	state int
+}
+
+func (s *stripANSIWriter) Write(p []byte) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch s.state {
+		case stripText:
+			if b == '\033' {
+				s.state = stripEsc
+			} else {
+				out = append(out, b)
+			}
+		case stripEsc:
+			switch {
+			case b == '[':
+				s.state = stripCSI
+			case b == ']':
+				s.state = stripOSC
+			case b >= 0x20 && b <= 0x2f:
+				s.state = stripEscIntermediate
+			case b == '\033':
+				// a lone ESC is dropped
+			default:
+				s.state = stripText
+			}
+		case stripEscIntermediate:
+			if b < 0x20 || b > 0x2f {
+				s.state = stripText
+			}
+		case stripCSI:
+			// the parameter and intermediate bytes are in 0x20-0x3f
+			if b >= 0x40 && b <= 0x7e {
+				s.state = stripText
+			} else if b < 0x20 || b > 0x7e {
+				// malformed, the byte is kept
+				s.state = stripText
+				out = append(out, b)
+			}
+		case stripOSC:
+			if b == '\a' {
+				s.state = stripText
+			} else if b == '\033' {
+				s.state = stripOSCEsc
+			}
+		case stripOSCEsc:
+			if b == '\\' {
+				s.state = stripText
+			} else if b != '\033' {
+				s.state = stripOSC
+			}
+		}
+	}
+	if len(out) > 0 {
+		if _, err := s.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
 func IsPrintable(key rune) bool {
 	isInSurrogateArea := key >= 0xd800 && key <= 0xdbff
 	return key >= 32 && !isInSurrogateArea
@@ -166,9 +294,9 @@ func escapeExKey(key *escapeKeyPair) rune {
 	var r rune
 	switch key.typ {
 	case 'D':
-		r = CharBackward
+		r = modifiedArrow(key, CharBackward, MetaBackward, MetaBigBackward)
 	case 'C':
-		r = CharForward
+		r = modifiedArrow(key, CharForward, MetaForward, MetaBigForward)
 	case 'A':
 		r = CharPrev
 	case 'B':
@@ -178,14 +306,44 @@ func escapeExKey(key *escapeKeyPair) rune {
 	case 'F':
 		r = CharLineEnd
 	case '~':
-		if key.attr == "3" {
+		// the modifiers follow the number, i.e. \033[5;5~ for Ctrl+PageUp
+		switch strings.SplitN(key.attr, ";", 2)[0] {
+		case "1", "7":
+			// \033[1~ in the Linux console and tmux, \033[7~ in rxvt
+			r = CharLineStart
+		case "2":
+			r = CharInsert
+		case "3":
 			r = CharDelete
+		case "4", "8":
+			r = CharLineEnd
+		case "5":
+			r = CharPageUp
+		case "6":
+			r = CharPageDown
 		}
 	default:
 	}
 	return r
 }
 
+// modifiedArrow translates the arrow key with the modifier in the second
+// parameter, i.e. \033[1;5C for Ctrl+Right. The modifier is 1 plus the
+// bits of Shift (1), Alt (2) and Ctrl (4).
+func modifiedArrow(key *escapeKeyPair, plain, ctrl, alt rune) rune {
+	_, mod, ok := key.Get2()
+	if !ok || mod < 1 {
+		return plain
+	}
+	switch bits := mod - 1; {
+	case bits&4 != 0:
+		return ctrl
+	case bits&2 != 0:
+		return alt
+	}
+	return plain
+}
+
 // translate EscOX SS3 codes for up/down/etc.
 func escapeSS3Key(key *escapeKeyPair) rune {
 	var r rune
@@ -228,14 +386,40 @@ func (e *escapeKeyPair) Get2() (int, int, bool) {
 	return s1, s2, true
 }
 
+// mouse parses a SGR mouse report (\033[<b;x;yM), ok is false if it's not
+// one. The button, the column and the row are returned for a press, and
+// nothing for a release (\033[<b;x;ym).
+func (e *escapeKeyPair) mouse() (ret []rune, ok bool) {
+	if (e.typ != 'M' && e.typ != 'm') || !strings.HasPrefix(e.attr, "<") {
+		return nil, false
+	}
+	sp := strings.Split(e.attr[1:], ";")
+	if len(sp) != 3 || e.typ == 'm' {
+		return nil, true
+	}
+	for _, s := range sp {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, true
+		}
+		ret = append(ret, rune(n))
+	}
+	return ret, true
+}
+
+// readEscKey reads the rest of a control sequence, the parameter
+// (0x30-0x3F) and the intermediate (0x20-0x2F) bytes are kept in attr, and
+// typ is the final byte. typ is 0 if the sequence is broken, so it's
+// dropped as a whole rather than leaking into the buffer.
 func readEscKey(r rune, reader *bufio.Reader) *escapeKeyPair {
 	p := escapeKeyPair{}
 	buf := bytes.NewBuffer(nil)
 	for {
-		if r == ';' {
-		} else if unicode.IsNumber(r) {
+		if r >= 0x20 && r <= 0x3f {
 		} else {
-			p.typ = r
+			if r >= 0x40 && r <= 0x7e {
+				p.typ = r
+			}
 			break
 		}
 		buf.WriteRune(r)
@@ -245,6 +429,26 @@ func readEscKey(r rune, reader *bufio.Reader) *escapeKeyPair {
 	return &p
 }
 
+// readPaste reads the content of a bracketed paste until \033[201~,
+// the null runes are dropped.
+func readPaste(reader *bufio.Reader) ([]rune, error) {
+	end := []rune("\033[201~")
+	var ret []rune
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return ret, err
+		}
+		if r == 0 {
+			continue
+		}
+		ret = append(ret, r)
+		if len(ret) >= len(end) && runes.Equal(ret[len(ret)-len(end):], end) {
+			return ret[:len(ret)-len(end)], nil
+		}
+	}
+}
+
 // translate EscX to Meta+X
 func escapeKey(r rune, reader *bufio.Reader) rune {
 	switch r {
@@ -254,6 +458,10 @@ func escapeKey(r rune, reader *bufio.Reader) rune {
 		r = MetaForward
 	case 'd':
 		r = MetaDelete
+	case 'y':
+		r = MetaYank
+	case '_':
+		r = MetaRedo
 	case CharTranspose:
 		r = MetaTranspose
 	case CharBackspace:
@@ -278,8 +486,11 @@ func SplitByLine(start, screenWidth int, rs []rune) []string {
 	var ret []string
 	buf := bytes.NewBuffer(nil)
 	currentWidth := start
-	for _, r := range rs {
-		w := runes.Width(r)
+	for i, r := range rs {
+		w := runes.WidthAt(rs, i)
+		if r == '\t' {
+			w = tabAdvance(currentWidth, TabWidth)
+		}
 		currentWidth += w
 		buf.WriteRune(r)
 		if currentWidth >= screenWidth {
@@ -301,6 +512,25 @@ func LineCount(screenWidth, w int) int {
 	return r
 }
 
+const (
+	// DefaultScreenWidth is used when the terminal reports no width
+	DefaultScreenWidth = 80
+	// MaxScreenWidth is the largest width we trust
+	MaxScreenWidth = 10000
+)
+
+// sanitizeWidth falls back to DefaultScreenWidth if w is not positive
+// (not a tty or a misbehaving terminal) and caps it with MaxScreenWidth.
+func sanitizeWidth(w int) int {
+	if w <= 0 {
+		return DefaultScreenWidth
+	}
+	if w > MaxScreenWidth {
+		return MaxScreenWidth
+	}
+	return w
+}
+
 func IsWordBreak(i rune) bool {
 	switch {
 	case i >= 'a' && i <= 'z':
@@ -312,6 +542,12 @@ func IsWordBreak(i rune) bool {
 	return false
 }
 
+// FilePathWordBreak is a Config.WordBreakFunc which only breaks the words
+// by spaces, so Ctrl+W deletes a whole path like /usr/local/bin.
+func FilePathWordBreak(r rune) bool {
+	return unicode.IsSpace(r)
+}
+
 func GetInt(s []string, def int) int {
 	if len(s) == 0 {
 		return def
@@ -356,11 +592,74 @@ func debugList(l *list.List) {
 	}
 }
 
-// Debug append log info to another file
+// DebugFileEnv is the environment variable naming the file Debug appends
+// to if SetDebugFile is not called.
+const DebugFileEnv = "READLINE_DEBUG_FILE"
+
+// the file of Debug, it's kept open once it's set
+var debugOut struct {
+	sync.Mutex
+	envOnce sync.Once
+	path    string
+	f       *os.File
+	// the logger preferred to the file, see SetDebugLogger
+	logger io.Writer
+}
+
+// SetDebugLogger makes Debug write to w instead of the debug file, i.e. the
+// Config.Logger of the application. The file is used again if w is nil.
+func SetDebugLogger(w io.Writer) {
+	debugOut.Lock()
+	debugOut.logger = w
+	debugOut.Unlock()
+}
+
+// SetDebugFile switches the file Debug appends to for the whole process,
+// the previous one is closed. Debug is disabled if path is empty, and
+// DebugFileEnv is ignored once it's called.
+func SetDebugFile(path string) error {
+	debugOut.envOnce.Do(func() {})
+	return openDebugFile(path)
+}
+
+func openDebugFile(path string) error {
+	debugOut.Lock()
+	defer debugOut.Unlock()
+	if path == debugOut.path {
+		return nil
+	}
+	if debugOut.f != nil {
+		debugOut.f.Close()
+		debugOut.f = nil
+	}
+	debugOut.path = ""
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	debugOut.path, debugOut.f = path, f
+	return nil
+}
+
+// Debug writes log info to the logger set by SetDebugLogger, or appends it
+// to the file set by SetDebugFile or named by the READLINE_DEBUG_FILE
+// environment variable. It does nothing if none is set.
 func Debug(o ...interface{}) {
-	f, _ := os.OpenFile("debug.tmp", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	fmt.Fprintln(f, o...)
-	f.Close()
+	debugOut.envOnce.Do(func() {
+		if path := os.Getenv(DebugFileEnv); path != "" {
+			openDebugFile(path)
+		}
+	})
+	debugOut.Lock()
+	defer debugOut.Unlock()
+	if debugOut.logger != nil {
+		fmt.Fprintln(debugOut.logger, o...)
+	} else if debugOut.f != nil {
+		fmt.Fprintln(debugOut.f, o...)
+	}
 }
 
 func CaptureExitSignal(f func()) {
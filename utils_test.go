@@ -1 +1,172 @@
 package readline
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSanitizeWidth(t *testing.T) {
+	for _, c := range []struct {
+		w, expect int
+	}{
+		{-1, DefaultScreenWidth},
+		{0, DefaultScreenWidth},
+		{1, 1},
+		{120, 120},
+		{65535, MaxScreenWidth},
+	} {
+		if w := sanitizeWidth(c.w); w != c.expect {
+			t.Fatal("result not expect", c.w, c.expect, w)
+		}
+	}
+}
+
+func TestEscapeExKey(t *testing.T) {
+	for _, c := range []struct {
+		seq    string
+		expect rune
+	}{
+		{"1~", CharLineStart},
+		{"7~", CharLineStart},
+		{"H", CharLineStart},
+		{"4~", CharLineEnd},
+		{"8~", CharLineEnd},
+		{"F", CharLineEnd},
+		{"2~", CharInsert},
+		{"3~", CharDelete},
+		{"5~", CharPageUp},
+		{"6~", CharPageDown},
+		{"5;5~", CharPageUp},
+		{"C", CharForward},
+		{"1;2C", CharForward},
+		{"1;5C", MetaForward},
+		{"1;5D", MetaBackward},
+		{"1;3C", MetaBigForward},
+		{"1;3D", MetaBigBackward},
+		{"1;7D", MetaBackward},
+		// the cursor position report is handled by the terminal
+		{"12;40R", 0},
+		// unknown ones are dropped
+		{"9~", 0},
+		{"?25h", 0},
+		{"12\x01", 0},
+	} {
+		reader := bufio.NewReader(strings.NewReader(c.seq[1:]))
+		key := readEscKey(rune(c.seq[0]), reader)
+		if r := escapeExKey(key); r != c.expect {
+			t.Fatalf("%q: expect %v, got %v", c.seq, c.expect, r)
+		}
+		if reader.Buffered() != 0 {
+			t.Fatalf("%q: sequence not read", c.seq)
+		}
+	}
+}
+
+func TestStripANSIWriter(t *testing.T) {
+	for _, c := range []struct {
+		in, expect string
+	}{
+		{"plain 文本\r\n", "plain 文本\r\n"},
+		{"\033[1;31mred\033[0m", "red"},
+		{"\033[?2004h> \033[2K\r\033[5C", "> \r"},
+		{"\033]0;title\a\033]8;;http://x\033\\link", "link"},
+		{"\033(Bcharset\033=keypad", "charsetkeypad"},
+		// a malformed CSI keeps the control byte
+		{"\033[1\nnext", "\nnext"},
+	} {
+		// written at once and byte by byte
+		for _, size := range []int{len(c.in), 1} {
+			out := bytes.NewBuffer(nil)
+			w := &stripANSIWriter{w: out}
+			for in := []byte(c.in); len(in) > 0; {
+				n := size
+				if n > len(in) {
+					n = len(in)
+				}
+				if m, err := w.Write(in[:n]); m != n || err != nil {
+					t.Fatal("write failed", m, err)
+				}
+				in = in[n:]
+			}
+			if out.String() != c.expect {
+				t.Fatalf("result not expect %q %q", c.in, out.String())
+			}
+		}
+	}
+
+	cfg := &Config{Stdout: bytes.NewBuffer(nil), StripANSIWhenNotTTY: true}
+	cfg.Init()
+	if _, ok := cfg.Stdout.(*stripANSIWriter); !ok {
+		t.Fatal("stdout not wrapped")
+	}
+}
+
+func TestStripANSIWriterConcurrent(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	w := &stripANSIWriter{w: out}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.Write([]byte("\033[1;31mab\033[0m"))
+			}
+		}()
+	}
+	wg.Wait()
+	if out.String() != strings.Repeat("ab", 400) {
+		t.Fatalf("result not expect %q", out.String())
+	}
+}
+
+func TestDebugFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "readline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// disabled by default
+	Debug("dropped")
+	if _, err := os.Stat("debug.tmp"); !os.IsNotExist(err) {
+		t.Fatal("debug.tmp created", err)
+	}
+
+	path := filepath.Join(dir, "debug.log")
+	if err := SetDebugFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer SetDebugFile("")
+	Debug("hello", 1)
+	Debug("world")
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "hello 1\nworld\n" {
+		t.Fatalf("result not expect %q %v", data, err)
+	}
+
+	// a Config leaves it alone
+	cfg := &Config{Stdin: ioutil.NopCloser(strings.NewReader(""))}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// it's closed when disabled
+	SetDebugFile("")
+	Debug("dropped")
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "hello 1\nworld\n" {
+		t.Fatalf("result not expect %q %v", data, err)
+	}
+	if err := SetDebugFile(filepath.Join(dir, "missing", "debug.log")); err == nil {
+		t.Fatal("the missing directory is opened")
+	}
+}
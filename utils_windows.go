@@ -4,7 +4,9 @@ package readline
 
 import (
 	"io"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func SuspendMe() {
@@ -36,6 +38,24 @@ func DefaultIsTerminal() bool {
 	return true
 }
 
-func DefaultOnWidthChanged(func()) {
+var (
+	widthChange         sync.Once
+	widthChangeCallback func()
+)
 
+// DefaultOnWidthChanged polls the console size since there is no SIGWINCH
+// on windows.
+func DefaultOnWidthChanged(f func()) {
+	widthChangeCallback = f
+	widthChange.Do(func() {
+		go func() {
+			width := GetScreenWidth()
+			for range time.Tick(500 * time.Millisecond) {
+				if w := GetScreenWidth(); w != width {
+					width = w
+					widthChangeCallback()
+				}
+			}
+		}()
+	})
 }
@@ -24,62 +24,117 @@ func newVimMode(op *Operation) *opVim {
 func (o *opVim) SetVimMode(on bool) {
 	if o.cfg.VimMode && !on { // turn off
 		o.ExitVimMode()
+		if o.op.GetConfig().VimCursorShapes {
+			o.op.t.SetCursorShape(CursorShapeDefault)
+		}
 	}
 	o.cfg.VimMode = on
 	o.vimMode = VIM_INSERT
+	o.updateModeIndicator()
 }
 
 func (o *opVim) ExitVimMode() {
 	o.vimMode = VIM_INSERT
+	o.updateCursorShape()
+	o.updateModeIndicator()
+}
+
+// DefaultVimModeIndicator shows the vim mode like vim does, it can be used
+// as Config.VimModeIndicator.
+func DefaultVimModeIndicator(mode int) []rune {
+	if mode == VIM_NORMAL {
+		return []rune("-- NORMAL --")
+	}
+	return []rune("-- INSERT --")
+}
+
+// updateModeIndicator redraws the line if the text of
+// Config.VimModeIndicator is changed.
+func (o *opVim) updateModeIndicator() {
+	var indicator []rune
+	if f := o.op.GetConfig().VimModeIndicator; f != nil && o.IsEnableVimMode() {
+		indicator = f(o.vimMode)
+	}
+	if o.op.buf.setModeIndicator(indicator) {
+		o.op.Refresh()
+	}
+}
+
+// updateCursorShape reflects the vim mode in the cursor shape if
+// Config.VimCursorShapes is enabled.
+func (o *opVim) updateCursorShape() {
+	if !o.IsEnableVimMode() || !o.op.GetConfig().VimCursorShapes {
+		return
+	}
+	if o.vimMode == VIM_NORMAL {
+		o.op.t.SetCursorShape(CursorShapeBlock)
+	} else {
+		o.op.t.SetCursorShape(CursorShapeBar)
+	}
 }
 
 func (o *opVim) IsEnableVimMode() bool {
 	return o.cfg.VimMode
 }
 
-func (o *opVim) handleVimNormalMovement(r rune, readNext func() rune) (t rune, handled bool) {
+// handleVimNormalMovement handles the commands staying in the normal mode,
+// count is the count typed before the command, it's 1 if there is none.
+func (o *opVim) handleVimNormalMovement(r rune, count int, readNext func() rune) (t rune, handled bool) {
 	rb := o.op.buf
 	handled = true
 	switch r {
 	case 'h':
-		t = CharBackward
+		rb.repeat(count, rb.MoveBackward)
 	case 'j':
 		t = CharNext
 	case 'k':
 		t = CharPrev
 	case 'l':
-		t = CharForward
+		rb.repeat(count, rb.MoveForward)
 	case '0', '^':
-		rb.MoveToLineStart()
+		rb.MoveToLogicalLineStart()
 	case '$':
-		rb.MoveToLineEnd()
+		rb.MoveToLogicalLineEnd()
 	case 'x':
-		rb.Delete()
+		rb.repeatKill(count, func() { rb.Delete() })
 		if rb.IsCursorInEnd() {
 			rb.MoveBackward()
 		}
 	case 'r':
-		rb.Replace(readNext())
+		if next := readNext(); next == CharEsc || !rb.ReplaceN(next, count) {
+			o.op.t.Bell()
+		}
+	case '~':
+		if !rb.ToggleCase(count) {
+			o.op.t.Bell()
+		}
 	case 'd':
-		next := readNext()
+		n, next := readCount(readNext(), readNext, rb.Len())
+		count = clampCount(count*n, rb.Len())
 		switch next {
 		case 'd':
 			rb.Erase()
 		case 'w':
-			rb.DeleteWord()
+			rb.repeatKill(count, rb.DeleteWord)
 		case 'h':
-			rb.Backspace()
+			rb.repeatKill(count, rb.Backspace)
 		case 'l':
-			rb.Delete()
+			rb.repeatKill(count, func() { rb.Delete() })
+		case 'i':
+			if !o.deleteInner(readNext()) {
+				o.op.t.Bell()
+			} else if rb.IsCursorInEnd() {
+				rb.MoveBackward()
+			}
 		}
 	case 'p':
 		rb.Yank()
 	case 'b', 'B':
-		rb.MoveToPrevWord()
+		rb.repeat(count, func() { rb.MoveWordBackward(r == 'B') })
 	case 'w', 'W':
-		rb.MoveToNextWord()
+		rb.repeat(count, func() { rb.MoveWordForward(r == 'W') })
 	case 'e', 'E':
-		rb.MoveToEndWord()
+		rb.repeat(count, func() { rb.MoveToEndOfWord(r == 'E') })
 	case 'f', 'F', 't', 'T':
 		next := readNext()
 		prevChar := r == 't' || r == 'T'
@@ -95,32 +150,39 @@ func (o *opVim) handleVimNormalMovement(r rune, readNext func() rune) (t rune, h
 	return t, true
 }
 
-func (o *opVim) handleVimNormalEnterInsert(r rune, readNext func() rune) (t rune, handled bool) {
+func (o *opVim) handleVimNormalEnterInsert(r rune, count int, readNext func() rune) (t rune, handled bool) {
 	rb := o.op.buf
 	handled = true
 	switch r {
 	case 'i':
 	case 'I':
-		rb.MoveToLineStart()
+		rb.MoveToLogicalLineStart()
 	case 'a':
 		rb.MoveForward()
 	case 'A':
-		rb.MoveToLineEnd()
+		rb.MoveToLogicalLineEnd()
 	case 's':
-		rb.Delete()
+		rb.repeatKill(count, func() { rb.Delete() })
 	case 'S':
 		rb.Erase()
 	case 'c':
-		next := readNext()
+		n, next := readCount(readNext(), readNext, rb.Len())
+		count = clampCount(count*n, rb.Len())
 		switch next {
 		case 'c':
 			rb.Erase()
 		case 'w':
-			rb.DeleteWord()
+			rb.repeatKill(count, rb.DeleteWord)
 		case 'h':
-			rb.Backspace()
+			rb.repeatKill(count, rb.Backspace)
 		case 'l':
-			rb.Delete()
+			rb.repeatKill(count, func() { rb.Delete() })
+		case 'i':
+			if !o.deleteInner(readNext()) {
+				// stay in the normal mode
+				o.op.t.Bell()
+				return 0, true
+			}
 		}
 	default:
 		return r, false
@@ -130,18 +192,60 @@ func (o *opVim) handleVimNormalEnterInsert(r rune, readNext func() rune) (t rune
 	return
 }
 
+// deleteInner deletes the text object selected by "i" and obj, i.e. the
+// inner word by "iw" and the quoted text by `i"`.
+func (o *opVim) deleteInner(obj rune) bool {
+	switch obj {
+	case 'w':
+		return o.op.buf.DeleteInnerWord()
+	case '"', '\'', '`':
+		return o.op.buf.DeleteInnerQuote(obj)
+	}
+	return false
+}
+
+// readCount reads the count before a command or a motion, i.e. 3 of "3dw"
+// and 2 of "d2w", r is the first key. 0 is a motion if it's not in a
+// count. The count is 1 if there is none, it's clamped by clampCount for
+// a line of size runes.
+func readCount(r rune, readNext func() rune, size int) (count int, next rune) {
+	for r >= '1' && r <= '9' || count > 0 && r == '0' {
+		// the rest of a long count is read but doesn't overflow it
+		if count <= size {
+			count = count*10 + int(r-'0')
+		}
+		r = readNext()
+	}
+	return clampCount(count, size), r
+}
+
+// clampCount bounds count by size+1 for a line of size runes, a command
+// repeated more times changes nothing more, but it still fails if it
+// needs more runes than the line has.
+func clampCount(count, size int) int {
+	if count < 1 {
+		return 1
+	}
+	if count > size+1 {
+		return size + 1
+	}
+	return count
+}
+
 func (o *opVim) HandleVimNormal(r rune, readNext func() rune) (t rune) {
+	count, r := readCount(r, readNext, o.op.buf.Len())
+
 	switch r {
 	case CharEnter, CharInterrupt:
 		o.ExitVimMode()
 		return r
 	}
 
-	if r, handled := o.handleVimNormalMovement(r, readNext); handled {
+	if r, handled := o.handleVimNormalMovement(r, count, readNext); handled {
 		return r
 	}
 
-	if r, handled := o.handleVimNormalEnterInsert(r, readNext); handled {
+	if r, handled := o.handleVimNormalEnterInsert(r, count, readNext); handled {
 		return r
 	}
 
@@ -152,10 +256,14 @@ func (o *opVim) HandleVimNormal(r rune, readNext func() rune) (t rune) {
 
 func (o *opVim) EnterVimInsertMode() {
 	o.vimMode = VIM_INSERT
+	o.updateCursorShape()
+	o.updateModeIndicator()
 }
 
 func (o *opVim) ExitVimInsertMode() {
 	o.vimMode = VIM_NORMAL
+	o.updateCursorShape()
+	o.updateModeIndicator()
 }
 
 func (o *opVim) HandleVim(r rune, readNext func() rune) rune {